@@ -2,14 +2,19 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"os"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/alexflint/go-arg"
+	"github.com/open-dynaMIX/anonip-go/anonip"
 )
-import "bufio"
-import "net"
-import "github.com/alexflint/go-arg"
 
 var version = "0.0.0-alpha.1"
 
@@ -18,17 +23,6 @@ var osExit = os.Exit
 var defaultLogWriter = os.Stdout
 var defaultLogReader io.Reader = os.Stdin
 
-var privateIPBlocksStrings = []string{
-	"127.0.0.0/8",    // IPv4 loopback
-	"10.0.0.0/8",     // RFC1918
-	"172.16.0.0/12",  // RFC1918
-	"192.168.0.0/16", // RFC1918
-	"169.254.0.0/16", // RFC3927 link-local
-	"::1/128",        // IPv6 loopback
-	"fe80::/10",      // IPv6 link-local
-	"fc00::/7",       // IPv6 unique local addr
-}
-
 // OpenFile is a wrapper around os.OpenFile for centralization of error handling
 func OpenFile(name string, flag int, perm os.FileMode) *os.File {
 	f, err := os.OpenFile(name, flag, perm)
@@ -40,210 +34,432 @@ func OpenFile(name string, flag int, perm os.FileMode) *os.File {
 	return f
 }
 
-var privateIPBlocks []*net.IPNet
+func logError(err error) {
+	_, _ = os.Stderr.WriteString("error: " + err.Error() + "\n")
+}
 
-func initPrivateIPBlocks() {
-	for _, cidr := range privateIPBlocksStrings {
-		_, block, err := net.ParseCIDR(cidr)
-		if err != nil {
-			logError(err)
-			osExit(2)
-			return // just in case osExit was monkey-patched
+// ReverseCmd restores the original addresses of a log anonymized with mode
+// encrypt. It shares all options with the top-level command.
+type ReverseCmd struct{}
+
+// PcapCmd anonymizes the addresses of a capture file in pcap or pcapng format.
+// It shares all options with the top-level command.
+type PcapCmd struct{}
+
+// Args will hold parsed CLI arguments
+type Args struct {
+	Reverse        *ReverseCmd      `arg:"subcommand:reverse" help:"decrypt a log anonymized with mode encrypt"`
+	Serve          *ServeCmd        `arg:"subcommand:serve" help:"receive syslog messages over the network and forward them anonymized"`
+	Pcap           *PcapCmd         `arg:"subcommand:pcap" help:"anonymize a pcap or pcapng capture file"`
+	IPV4Mask       int              `arg:"-4,--ipv4mask,env:ANONIP_IPV4MASK" default:"12" placeholder:"INTEGER" help:"truncate the last n bits"`
+	IPV6Mask       int              `arg:"-6,--ipv6mask,env:ANONIP_IPV6MASK" default:"84" placeholder:"INTEGER" help:"truncate the last n bits"`
+	Increment      uint             `arg:"-i,--increment,env:ANONIP_INCREMENT" default:"0" placeholder:"INTEGER" help:"increment the IP address by n"`
+	Mode           string           `arg:"-m,--mode,env:ANONIP_MODE" default:"truncate" placeholder:"MODE" help:"anonymization mode: truncate, hmac, cryptopan or encrypt"`
+	KeyFile        string           `arg:"-k,--key-file,env:ANONIP_KEY_FILE" placeholder:"FILE" help:"file containing the secret key for keyed modes"`
+	Key            []byte           `arg:"-"`
+	RawOutput      string           `arg:"-o,--output,env:ANONIP_OUTPUT" placeholder:"FILE" help:"file or FIFO to write to [default: stdout]"`
+	Output         io.Writer        `arg:"-"`
+	Compress       string           `arg:"--output-compress,env:ANONIP_OUTPUT_COMPRESS" placeholder:"COMPRESSION" help:"compress the output: none, gzip or zstd [default: by the extension of --output]"`
+	Closer         io.Closer        `arg:"-"`
+	OutputFile     outputFile       `arg:"-"`
+	OutputDir      string           `arg:"--output-dir,env:ANONIP_OUTPUT_DIR" placeholder:"DIR" help:"write one file per input file to this directory, named like the input below the directory or glob it was found by"`
+	RawInput       []string         `arg:"--input,separate,env:ANONIP_INPUT" placeholder:"FILE" help:"file, FIFO, glob or directory to read from, decompressing gzip, zstd, bzip2 and xz. Directories are read recursively. Can be given multiple times [default: stdin]"`
+	Inputs         []InputFile      `arg:"-"`
+	Input          io.Reader        `arg:"-"`
+	InPlace        bool             `arg:"--in-place,env:ANONIP_IN_PLACE" default:"false" help:"replace the input files by their anonymized content, keeping their compression unless --output-compress is given"`
+	BackupSuffix   string           `arg:"--backup-suffix,env:ANONIP_BACKUP_SUFFIX" placeholder:"SUFFIX" help:"with --in-place, keep the original files with this suffix appended"`
+	Follow         bool             `arg:"-F,--follow,env:ANONIP_FOLLOW" default:"false" help:"keep reading the input file as it grows, reopening it when it is rotated"`
+	StateFile      string           `arg:"--state-file,env:ANONIP_STATE_FILE" placeholder:"FILE" help:"record the position after the last line written in FILE, and resume from there"`
+	RawRotateSize  string           `arg:"--rotate-size,env:ANONIP_ROTATE_SIZE" placeholder:"SIZE" help:"rotate --output before it grows beyond SIZE bytes, which may have a K, M or G suffix"`
+	RotateInterval time.Duration    `arg:"--rotate-interval,env:ANONIP_ROTATE_INTERVAL" placeholder:"DURATION" help:"rotate --output at multiples of DURATION, so 24h rotates at midnight UTC"`
+	RotateKeep     int              `arg:"--rotate-keep,env:ANONIP_ROTATE_KEEP" placeholder:"INTEGER" help:"number of rotated files to keep [default: all]"`
+	RotateCompress string           `arg:"--rotate-compress,env:ANONIP_ROTATE_COMPRESS" placeholder:"COMPRESSION" help:"compress rotated files: none, gzip or zstd [default: none]"`
+	FlushInterval  time.Duration    `arg:"--flush-interval,env:ANONIP_FLUSH_INTERVAL" default:"1s" placeholder:"DURATION" help:"longest time output is buffered, 0 disables. Output is flushed whenever the input is idle as well"`
+	FlushLines     int              `arg:"--flush-lines,env:ANONIP_FLUSH_LINES" default:"0" placeholder:"INTEGER" help:"flush output once this many lines are buffered, 0 disables"`
+	Jobs           int              `arg:"-j,--jobs,env:ANONIP_JOBS" placeholder:"INTEGER" help:"number of input files to process concurrently with --output-dir or --in-place [default: number of CPUs]"`
+	Format         string           `arg:"-f,--format,env:ANONIP_FORMAT" default:"text" placeholder:"FORMAT" help:"log format: text, json, logfmt, csv, tsv, w3c or syslog"`
+	Fields         []string         `arg:"--field,separate,env:ANONIP_FIELDS" placeholder:"PATH" help:"dotted path of a field holding IP addresses, for format json. Can be given multiple times"`
+	Keys           []string         `arg:"--key,separate,env:ANONIP_KEYS" placeholder:"KEY" help:"key holding IP addresses, for format logfmt. Can be given multiple times"`
+	ColumnNames    []string         `arg:"--column-name,separate,env:ANONIP_COLUMN_NAMES" placeholder:"NAME" help:"name of a column holding IP addresses, for formats csv, tsv and w3c. For csv and tsv, the first line is used as header. Can be given multiple times"`
+	Preset         string           `arg:"--preset,env:ANONIP_PRESET" placeholder:"PRESET" help:"locate addresses by a built-in log format: apache-common, envoy, haproxy-http, iis-w3c or nginx-combined"`
+	Columns        []uint           `arg:"-c,--columns,env:ANONIP_COLUMNS" placeholder:"INTEGER [INTEGER ...]" help:"assume IP address is in column n (1-based indexed) [default: 0]"`
+	Delimiter      string           `arg:"-l,--delimiter,env:ANONIP_DELIMITER" default:" " placeholder:"STRING" help:"log delimiter"`
+	Replace        *string          `arg:"-r,--replace,env:ANONIP_REPLACE" placeholder:"STRING" help:"replacement string in case address parsing fails (Example: 0.0.0.0)"`
+	RawRegex       []string         `arg:"--regex,env:ANONIP_REGEX" placeholder:"STRING [STRING ...]" help:"regex, each applied independently. Capture groups hold the addresses; if there are named groups, only those"`
+	Regexes        []*regexp.Regexp `arg:"-"`
+	RawRules       []string         `arg:"--rules,env:ANONIP_RULES" placeholder:"RULE [RULE ...]" help:"anonymize networks differently, longest prefix first. RULE is \"CIDR keep\", \"CIDR mask BITS\" or \"default mask BITS\""`
+	RulesFile      string           `arg:"--rules-file,env:ANONIP_RULES_FILE" placeholder:"FILE" help:"file with one rule per line"`
+	Rules          []anonip.Rule    `arg:"-"`
+	Scan           bool             `arg:"-s,--scan,env:ANONIP_SCAN" default:"false" help:"find addresses anywhere in a line, ignoring columns and regex"`
+	SkipPrivate    bool             `arg:"-p,--skip-private,env:ANONIP_SKIP_PRIVATE" default:"false" help:"do not mask addresses that are not globally reachable. See IANA Special-Purpose Address Registries"`
+	RawSkip        []string         `arg:"--skip-cidr,env:ANONIP_SKIP_CIDR" placeholder:"CIDR [CIDR ...]" help:"do not mask addresses in these networks. Also accepts single addresses and set names, see README"`
+	SkipFile       string           `arg:"--skip-file,env:ANONIP_SKIP_FILE" placeholder:"FILE" help:"file with one network to skip per line"`
+	Skip           []*net.IPNet     `arg:"-"`
+	Workers        int              `arg:"-w,--workers,env:ANONIP_WORKERS" default:"1" placeholder:"INTEGER" help:"number of lines to process concurrently"`
+	Version        bool             `arg:"-v,--version" default:"false" help:"show program's version number and exit"`
+}
+
+func (args *Args) validateOutput() {
+	args.Output = defaultLogWriter
+	if output := strings.Trim(args.RawOutput, " "); output != "" && !args.rotates() {
+		file := &reopenFile{
+			name: args.RawOutput,
+			flag: args.outputFlag(),
+			file: OpenFile(args.RawOutput, args.outputFlag(), 0660),
 		}
-		privateIPBlocks = append(privateIPBlocks, block)
+		args.Output = file
+		args.OutputFile = file
 	}
 }
 
-// IsPrivateIP returns true for IP addresses in private blocks
-func IsPrivateIP(ip net.IP) bool {
-	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
-		return true
+func (args *Args) validateInput() error {
+	args.Input = defaultLogReader
+	seen := make(map[string]bool)
+	for _, raw := range args.RawInput {
+		files, err := expandInput(strings.Trim(raw, " "))
+		if err != nil {
+			return errors.New("argument --input: " + err.Error())
+		}
+		for _, file := range files {
+			if !seen[file.Path] {
+				seen[file.Path] = true
+				args.Inputs = append(args.Inputs, file)
+			}
+		}
 	}
+	return nil
+}
 
-	for _, block := range privateIPBlocks {
-		if block.Contains(ip) {
-			return true
+func (args *Args) validateOutputDir() error {
+	switch {
+	case args.OutputDir == "":
+		if args.Pcap != nil && len(args.Inputs) > 1 && !args.InPlace {
+			return errors.New("pcap: multiple input files require --output-dir")
+		}
+	case args.RawOutput != "":
+		return errors.New("argument --output-dir: not allowed with argument -o/--output")
+	case len(args.Inputs) == 0:
+		return errors.New("argument --output-dir: requires argument --input")
+	default:
+		// concurrent writes to the same file would mix up their lines
+		paths := make(map[string]string)
+		for _, input := range args.Inputs {
+			if path, ok := paths[input.Name]; ok {
+				return errors.New("argument --output-dir: " + path + " and " + input.Path + " would both be written to " + input.Name)
+			}
+			paths[input.Name] = input.Path
 		}
 	}
-	return false
+	return nil
 }
 
-// MaskIP masks a single IP address
-func MaskIP(ip net.IP, IPV4Mask int, IPV6Mask int) net.IP {
-	if ip := ip.To4(); ip != nil {
-		mask := net.CIDRMask(32-IPV4Mask, 32)
-		return ip.Mask(mask)
+func (args *Args) validateInPlace() error {
+	switch {
+	case !args.InPlace:
+		if args.BackupSuffix != "" {
+			return errors.New("argument --backup-suffix: requires argument --in-place")
+		}
+	case len(args.Inputs) == 0:
+		return errors.New("argument --in-place: requires argument --input")
+	case args.RawOutput != "" || args.OutputDir != "":
+		return errors.New("argument --in-place: not allowed with arguments -o/--output and --output-dir")
 	}
-	mask := net.CIDRMask(128-IPV6Mask, 128)
-	return ip.Mask(mask)
+	return nil
 }
 
-// IncrementIP imcrements a single IP address
-func IncrementIP(ip net.IP, amount uint) {
-	for i := len(ip) - 1; i >= 0; i-- {
-		ip[i] += byte(amount)
-		if ip[i] != 0 {
-			break
-		}
+func (args *Args) validateFollow() error {
+	switch {
+	case !args.Follow:
+	case len(args.Inputs) != 1:
+		return errors.New("argument -F/--follow: requires a single input file")
+	case args.OutputDir != "" || args.InPlace:
+		return errors.New("argument -F/--follow: not allowed with arguments --output-dir and --in-place")
+	case args.Pcap != nil:
+		return errors.New("pcap: argument -F/--follow is not supported")
+	}
+	switch {
+	case args.StateFile == "":
+	case !args.Follow:
+		return errors.New("argument --state-file: requires argument -F/--follow")
+	case args.outputCompression(args.RawOutput) != anonip.CompressionNone:
+		// lines are only written once the compressed stream is complete
+		return errors.New("argument --state-file: not allowed with compressed output")
 	}
+	return nil
 }
 
-func trimBrackets(ipString string) (string, net.IP) {
-	ipString = strings.Trim(ipString, "[]")
-	return ipString, net.ParseIP(ipString)
+func (args *Args) validateFlush() error {
+	switch {
+	case args.FlushInterval < 0:
+		return errors.New("argument --flush-interval: must not be negative")
+	case args.FlushLines < 0:
+		return errors.New("argument --flush-lines: must not be negative")
+	}
+	return nil
 }
 
-func handlePort(ipString string) (string, net.IP) {
-	strippedIPString, _, err := net.SplitHostPort(ipString)
-	if err != nil {
-		parts := strings.Split(ipString, "]")
-		if len(parts) > 1 {
-			return parts[0], net.ParseIP(parts[0])
-		}
-		return ipString, nil
+func (args *Args) validateJobs() error {
+	if args.Jobs < 0 {
+		return errors.New("argument -j/--jobs: must be an integer greater than 0")
+	}
+	if args.Jobs == 0 {
+		args.Jobs = runtime.NumCPU()
 	}
+	return nil
+}
 
-	return strippedIPString, net.ParseIP(strippedIPString)
+// rotates tells whether --output is rotated
+func (args *Args) rotates() bool {
+	return args.RawRotateSize != "" || args.RotateInterval != 0
 }
 
-// GetIP extracts an IP address from a string
-func GetIP(ipString string) (string, net.IP) {
-	ip := net.ParseIP(ipString)
-	if ip == nil {
-		ipString, ip = trimBrackets(ipString)
-		if ip == nil {
-			return handlePort(ipString)
-		}
-		return ipString, ip
+// parseSize parses a number of bytes, which may have a K, M or G suffix
+func parseSize(raw string) (int64, error) {
+	multiplier := int64(1)
+	raw = strings.ToUpper(strings.Trim(raw, " "))
+	if i := strings.IndexAny(raw, "KMG"); i >= 0 && i == len(raw)-1 {
+		multiplier = 1 << (10 * (strings.Index("KMG", raw[i:]) + 1))
+		raw = raw[:i]
 	}
-	return ipString, ip
+	size, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, errors.New("must be a number of bytes greater than 0, which may have a K, M or G suffix")
+	}
+	return size * multiplier, nil
 }
 
-// GetIPStringsRegex extracts IP addresses as strings with regex
-func GetIPStringsRegex(line string, regex *regexp.Regexp) []string {
-	return regex.FindStringSubmatch(line)
+func (args *Args) validateRotate() error {
+	if !args.rotates() {
+		if args.RotateKeep != 0 || args.RotateCompress != "" {
+			return errors.New("arguments --rotate-keep and --rotate-compress: require argument --rotate-size or --rotate-interval")
+		}
+		return nil
+	}
+	var size int64
+	if args.RawRotateSize != "" {
+		var err error
+		if size, err = parseSize(args.RawRotateSize); err != nil {
+			return errors.New("argument --rotate-size: " + err.Error())
+		}
+	}
+	switch {
+	case strings.Trim(args.RawOutput, " ") == "":
+		return errors.New("arguments --rotate-size and --rotate-interval: require argument -o/--output")
+	case args.Pcap != nil:
+		return errors.New("pcap: arguments --rotate-size and --rotate-interval are not supported")
+	case args.outputCompression(args.RawOutput) != anonip.CompressionNone:
+		return errors.New("arguments --rotate-size and --rotate-interval: not allowed with compressed output, use --rotate-compress")
+	case args.RotateInterval < 0:
+		return errors.New("argument --rotate-interval: must be a duration greater than 0")
+	case args.RotateKeep < 0:
+		return errors.New("argument --rotate-keep: must not be negative")
+	}
+	for _, compression := range anonip.Compressions {
+		if args.RotateCompress != "" && args.RotateCompress != compression {
+			continue
+		}
+		file, err := anonip.OpenRotating(args.RawOutput, anonip.RotateOptions{
+			Size:        size,
+			Interval:    args.RotateInterval,
+			Keep:        args.RotateKeep,
+			Compression: compression,
+		})
+		if err != nil {
+			return err
+		}
+		args.Output = file
+		args.OutputFile = file
+		return nil
+	}
+	return errors.New("argument --rotate-compress: must be one of " + strings.Join(anonip.Compressions, ", "))
 }
 
-// GetIPStringsColumn extracts IP addresses as strings
-func GetIPStringsColumn(line string, columns []uint, delimiter string) []string {
-	logList := strings.Split(line, delimiter)
-	ipList := []string{}
-	for _, column := range columns {
-		if int(column) > len(logList)-1 {
+func (args *Args) validateCompress() error {
+	for _, compression := range anonip.Compressions {
+		if args.Compress != "" && args.Compress != compression {
 			continue
 		}
-		ipList = append(ipList, logList[column])
+		if args.OutputDir == "" && !args.InPlace && !args.rotates() {
+			compressor := args.compressor(args.Output, args.RawOutput)
+			args.Output = compressor
+			args.Closer = compressor
+		}
+		return nil
 	}
-	return ipList
+	return errors.New("argument --output-compress: must be one of " + strings.Join(anonip.Compressions, ", "))
 }
 
-func printLog(w io.Writer, line string) {
-	_, err := w.Write([]byte(line + "\n"))
-	if err != nil {
-		logError(err)
+func (args *Args) validateIPV4Mask() error {
+	if args.IPV4Mask < 1 || args.IPV4Mask > 32 {
+		return errors.New("argument -4/--ipv4mask: must be an integer between 1 and 32")
 	}
+	return nil
 }
 
-func logError(err error) {
-	_, _ = os.Stderr.WriteString("error: " + err.Error() + "\n")
+func (args *Args) validateIPV6Mask() error {
+	if args.IPV6Mask < 1 || args.IPV6Mask > 128 {
+		return errors.New("argument -6/--ipv6mask: must be an integer between 1 and 128")
+	}
+	return nil
 }
 
-// HandleLine handles a single line from the log
-func HandleLine(line string, args Args, channel chan string) {
-	if line == "" {
-		channel <- line
-		return
+func (args *Args) validateReverse() error {
+	if args.Reverse == nil {
+		return nil
 	}
-	var ipStrings []string
-	if args.Regex != nil {
-		ipStrings = GetIPStringsRegex(line, args.Regex)
-	} else {
-		ipStrings = GetIPStringsColumn(line, args.Columns, args.Delimiter)
+	if args.Mode != anonip.ModeTruncate && args.Mode != anonip.ModeEncrypt {
+		return errors.New("reverse: only mode " + anonip.ModeEncrypt + " can be reversed")
 	}
-	for _, ipString := range ipStrings {
-		ipString, ip := GetIP(ipString)
-		if ip == nil {
-			if args.Replace != nil {
-				line = strings.Replace(line, ipString, *args.Replace, 1)
-			}
-			continue
-		}
-		if args.SkipPrivate {
-			if IsPrivateIP(ip) {
-				continue
-			}
-		}
-		maskedIP := MaskIP(ip, args.IPV4Mask, args.IPV6Mask)
-		if args.Increment > 0 {
-			IncrementIP(maskedIP, args.Increment)
+	if args.SkipPrivate || len(args.RawSkip) > 0 || args.SkipFile != "" {
+		return errors.New("reverse: skipping addresses is not supported")
+	}
+	if len(args.RawRules) > 0 || args.RulesFile != "" {
+		return errors.New("reverse: rules are not supported")
+	}
+	args.Mode = anonip.ModeEncrypt
+	return nil
+}
+
+// validateEncrypt makes sure every address is encrypted with mode encrypt,
+// otherwise reverse would decrypt addresses which have been kept or masked
+func (args *Args) validateEncrypt() error {
+	if args.Mode != anonip.ModeEncrypt {
+		return nil
+	}
+	if args.SkipPrivate || len(args.RawSkip) > 0 || args.SkipFile != "" {
+		return errors.New("argument -m/--mode: skipping addresses is not supported by mode " + anonip.ModeEncrypt)
+	}
+	if len(args.RawRules) > 0 || args.RulesFile != "" {
+		return errors.New("argument -m/--mode: rules are not supported by mode " + anonip.ModeEncrypt)
+	}
+	return nil
+}
+
+func (args *Args) validateMode() error {
+	for _, mode := range anonip.Modes {
+		if args.Mode == mode {
+			return nil
 		}
-		line = strings.ReplaceAll(line, ipString, maskedIP.String())
 	}
-	channel <- line
+	return errors.New("argument -m/--mode: must be one of " + strings.Join(anonip.Modes, ", "))
 }
 
-// Args will hold parsed CLI arguments
-type Args struct {
-	IPV4Mask    int            `arg:"-4,--ipv4mask,env:ANONIP_IPV4MASK" default:"12" placeholder:"INTEGER" help:"truncate the last n bits"`
-	IPV6Mask    int            `arg:"-6,--ipv6mask,env:ANONIP_IPV6MASK" default:"84" placeholder:"INTEGER" help:"truncate the last n bits"`
-	Increment   uint           `arg:"-i,--increment,env:ANONIP_INCREMENT" default:"0" placeholder:"INTEGER" help:"increment the IP address by n"`
-	RawOutput   string         `arg:"-o,--output,env:ANONIP_OUTPUT" placeholder:"FILE" help:"file or FIFO to write to [default: stdout]"`
-	Output      io.Writer      `arg:"-"`
-	RawInput    string         `arg:"--input,env:ANONIP_OUTPUT" placeholder:"FILE" help:"file or FIFO to read from [default: stdin]"`
-	Input       io.Reader      `arg:"-"`
-	Columns     []uint         `arg:"-c,--columns,env:ANONIP_COLUMNS" placeholder:"INTEGER [INTEGER ...]" help:"assume IP address is in column n (1-based indexed) [default: 0]"`
-	Delimiter   string         `arg:"-l,--delimiter,env:ANONIP_DELIMITER" default:" " placeholder:"STRING" help:"log delimiter"`
-	Replace     *string        `arg:"-r,--replace,env:ANONIP_REPLACE" placeholder:"STRING" help:"replacement string in case address parsing fails (Example: 0.0.0.0)"`
-	RawRegex    []string       `arg:"--regex,env:ANONIP_REGEX" placeholder:"STRING [STRING ...]" help:"regex"`
-	Regex       *regexp.Regexp `arg:"-"`
-	SkipPrivate bool           `arg:"-p,--skip-private,env:ANONIP_SKIP_PRIVATE" default:"false" help:"do not mask addresses in private ranges. See IANA Special-Purpose Address Registry"`
-	Version     bool           `arg:"-v,--version" default:"false" help:"show program's version number and exit"`
+func (args *Args) validateKeyFile() error {
+	if args.KeyFile == "" {
+		if args.Mode != anonip.ModeTruncate {
+			return errors.New("argument -k/--key-file: required by mode " + args.Mode)
+		}
+		return nil
+	}
+	key, err := anonip.ReadKeyFile(args.KeyFile)
+	if err != nil {
+		return errors.New("argument -k/--key-file: " + err.Error())
+	}
+	if len(key) < anonip.MinKeyLength {
+		return fmt.Errorf("argument -k/--key-file: key must be at least %d bytes long", anonip.MinKeyLength)
+	}
+	if args.Mode == anonip.ModeCryptoPAn && len(key) != anonip.CryptoPAnKeyLength {
+		return fmt.Errorf("argument -k/--key-file: key must be exactly %d bytes long for mode %s", anonip.CryptoPAnKeyLength, args.Mode)
+	}
+	args.Key = key
+	return nil
 }
 
-func (args *Args) validateOutput() {
-	args.Output = defaultLogWriter
-	if output := strings.Trim(args.RawOutput, " "); output != "" {
-		file := OpenFile(args.RawOutput, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0660)
-		args.Output = file
+func (args *Args) validateWorkers() error {
+	if args.Workers < 1 {
+		return errors.New("argument -w/--workers: must be an integer greater than 0")
 	}
+	return nil
 }
 
-func (args *Args) validateInput() {
-	args.Input = defaultLogReader
-	if input := strings.Trim(args.RawInput, " "); input != "" {
-		file := OpenFile(args.RawInput, os.O_RDONLY, 0)
-		args.Input = file
+func (args *Args) validateRegex() error {
+	for _, raw := range args.RawRegex {
+		r, err := regexp.Compile(raw)
+		if err != nil {
+			return errors.New("argument --regex: must be a valid regex string: " + raw)
+		}
+		args.Regexes = append(args.Regexes, r)
 	}
+	return nil
 }
 
-func (args *Args) validateIPV4Mask() error {
-	if args.IPV4Mask < 1 || args.IPV4Mask > 32 {
-		return errors.New("argument -4/--ipv4mask: must be an integer between 1 and 32")
+func (args *Args) validatePreset() error {
+	if args.Preset == "" {
+		return nil
+	}
+	preset, ok := anonip.Presets[args.Preset]
+	if !ok {
+		return errors.New("argument --preset: must be one of " + strings.Join(anonip.PresetNames(), ", "))
 	}
+	switch {
+	case args.Format != anonip.FormatText:
+		return errors.New("argument --preset: not allowed with argument -f/--format")
+	case len(args.Columns) > 0:
+		return errors.New("argument --preset: not allowed with argument -c/--columns")
+	case len(args.RawRegex) > 0:
+		return errors.New("argument --preset: not allowed with argument --regex")
+	case args.Scan:
+		return errors.New("argument --preset: not allowed with argument -s/--scan")
+	}
+	args.Format = preset.Format
 	return nil
 }
 
-func (args *Args) validateIPV6Mask() error {
-	if args.IPV6Mask < 1 || args.IPV6Mask > 128 {
-		return errors.New("argument -6/--ipv6mask: must be an integer between 1 and 128")
+func (args *Args) validateFormat() error {
+	for _, format := range anonip.Formats {
+		if args.Format != format {
+			continue
+		}
+		switch {
+		case format == anonip.FormatJSON && len(args.Fields) == 0:
+			return errors.New("argument --field: required by format " + format)
+		case format == anonip.FormatLogfmt && len(args.Keys) == 0:
+			return errors.New("argument --key: required by format " + format)
+		case format != anonip.FormatCSV && format != anonip.FormatTSV && format != anonip.FormatW3C && len(args.ColumnNames) > 0:
+			return errors.New("argument --column-name: not supported by format " + format)
+		}
+		return nil
+	}
+	return errors.New("argument -f/--format: must be one of " + strings.Join(anonip.Formats, ", "))
+}
+
+func (args *Args) validateRules() error {
+	rules, err := anonip.ParseRules(args.RawRules)
+	if err != nil {
+		return errors.New("argument --rules: " + err.Error())
 	}
+	if args.RulesFile != "" {
+		fileRules, err := anonip.ReadRulesFile(args.RulesFile)
+		if err != nil {
+			return errors.New("argument --rules-file: " + err.Error())
+		}
+		rules = append(rules, fileRules...)
+	}
+	args.Rules = rules
 	return nil
 }
 
-func (args *Args) validateRegex() error {
-	if len(args.RawRegex) != 0 {
-		r, err := regexp.Compile(strings.Join(args.RawRegex, "|"))
+func (args *Args) validateSkip() error {
+	skip, err := anonip.ParseSkipList(args.RawSkip)
+	if err != nil {
+		return errors.New("argument --skip-cidr: " + err.Error())
+	}
+	if args.SkipFile != "" {
+		fileSkip, err := anonip.ReadSkipFile(args.SkipFile)
 		if err != nil {
-			return errors.New("argument --regex: must be a valid regex string")
+			return errors.New("argument --skip-file: " + err.Error())
 		}
-		args.Regex = r
+		skip = append(skip, fileSkip...)
 	}
+	args.Skip = skip
 	return nil
 }
 
 func (args *Args) validateColumns() error {
 	if len(args.Columns) == 0 {
-		args.Columns = append(args.Columns, 0)
+		if len(args.ColumnNames) == 0 {
+			args.Columns = append(args.Columns, 0)
+		}
 	} else {
 		for i, col := range args.Columns {
 			if col == 0 {
@@ -257,7 +473,7 @@ func (args *Args) validateColumns() error {
 
 func (args *Args) validateVersion() {
 	if args.Version {
-		printLog(defaultLogWriter, version)
+		_, _ = io.WriteString(defaultLogWriter, version+"\n")
 		osExit(0)
 	}
 }
@@ -266,12 +482,30 @@ func (args *Args) validateVersion() {
 func (args *Args) Validate() error {
 	args.validateVersion()
 	args.validateOutput()
-	args.validateInput()
 
 	for _, method := range []func() error{
 		args.validateIPV4Mask,
 		args.validateIPV6Mask,
+		args.validateReverse,
+		args.validateServe,
+		args.validateInput,
+		args.validateOutputDir,
+		args.validateInPlace,
+		args.validateFollow,
+		args.validateRotate,
+		args.validateFlush,
+		args.validateJobs,
+		args.validateCompress,
+		args.validateMode,
+		args.validateEncrypt,
+		args.validateKeyFile,
+		args.validateWorkers,
+		args.validatePreset,
+		args.validateFormat,
+		args.validateServeFormat,
 		args.validateRegex,
+		args.validateRules,
+		args.validateSkip,
 		args.validateColumns,
 	} {
 		err := method()
@@ -291,18 +525,62 @@ func parseArgs() (Args, *arg.Parser, error) {
 	return args, p, err
 }
 
-// Run starts the loop for anonymization of OP addresses
+// Options converts the parsed arguments into anonymizer options
+func (args *Args) Options() anonip.Options {
+	return anonip.Options{
+		IPV4Mask:    args.IPV4Mask,
+		IPV6Mask:    args.IPV6Mask,
+		Increment:   args.Increment,
+		Mode:        args.Mode,
+		Key:         args.Key,
+		Format:      args.Format,
+		Fields:      append(args.Fields, args.Keys...),
+		Columns:     args.Columns,
+		ColumnNames: args.ColumnNames,
+		Preset:      args.Preset,
+		Delimiter:   args.Delimiter,
+		Replace:     args.Replace,
+		Regexes:     args.Regexes,
+		Scan:        args.Scan,
+		SkipPrivate: args.SkipPrivate,
+		Skip:        args.Skip,
+		Rules:       args.Rules,
+		Reverse:     args.Reverse != nil,
+		Workers:     args.Workers,
+	}
+}
+
+// Run starts the loop for anonymization of IP addresses
 func Run(args Args) {
-	if args.SkipPrivate {
-		initPrivateIPBlocks()
+	anonymizer, err := anonip.New(args.Options())
+	if err != nil {
+		logError(err)
+		osExit(2)
+		return // just in case osExit was monkey-patched
 	}
-	channel := make(chan string)
-	scanner := bufio.NewScanner(args.Input)
-	for scanner.Scan() {
-		go HandleLine(scanner.Text(), args, channel)
-		printLog(args.Output, <-channel)
+	run := (*anonip.Anonymizer).Run
+	if args.Pcap != nil {
+		run = (*anonip.Anonymizer).RunPcap
 	}
-	if err := scanner.Err(); err != nil {
+	switch {
+	case args.Serve != nil:
+		err = serve(anonymizer, args)
+	case args.Follow:
+		err = follow(anonymizer, args)
+	case len(args.Inputs) > 0:
+		err = runFiles(args, run)
+	default:
+		err = runInput(anonymizer, args, run)
+	}
+	if err == nil && args.Closer != nil {
+		// complete the compressed stream
+		err = args.Closer.Close()
+	}
+	if err == nil && args.OutputFile != nil {
+		// sync to disk, and wait for rotated files
+		err = args.OutputFile.Close()
+	}
+	if err != nil {
 		logError(err)
 		osExit(-1)
 		return // just in case osExit was monkey-patched
@@ -0,0 +1,505 @@
+// Package anonip anonymizes IP addresses in log lines.
+//
+// It is the core of the anonip command line tool and can be embedded in
+// other programs in order to mask addresses in-process.
+package anonip
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Input formats
+const (
+	// FormatText is free text, addresses are found by column, regex or scan
+	FormatText = "text"
+	// FormatJSON is one JSON document per line, addresses are found by field
+	FormatJSON = "json"
+	// FormatLogfmt is key=value pairs, addresses are found by key
+	FormatLogfmt = "logfmt"
+	// FormatCSV is comma separated values according to RFC 4180, addresses
+	// are found by column index or name
+	FormatCSV = "csv"
+	// FormatTSV is like FormatCSV, but separated by tabs
+	FormatTSV = "tsv"
+	// FormatSyslog is RFC 5424 or RFC 3164 syslog, addresses are found
+	// anywhere in the structured data and the message
+	FormatSyslog = "syslog"
+	// FormatW3C is the W3C extended log format used by IIS, addresses are
+	// found by the field names of the #Fields directive
+	FormatW3C = "w3c"
+)
+
+// Formats lists all available input formats
+var Formats = []string{FormatText, FormatJSON, FormatLogfmt, FormatCSV, FormatTSV, FormatW3C, FormatSyslog}
+
+// Default values used by the anonip command line tool
+const (
+	DefaultIPV4Mask  = 12
+	DefaultIPV6Mask  = 84
+	DefaultDelimiter = " "
+)
+
+// Options configures an Anonymizer
+type Options struct {
+	// IPV4Mask is the number of trailing bits to truncate from IPv4 addresses
+	IPV4Mask int
+	// IPV6Mask is the number of trailing bits to truncate from IPv6 addresses
+	IPV6Mask int
+	// Increment is added to every masked address
+	Increment uint
+	// Mode selects how addresses are anonymized. Defaults to ModeTruncate
+	Mode string
+	// Key is the secret used by the keyed modes
+	Key []byte
+	// Reverse restores the original addresses of a log anonymized with
+	// ModeEncrypt and the same key
+	Reverse bool
+	// Format of the lines. Defaults to FormatText
+	Format string
+	// Fields select the values holding IP addresses in the structured
+	// formats: dotted paths for FormatJSON and keys for FormatLogfmt. A value
+	// may hold a comma separated list of addresses
+	Fields []string
+	// Columns are the 0-based columns holding IP addresses
+	Columns []uint
+	// ColumnNames select columns by their name in the header line, for
+	// FormatCSV, FormatTSV and FormatW3C
+	ColumnNames []string
+	// Preset is the name of one of the Presets. It overrides Format, Columns,
+	// Delimiter, Regexes and Scan.
+	Preset string
+	// Delimiter separates the columns of a line
+	Delimiter string
+	// Replace is used in place of values that can't be parsed as IP address
+	Replace *string
+	// Regexes extract the IP addresses from a line. Each regex is applied to
+	// the whole line independently. Columns are ignored if set. See
+	// GetIPIndexRegex
+	Regexes []*regexp.Regexp
+	// Scan finds addresses anywhere in a line. Columns, Regexes and Replace are
+	// ignored if set
+	Scan bool
+	// SkipPrivate leaves addresses in the PrivateSets untouched
+	SkipPrivate bool
+	// Skip lists additional networks whose addresses are left untouched
+	Skip []*net.IPNet
+	// Rules override the anonymization of addresses in specific networks.
+	// The rule with the longest matching prefix applies. Addresses without a
+	// matching rule are anonymized according to Mode
+	Rules []Rule
+	// Workers is the number of lines processed concurrently by Run. Values
+	// below 2 process lines serially
+	Workers int
+}
+
+// DefaultOptions returns the options used by the anonip command line tool
+func DefaultOptions() Options {
+	return Options{
+		IPV4Mask:  DefaultIPV4Mask,
+		IPV6Mask:  DefaultIPV6Mask,
+		Columns:   []uint{0},
+		Mode:      ModeTruncate,
+		Format:    FormatText,
+		Delimiter: DefaultDelimiter,
+		Workers:   1,
+	}
+}
+
+// Anonymizer masks IP addresses in log lines
+type Anonymizer struct {
+	opts            Options
+	transformer     transformer
+	rules           []Rule
+	fieldPaths      [][]string
+	columns         []uint
+	headerParsed    bool
+	privateIPBlocks []*net.IPNet
+	publicIPBlocks  []*net.IPNet
+}
+
+// New validates the options and returns a ready to use Anonymizer
+func New(opts Options) (*Anonymizer, error) {
+	if opts.IPV4Mask < 0 || opts.IPV4Mask > 32 {
+		return nil, errors.New("ipv4 mask must be an integer between 0 and 32")
+	}
+	if opts.IPV6Mask < 0 || opts.IPV6Mask > 128 {
+		return nil, errors.New("ipv6 mask must be an integer between 0 and 128")
+	}
+	if opts.Preset != "" {
+		if err := applyPreset(&opts); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.Columns) == 0 && len(opts.ColumnNames) == 0 {
+		opts.Columns = []uint{0}
+	}
+	if opts.Workers < 0 {
+		return nil, errors.New("number of workers must not be negative")
+	}
+	// every address must be encrypted, otherwise reversing would decrypt
+	// addresses which have been kept or masked
+	if opts.Mode == ModeEncrypt && (opts.SkipPrivate || len(opts.Skip) > 0) {
+		return nil, errors.New("skipping addresses is not supported by mode " + ModeEncrypt)
+	}
+	if opts.Mode == ModeEncrypt && len(opts.Rules) > 0 {
+		return nil, errors.New("rules are not supported by mode " + ModeEncrypt)
+	}
+	if opts.Delimiter == "" {
+		opts.Delimiter = DefaultDelimiter
+	}
+
+	t, err := newTransformer(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range opts.Rules {
+		if rule.Action != ActionKeep && rule.Action != ActionMask {
+			return nil, errors.New("unknown rule action: " + rule.Action)
+		}
+	}
+
+	switch opts.Format {
+	case "", FormatText:
+	case FormatJSON, FormatLogfmt:
+		if len(opts.Fields) == 0 {
+			return nil, errors.New("format " + opts.Format + " requires at least one field")
+		}
+	case FormatCSV, FormatTSV, FormatW3C, FormatSyslog:
+	default:
+		return nil, errors.New("unknown format: " + opts.Format)
+	}
+	if len(opts.ColumnNames) > 0 && opts.Format != FormatCSV && opts.Format != FormatTSV && opts.Format != FormatW3C {
+		return nil, errors.New("column names are only supported by formats " + FormatCSV + ", " + FormatTSV + " and " + FormatW3C)
+	}
+
+	a := &Anonymizer{
+		opts:        opts,
+		transformer: t,
+		rules:       sortRules(opts.Rules),
+		columns:     append([]uint{}, opts.Columns...),
+	}
+	if opts.Format == FormatW3C {
+		a.setW3CFields(W3CDefaultFields)
+	}
+	for _, field := range opts.Fields {
+		a.fieldPaths = append(a.fieldPaths, ParseFieldPath(field))
+	}
+	if opts.SkipPrivate {
+		blocks, err := parseCIDRs(setsCIDRs(PrivateSets))
+		if err != nil {
+			return nil, err
+		}
+		a.privateIPBlocks = blocks
+		if a.publicIPBlocks, err = parseCIDRs(globallyReachable); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var blocks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// IsPrivateIP returns true for IP addresses in private blocks
+func (a *Anonymizer) IsPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return true
+	}
+
+	for _, block := range a.publicIPBlocks {
+		if block.Contains(ip) {
+			return false
+		}
+	}
+	for _, block := range a.privateIPBlocks {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaskIP masks a single IP address
+func MaskIP(ip net.IP, IPV4Mask int, IPV6Mask int) net.IP {
+	if ip := ip.To4(); ip != nil {
+		mask := net.CIDRMask(32-IPV4Mask, 32)
+		return ip.Mask(mask)
+	}
+	mask := net.CIDRMask(128-IPV6Mask, 128)
+	return ip.Mask(mask)
+}
+
+// IncrementIP imcrements a single IP address
+func IncrementIP(ip net.IP, amount uint) {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i] += byte(amount)
+		if ip[i] != 0 {
+			break
+		}
+	}
+}
+
+func trimBrackets(ipString string) (string, net.IP) {
+	ipString = strings.Trim(ipString, "[]")
+	return ipString, net.ParseIP(ipString)
+}
+
+func handlePort(ipString string) (string, net.IP) {
+	strippedIPString, _, err := net.SplitHostPort(ipString)
+	if err != nil {
+		parts := strings.Split(ipString, "]")
+		if len(parts) > 1 {
+			return parts[0], net.ParseIP(parts[0])
+		}
+		return ipString, nil
+	}
+
+	return strippedIPString, net.ParseIP(strippedIPString)
+}
+
+// GetIP extracts an IP address from a string
+func GetIP(ipString string) (string, net.IP) {
+	ip := net.ParseIP(ipString)
+	if ip == nil {
+		ipString, ip = trimBrackets(ipString)
+		if ip == nil {
+			return handlePort(ipString)
+		}
+		return ipString, ip
+	}
+	return ipString, ip
+}
+
+// GetIPStringsRegex extracts IP addresses as strings with regex. See
+// GetIPIndexRegex.
+func GetIPStringsRegex(line string, regex *regexp.Regexp) []string {
+	ipList := []string{}
+	for _, index := range GetIPIndexRegex(line, regex) {
+		ipList = append(ipList, line[index[0]:index[1]])
+	}
+	return ipList
+}
+
+// GetIPIndexRegex returns the byte offsets of the IP addresses extracted with
+// regex, for all matches in the line.
+//
+// If the regex contains named groups, only those hold IP addresses. Otherwise
+// all capture groups do, and if there are no capture groups at all the whole
+// match is used. Groups that did not participate in a match are omitted.
+func GetIPIndexRegex(line string, regex *regexp.Regexp) [][]int {
+	var groups []int
+	names := regex.SubexpNames()
+	for i, name := range names {
+		if name != "" {
+			groups = append(groups, i)
+		}
+	}
+	if len(groups) == 0 {
+		for i := 1; i < len(names); i++ {
+			groups = append(groups, i)
+		}
+	}
+	if len(groups) == 0 {
+		groups = []int{0}
+	}
+
+	var indexes [][]int
+	for _, match := range regex.FindAllStringSubmatchIndex(line, -1) {
+		for _, group := range groups {
+			if match[2*group] < 0 {
+				continue
+			}
+			indexes = append(indexes, []int{match[2*group], match[2*group+1]})
+		}
+	}
+	return indexes
+}
+
+// GetIPStringsColumn extracts IP addresses as strings
+func GetIPStringsColumn(line string, columns []uint, delimiter string) []string {
+	ipList := []string{}
+	for _, index := range GetIPIndexColumn(line, columns, delimiter) {
+		ipList = append(ipList, line[index[0]:index[1]])
+	}
+	return ipList
+}
+
+// GetIPIndexColumn returns the byte offsets of the given columns. An empty
+// delimiter does not split the line at all.
+func GetIPIndexColumn(line string, columns []uint, delimiter string) [][]int {
+	var offsets [][]int
+	start := 0
+	for {
+		end := strings.Index(line[start:], delimiter)
+		if end < 0 || delimiter == "" {
+			offsets = append(offsets, []int{start, len(line)})
+			break
+		}
+		offsets = append(offsets, []int{start, start + end})
+		start += end + len(delimiter)
+	}
+
+	indexes := [][]int{}
+	for _, column := range columns {
+		if int(column) > len(offsets)-1 {
+			continue
+		}
+		indexes = append(indexes, offsets[column])
+	}
+	return indexes
+}
+
+// HandleLine anonymizes all IP addresses in a single line from the log.
+// Only the bytes where an address has been found are replaced. As long as
+// Options.ColumnNames have not been resolved by ParseHeader, all addresses
+// found anywhere in the line are anonymized.
+func (a *Anonymizer) HandleLine(line string) string {
+	if line == "" {
+		return line
+	}
+	switch {
+	case a.NeedsHeader():
+		return a.scanLine(line)
+	case a.opts.Format == FormatJSON:
+		return a.jsonLine(line)
+	case a.opts.Format == FormatLogfmt:
+		return a.logfmtLine(line)
+	case a.opts.Format == FormatCSV || a.opts.Format == FormatTSV:
+		return a.csvLine(line)
+	case a.opts.Format == FormatW3C:
+		return a.w3cLine(line)
+	case a.opts.Format == FormatSyslog:
+		return a.syslogLine(line)
+	case a.opts.Scan:
+		return a.scanLine(line)
+	}
+	var indexes [][]int
+	if len(a.opts.Regexes) > 0 {
+		for _, regex := range a.opts.Regexes {
+			for _, index := range GetIPIndexRegex(line, regex) {
+				indexes = append(indexes, listIndexes(line, index, " ")...)
+			}
+		}
+	} else {
+		indexes = GetIPIndexColumn(line, a.opts.Columns, a.opts.Delimiter)
+	}
+	return a.anonymizeIndexes(line, indexes)
+}
+
+// anonymizeIndexes anonymizes the addresses found at the given byte offsets
+func (a *Anonymizer) anonymizeIndexes(line string, indexes [][]int) string {
+	var replacements []replacement
+	for _, index := range indexes {
+		field := line[index[0]:index[1]]
+		ipString, ip := GetIP(field)
+		// GetIP only strips brackets and ports, ipString is part of field
+		start := index[0] + strings.Index(field, ipString)
+		r := replacement{start: start, end: start + len(ipString)}
+		if ip == nil {
+			if a.opts.Replace == nil {
+				continue
+			}
+			r.value = *a.opts.Replace
+		} else {
+			maskedIP := a.AnonymizeIP(ip)
+			if maskedIP == nil {
+				continue
+			}
+			r.value = maskedIP.String()
+		}
+		replacements = append(replacements, r)
+	}
+	return applyReplacements(line, replacements)
+}
+
+// anonymizeList anonymizes a comma separated list of addresses, like the
+// value of an X-Forwarded-For header
+func (a *Anonymizer) anonymizeList(value string) string {
+	return a.anonymizeIndexes(value, listIndexes(value, []int{0, len(value)}, " \t"))
+}
+
+// listIndexes splits the comma separated list found at index of line and
+// returns the offsets of its elements, without the characters in cutset
+func listIndexes(line string, index []int, cutset string) [][]int {
+	var indexes [][]int
+	start := index[0]
+	for _, part := range strings.Split(line[index[0]:index[1]], ",") {
+		trimmed := strings.Trim(part, cutset)
+		offset := start + strings.Index(part, trimmed)
+		indexes = append(indexes, []int{offset, offset + len(trimmed)})
+		start += len(part) + 1
+	}
+	return indexes
+}
+
+// AnonymizeIP anonymizes a single IP address. It returns nil if the address
+// is to be left untouched.
+func (a *Anonymizer) AnonymizeIP(ip net.IP) net.IP {
+	if a.opts.SkipPrivate {
+		if a.IsPrivateIP(ip) {
+			return nil
+		}
+	}
+	for _, network := range a.opts.Skip {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	if rule := matchRule(a.rules, ip); rule != nil {
+		return rule.apply(ip, a.opts.Increment)
+	}
+	return a.transformer.transform(ip)
+}
+
+// Run anonymizes every line read from r and writes the result to w.
+// The order of the lines is preserved, regardless of the number of workers.
+// If a header is needed, the first line is used as header. With more than one
+// worker, w is flushed, if it has a Flush method, whenever all lines read
+// before the input ran dry have been written, and Run returns on a write error
+// while a read from r may still be pending, which is abandoned once it
+// returns.
+func (a *Anonymizer) Run(r io.Reader, w io.Writer) error {
+	if a.NeedsHeader() {
+		reader := bufio.NewReader(r)
+		line, err := readLine(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := a.ParseHeader(line); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+		r = reader
+	}
+	if a.opts.Workers > 1 && a.opts.Format != FormatW3C {
+		// a #Fields directive affects all subsequent lines
+		return a.runParallel(r, w)
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if _, err := io.WriteString(w, a.HandleLine(scanner.Text())+"\n"); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
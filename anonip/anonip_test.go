@@ -0,0 +1,559 @@
+package anonip
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var ignoreCoverage bool
+
+func init() {
+	flag.BoolVar(&ignoreCoverage, "ic", false, "Do not enforce 100% coverage")
+}
+
+func TestMain(m *testing.M) {
+	rc := m.Run()
+
+	// rc 0 means we've passed,
+	// and CoverMode will be non empty if Run with -cover
+	if rc == 0 && testing.CoverMode() != "" {
+		c := testing.Coverage()
+		if !ignoreCoverage && c < 1.0 { // enforce 100% coverage
+			fmt.Println("Tests passed but coverage failed at", c)
+			rc = -1
+		}
+	}
+	os.Exit(rc)
+}
+
+func newAnonymizer(t *testing.T, opts Options) *Anonymizer {
+	a, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestHandleLine(t *testing.T) {
+	var testMap = []struct {
+		Input    string
+		Expected string
+		V4Mask   int
+		V6Mask   int
+	}{
+		{
+			Input:    "3.3.3.3",
+			Expected: "3.3.0.0",
+			V4Mask:   12,
+			V6Mask:   84,
+		},
+		{
+			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+			Expected: "2001:db8:85a0::",
+			V4Mask:   12,
+			V6Mask:   84,
+		},
+		{
+			Input:    "192.168.100.200",
+			Expected: "192.168.96.0",
+			V4Mask:   12,
+			V6Mask:   84,
+		},
+		{
+			Input:    "192.168.100.200:80",
+			Expected: "192.168.96.0:80",
+			V4Mask:   12,
+			V6Mask:   84,
+		},
+		{
+			Input:    "192.168.100.200]",
+			Expected: "192.168.96.0]",
+			V4Mask:   12,
+			V6Mask:   84,
+		},
+		{
+			Input:    "192.168.100.200:80]",
+			Expected: "192.168.96.0:80]",
+			V4Mask:   12,
+			V6Mask:   84,
+		},
+		{
+			Input:    "192.168.100.200",
+			Expected: "192.168.100.200",
+			V4Mask:   0,
+			V6Mask:   84,
+		},
+		{
+			Input:    "192.168.100.200",
+			Expected: "192.168.100.192",
+			V4Mask:   4,
+			V6Mask:   84,
+		},
+		{
+			Input:    "192.168.100.200",
+			Expected: "192.168.100.0",
+			V4Mask:   8,
+			V6Mask:   84,
+		},
+		{
+			Input:    "192.168.100.200",
+			Expected: "192.0.0.0",
+			V4Mask:   24,
+			V6Mask:   84,
+		},
+		{
+			Input:    "192.168.100.200",
+			Expected: "0.0.0.0",
+			V4Mask:   32,
+			V6Mask:   84,
+		},
+		{
+			Input:    "no_ip_address",
+			Expected: "no_ip_address",
+			V4Mask:   12,
+			V6Mask:   84,
+		},
+		{
+			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+			Expected: "2001:db8:85a0::",
+			V4Mask:   12,
+			V6Mask:   84,
+		},
+		{
+			Input:    "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:443",
+			Expected: "[2001:db8:85a0::]:443",
+			V4Mask:   12,
+			V6Mask:   84,
+		},
+		{
+			Input:    "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]",
+			Expected: "[2001:db8:85a0::]",
+			V4Mask:   12,
+			V6Mask:   84,
+		},
+		{
+			Input:    "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]]",
+			Expected: "[2001:db8:85a0::]]",
+			V4Mask:   12,
+			V6Mask:   84,
+		},
+		{
+			Input:    "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:443]",
+			Expected: "[2001:db8:85a0::]:443]",
+			V4Mask:   12,
+			V6Mask:   84,
+		},
+		{
+			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+			Expected: "2001:db8:85a3::8a2e:370:7334",
+			V4Mask:   12,
+			V6Mask:   0,
+		},
+		{
+			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+			Expected: "2001:db8:85a3::8a2e:370:7330",
+			V4Mask:   12,
+			V6Mask:   4,
+		},
+		{
+			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+			Expected: "2001:db8:85a3::8a2e:370:7300",
+			V4Mask:   12,
+			V6Mask:   8,
+		},
+		{
+			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+			Expected: "2001:db8:85a3::8a2e:300:0",
+			V4Mask:   12,
+			V6Mask:   24,
+		},
+		{
+			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+			Expected: "2001:db8:85a3::8a2e:0:0",
+			V4Mask:   12,
+			V6Mask:   32,
+		},
+		{
+			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+			Expected: "2001:db8:85a3::",
+			V4Mask:   12,
+			V6Mask:   62,
+		},
+		{
+			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+			Expected: "::",
+			V4Mask:   12,
+			V6Mask:   128,
+		},
+		{
+			Input:    "   foo",
+			Expected: "   foo",
+			V4Mask:   12,
+			V6Mask:   84,
+		},
+		{
+			Input:    "",
+			Expected: "",
+			V4Mask:   12,
+			V6Mask:   84,
+		},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.IPV4Mask, opts.IPV6Mask = tCase.V4Mask, tCase.V6Mask
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, maskedLine, tCase.Expected, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	var testMap = []struct {
+		Input     string
+		Increment uint
+		Expected  string
+	}{
+		{
+			Input:     "192.168.100.200",
+			Increment: 3,
+			Expected:  "192.168.96.3",
+		},
+		{
+			Input:     "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+			Increment: 7,
+			Expected:  "2001:db8:85a0::7",
+		},
+	}
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Increment = tCase.Increment
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, maskedLine, tCase.Expected, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestColumns(t *testing.T) {
+	var testMap = []struct {
+		Input    string
+		Columns  []uint
+		Expected string
+	}{
+		{
+			Input:    "192.168.100.200 some string with öéäü",
+			Columns:  []uint{0},
+			Expected: "192.168.96.0 some string with öéäü",
+		},
+		{
+			Input:    "some 192.168.100.200 string with öéäü",
+			Columns:  []uint{1},
+			Expected: "some 192.168.96.0 string with öéäü",
+		},
+		{
+			Input:    "some string 192.168.100.200 with öéäü",
+			Columns:  []uint{2},
+			Expected: "some string 192.168.96.0 with öéäü",
+		},
+		{
+			Input:    "192.168.100.200 192.168.11.222 192.168.123.234",
+			Columns:  []uint{0, 1, 2},
+			Expected: "192.168.96.0 192.168.0.0 192.168.112.0",
+		},
+		{
+			Input:    "192.168.100.200 192.168.11.222 192.168.123.234",
+			Columns:  []uint{9999},
+			Expected: "192.168.100.200 192.168.11.222 192.168.123.234",
+		},
+	}
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Columns = tCase.Columns
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, maskedLine, tCase.Expected, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestDelimiter(t *testing.T) {
+	var testMap = []struct {
+		Input     string
+		Delimiter string
+		Expected  string
+	}{
+		{
+			Input:     "192.168.100.200;some;string;with;öéäü",
+			Delimiter: ";",
+			Expected:  "192.168.96.0;some;string;with;öéäü",
+		},
+		{
+			Input:     "192.168.100.200 some string with öéäü",
+			Delimiter: ";",
+			Expected:  "192.168.100.200 some string with öéäü",
+		},
+	}
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Delimiter = tCase.Delimiter
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, maskedLine, tCase.Expected, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestReplace(t *testing.T) {
+	replaceString := "replaceIt"
+
+	var testMap = []struct {
+		Input    string
+		Replace  *string
+		Expected string
+	}{
+		{
+			Input:    "some string without IP",
+			Replace:  nil,
+			Expected: "some string without IP",
+		},
+		{
+			Input:    "some string without IP",
+			Replace:  &replaceString,
+			Expected: "replaceIt string without IP",
+		},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Replace = tCase.Replace
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, maskedLine, tCase.Expected, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestSkipPrivate(t *testing.T) {
+	var testMap = []struct {
+		Input    string
+		Expected string
+	}{
+		{
+			Input:    "10.0.0.1",
+			Expected: "10.0.0.1",
+		},
+		{
+			Input:    "3.3.3.3",
+			Expected: "3.3.0.0",
+		},
+		{
+			Input:    "169.254.0.1",
+			Expected: "169.254.0.1",
+		},
+	}
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.SkipPrivate = true
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, maskedLine, tCase.Expected, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestNewFail(t *testing.T) {
+	var testMap = []struct {
+		Name string
+		Opts func(opts *Options)
+	}{
+		{
+			Name: "ipv4 mask too small",
+			Opts: func(opts *Options) { opts.IPV4Mask = -1 },
+		},
+		{
+			Name: "ipv4 mask too big",
+			Opts: func(opts *Options) { opts.IPV4Mask = 33 },
+		},
+		{
+			Name: "ipv6 mask too small",
+			Opts: func(opts *Options) { opts.IPV6Mask = -1 },
+		},
+		{
+			Name: "ipv6 mask too big",
+			Opts: func(opts *Options) { opts.IPV6Mask = 129 },
+		},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Name, func(t *testing.T) {
+			opts := DefaultOptions()
+			tCase.Opts(&opts)
+			_, err := New(opts)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	a, err := New(Options{IPV4Mask: 12, IPV6Mask: 84})
+	assert.NoError(t, err)
+	assert.Equal(t, "3.3.0.0 foo", a.HandleLine("3.3.3.3 foo"))
+}
+
+func TestFailInitPrivateIPBlocks(t *testing.T) {
+	oldLoopback := SpecialPurposeSets["loopback"]
+	defer func() { SpecialPurposeSets["loopback"] = oldLoopback }()
+
+	SpecialPurposeSets["loopback"] = []string{
+		"no valid CIDR",
+	}
+
+	opts := DefaultOptions()
+	opts.SkipPrivate = true
+
+	_, err := New(opts)
+	assert.Error(t, err)
+
+	_, err = ParseSkipList([]string{"loopback"})
+	assert.Error(t, err)
+
+	SpecialPurposeSets["loopback"] = oldLoopback
+	oldGloballyReachable := globallyReachable
+	defer func() { globallyReachable = oldGloballyReachable }()
+	globallyReachable = []string{"no valid CIDR"}
+
+	_, err = New(opts)
+	assert.Error(t, err)
+}
+
+func TestRegexMatching(t *testing.T) {
+	var testMap = []struct {
+		Input    string
+		Expected string
+		Regex    []string
+	}{
+		{
+			Input:    "3.3.3.3 - - [20/May/2015:21:05:01 +0000] \"GET / HTTP/1.1\" 200 13358 \"-\" \"useragent\"\n",
+			Expected: "3.3.0.0 - - [20/May/2015:21:05:01 +0000] \"GET / HTTP/1.1\" 200 13358 \"-\" \"useragent\"\n",
+			Regex:    []string{"(?:^(.*) - - )", "^(.*) - somefixedstring: (.*) - .* - (.*)"},
+		},
+		{
+			Input:    "1.1.1.1 - somefixedstring: 2.2.2.2 - some random stuff - 3.3.3.3",
+			Expected: "1.1.0.0 - somefixedstring: 2.2.0.0 - some random stuff - 3.3.0.0",
+			Regex:    []string{"(?:^(.*) - - )", "^(.*) - somefixedstring: (.*) - .* - (.*)"},
+		},
+		{
+			Input:    "blabla/ 3.3.3.3 /blublu",
+			Expected: "blabla/ 3.3.0.0 /blublu",
+			Regex:    []string{"^blabla/ (.*) /blublu$"},
+		},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			for _, regex := range tCase.Regex {
+				opts.Regexes = append(opts.Regexes, regexp.MustCompile(regex))
+			}
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, maskedLine, tCase.Expected, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	a := newAnonymizer(t, DefaultOptions())
+	var out bytes.Buffer
+	err := a.Run(strings.NewReader("3.3.3.3 foo\n\n2001:db8::1 bar\n"), &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "3.3.0.0 foo\n\n2001:db8:: bar\n", out.String())
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestRunFail(t *testing.T) {
+	a := newAnonymizer(t, DefaultOptions())
+
+	err := a.Run(iotest.TimeoutReader(bytes.NewReader([]byte("foo"))), &bytes.Buffer{})
+	assert.Error(t, err)
+
+	err = a.Run(strings.NewReader("foo\n"), failingWriter{})
+	assert.Error(t, err)
+}
+
+func TestRegexGroups(t *testing.T) {
+	var testMap = []struct {
+		Input    string
+		Expected string
+		Regex    []string
+	}{
+		{
+			// the whole match is not an address
+			Input:    "client 3.3.3.3",
+			Expected: "client 3.3.0.0",
+			Regex:    []string{`client (\S+)`},
+		},
+		{
+			// only named groups hold addresses
+			Input:    "4.4.4.4 client 3.3.3.3",
+			Expected: "4.4.4.4 client 3.3.0.0",
+			Regex:    []string{`^(\S+) client (?P<ip>\S+)`},
+		},
+		{
+			// all matches in the line
+			Input:    "from=1.1.1.1 to=2.2.2.2 from=3.3.3.3",
+			Expected: "from=1.1.0.0 to=2.2.2.2 from=3.3.0.0",
+			Regex:    []string{`from=(\S+)`},
+		},
+		{
+			// without groups the whole match is the address
+			Input:    "a 1.1.1.1 b 2.2.2.2",
+			Expected: "a 1.1.0.0 b 2.2.0.0",
+			Regex:    []string{`\d+\.\d+\.\d+\.\d+`},
+		},
+		{
+			// each regex is applied independently
+			Input:    "from=1.1.1.1 to=2.2.2.2",
+			Expected: "from=1.1.0.0 to=2.2.0.0",
+			Regex:    []string{`from=(?P<ip>\S+)`, `(to)=(\S+)`},
+		},
+		{
+			// optional groups that did not participate
+			Input:    "to=2.2.2.2",
+			Expected: "to=2.2.0.0",
+			Regex:    []string{`(?:from=(\S+))?to=(\S+)`},
+		},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			for _, regex := range tCase.Regex {
+				opts.Regexes = append(opts.Regexes, regexp.MustCompile(regex))
+			}
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, tCase.Expected, maskedLine, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestGetIPStringsRegex(t *testing.T) {
+	regex := regexp.MustCompile(`(?P<ip>\S+) (\S+)`)
+	assert.Equal(t, []string{"1.1.1.1", "3.3.3.3"}, GetIPStringsRegex("1.1.1.1 2.2.2.2 3.3.3.3 4.4.4.4", regex))
+	assert.Equal(t, []string{}, GetIPStringsRegex("", regex))
+}
@@ -0,0 +1,76 @@
+package anonip
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// FlushOptions control when a BufferedWriter flushes
+type FlushOptions struct {
+	// Interval is the longest time data stays buffered, 0 disables
+	Interval time.Duration
+	// Lines flushes once this many lines are buffered, 0 disables
+	Lines int
+}
+
+// BufferedWriter buffers writes to w, saving a write per line. Besides when
+// its buffer is full, it flushes as FlushOptions say and when Flush is called,
+// e.g. once the input is idle. It is safe for concurrent use. After an error,
+// all writes return it.
+type BufferedWriter struct {
+	mutex sync.Mutex
+	w     *bufio.Writer
+	opts  FlushOptions
+	lines int
+	timer *time.Timer
+}
+
+// NewBufferedWriter returns a BufferedWriter writing to w
+func NewBufferedWriter(w io.Writer, opts FlushOptions) *BufferedWriter {
+	return &BufferedWriter{
+		w:    bufio.NewWriterSize(w, 64*1024),
+		opts: opts,
+	}
+}
+
+// Write buffers p
+func (b *BufferedWriter) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	n, err := b.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if b.opts.Lines > 0 {
+		b.lines += bytes.Count(p, []byte{'\n'})
+		if b.lines >= b.opts.Lines {
+			return n, b.flush()
+		}
+	}
+	if b.opts.Interval > 0 && b.timer == nil && b.w.Buffered() > 0 {
+		b.timer = time.AfterFunc(b.opts.Interval, func() {
+			// an error is returned by the next write
+			_ = b.Flush()
+		})
+	}
+	return n, nil
+}
+
+// Flush writes the buffered data to w
+func (b *BufferedWriter) Flush() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.flush()
+}
+
+func (b *BufferedWriter) flush() error {
+	b.lines = 0
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return b.w.Flush()
+}
@@ -0,0 +1,65 @@
+package anonip
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.buffer.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.buffer.String()
+}
+
+func TestBufferedWriter(t *testing.T) {
+	// by lines
+	output := &syncBuffer{}
+	b := NewBufferedWriter(output, FlushOptions{Lines: 2})
+	_, err := io.WriteString(b, "1.2.0.0\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "", output.String())
+	_, err = io.WriteString(b, "3.4.0.0\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.0.0\n3.4.0.0\n", output.String())
+
+	// on request
+	_, err = io.WriteString(b, "5.6.0.0\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.0.0\n3.4.0.0\n", output.String())
+	assert.NoError(t, b.Flush())
+	assert.Equal(t, "1.2.0.0\n3.4.0.0\n5.6.0.0\n", output.String())
+
+	// by time
+	output = &syncBuffer{}
+	b = NewBufferedWriter(output, FlushOptions{Interval: 10 * time.Millisecond})
+	_, err = io.WriteString(b, "1.2.0.0\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "", output.String())
+	assert.Eventually(t, func() bool {
+		return output.String() == "1.2.0.0\n"
+	}, 5*time.Second, time.Millisecond)
+
+	// errors stick
+	b = NewBufferedWriter(failingWriter{}, FlushOptions{Lines: 1})
+	_, err = io.WriteString(b, "1.2.0.0\n")
+	assert.EqualError(t, err, "write failed")
+	_, err = io.WriteString(b, "3.4.0.0\n")
+	assert.EqualError(t, err, "write failed")
+}
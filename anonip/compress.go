@@ -0,0 +1,117 @@
+package anonip
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression formats
+const (
+	CompressionNone  = "none"
+	CompressionGzip  = "gzip"
+	CompressionZstd  = "zstd"
+	CompressionBzip2 = "bzip2"
+	CompressionXz    = "xz"
+)
+
+// Compressions holds all compression formats output can be written in
+var Compressions = []string{CompressionNone, CompressionGzip, CompressionZstd}
+
+// compressionExtensions holds the file name extensions of the formats output
+// can be written in
+var compressionExtensions = map[string]string{
+	CompressionNone: "",
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+}
+
+var compressionMagics = []struct {
+	Compression string
+	Magic       []byte
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{CompressionBzip2, []byte("BZh")},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// DetectCompression returns the compression format of the stream starting
+// with header, or CompressionNone
+func DetectCompression(header []byte) string {
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(header, m.Magic) {
+			return m.Compression
+		}
+	}
+	return CompressionNone
+}
+
+// CompressionByExtension returns the compression format implied by the
+// extension of a file name, or CompressionNone
+func CompressionByExtension(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gz":
+		return CompressionGzip
+	case ".zst", ".zstd":
+		return CompressionZstd
+	}
+	return CompressionNone
+}
+
+// NewDecompressingReader detects the compression of r by its magic bytes and
+// returns a reader for the decompressed content. Uncompressed content is
+// passed through. Closing the returned reader does not close r.
+func NewDecompressingReader(r io.Reader) (io.ReadCloser, error) {
+	reader := bufio.NewReader(r)
+	// a short stream is not compressed, the error is repeated when reading
+	header, _ := reader.Peek(6)
+	switch DetectCompression(header) {
+	case CompressionGzip:
+		return gzip.NewReader(reader)
+	case CompressionZstd:
+		// without options, errors are only returned when reading
+		decoder, _ := zstd.NewReader(reader)
+		return decoder.IOReadCloser(), nil
+	case CompressionBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(reader)), nil
+	case CompressionXz:
+		decoder, err := xz.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(decoder), nil
+	}
+	return ioutil.NopCloser(reader), nil
+}
+
+// NewCompressingWriter returns a writer compressing to w. Close must be
+// called to complete the stream, it does not close w.
+func NewCompressingWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	}
+	return nil, errors.New("unsupported compression: " + compression)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,96 @@
+package anonip
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+// bzip2Log is "1.2.3.4\n" compressed with bzip2, which can't be written with
+// the standard library
+var bzip2Log = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x2d, 0x39, 0x06, 0x0c, 0x00,
+	0x00, 0x02, 0x58, 0x00, 0x00, 0x10, 0x00, 0x01, 0x3c, 0x00, 0x20, 0x00, 0x22, 0x18, 0x68,
+	0x30, 0x02, 0x52, 0x9f, 0x85, 0xdc, 0x91, 0x4e, 0x14, 0x24, 0x0b, 0x4e, 0x41, 0x83, 0x00,
+}
+
+func compress(t *testing.T, compression string, data string) []byte {
+	var output bytes.Buffer
+	w, err := NewCompressingWriter(&output, compression)
+	assert.NoError(t, err)
+	_, err = io.WriteString(w, data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return output.Bytes()
+}
+
+func TestDecompressingReader(t *testing.T) {
+	var xzLog bytes.Buffer
+	w, err := xz.NewWriter(&xzLog)
+	assert.NoError(t, err)
+	_, err = io.WriteString(w, "1.2.3.4\n")
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	for compression, input := range map[string][]byte{
+		CompressionNone:  []byte("1.2.3.4\n"),
+		CompressionGzip:  compress(t, CompressionGzip, "1.2.3.4\n"),
+		CompressionZstd:  compress(t, CompressionZstd, "1.2.3.4\n"),
+		CompressionBzip2: bzip2Log,
+		CompressionXz:    xzLog.Bytes(),
+	} {
+		t.Run(compression, func(t *testing.T) {
+			assert.Equal(t, compression, DetectCompression(input))
+			r, err := NewDecompressingReader(bytes.NewReader(input))
+			assert.NoError(t, err)
+			var output bytes.Buffer
+			assert.NoError(t, newAnonymizer(t, DefaultOptions()).Run(r, &output))
+			assert.NoError(t, r.Close())
+			assert.Equal(t, "1.2.0.0\n", output.String())
+		})
+	}
+
+	// rotated logs may be concatenated
+	input := concat(compress(t, CompressionGzip, "a\n"), compress(t, CompressionGzip, "b\n"))
+	r, err := NewDecompressingReader(bytes.NewReader(input))
+	assert.NoError(t, err)
+	output, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "a\nb\n", string(output))
+
+	for _, input := range [][]byte{
+		{0x1f, 0x8b},
+		{0xfd, '7', 'z', 'X', 'Z', 0x00},
+	} {
+		_, err := NewDecompressingReader(bytes.NewReader(input))
+		assert.Error(t, err)
+	}
+}
+
+func TestCompressingWriter(t *testing.T) {
+	for _, compression := range Compressions {
+		t.Run(compression, func(t *testing.T) {
+			data := compress(t, compression, "1.2.3.4\n")
+			assert.Equal(t, compression, DetectCompression(data))
+		})
+	}
+
+	_, err := NewCompressingWriter(ioutil.Discard, CompressionBzip2)
+	assert.Error(t, err)
+}
+
+func TestCompressionByExtension(t *testing.T) {
+	for name, expected := range map[string]string{
+		"access.log.1.gz": CompressionGzip,
+		"access.log.ZST":  CompressionZstd,
+		"access.zstd":     CompressionZstd,
+		"access.log":      CompressionNone,
+		"":                CompressionNone,
+	} {
+		assert.Equal(t, expected, CompressionByExtension(name), name)
+	}
+}
@@ -0,0 +1,74 @@
+package anonip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"net"
+)
+
+// CryptoPAnKeyLength is the length of a Crypto-PAn key in bytes
+const CryptoPAnKeyLength = 32
+
+// CryptoPAn implements prefix-preserving anonymization as described by
+// Xu, Fan, Ammar and Moon. Two addresses sharing a k-bit prefix are mapped to
+// addresses sharing a k-bit prefix as well.
+//
+// IPv4 addresses produce the same results as the reference implementation,
+// IPv6 addresses are handled the same way using all 128 bits.
+type CryptoPAn struct {
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+}
+
+// NewCryptoPAn creates a CryptoPAn anonymizer. The first 16 bytes of the key
+// are used as AES key, the last 16 bytes are encrypted to form the pad.
+func NewCryptoPAn(key []byte) (*CryptoPAn, error) {
+	if len(key) != CryptoPAnKeyLength {
+		return nil, fmt.Errorf("crypto-pan requires a key of exactly %d bytes", CryptoPAnKeyLength)
+	}
+	// 16 bytes are always a valid AES key
+	block, _ := aes.NewCipher(key[:aes.BlockSize])
+	c := &CryptoPAn{block: block}
+	block.Encrypt(c.pad[:], key[aes.BlockSize:])
+	return c, nil
+}
+
+// Anonymize maps an IP address to its prefix-preserving counterpart
+func (c *CryptoPAn) Anonymize(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	size := len(ip)
+
+	var input, output [aes.BlockSize]byte
+	result := make(net.IP, size)
+	for pos := 0; pos < size*8; pos++ {
+		// the first pos bits of the original address, padded with the pad
+		copy(input[:], c.pad[:])
+		for i := 0; i < size; i++ {
+			var mask byte
+			switch {
+			case (i+1)*8 <= pos:
+				mask = 0xff
+			case i*8 < pos:
+				mask = 0xff << uint(8-(pos-i*8))
+			}
+			input[i] = ip[i]&mask | c.pad[i]&^mask
+		}
+		c.block.Encrypt(output[:], input[:])
+		result[pos/8] |= (output[0] >> 7) << uint(7-pos%8)
+	}
+	for i := range result {
+		result[i] ^= ip[i]
+	}
+	return result
+}
+
+type cryptoPAnTransformer struct {
+	cryptoPAn *CryptoPAn
+}
+
+func (t cryptoPAnTransformer) transform(ip net.IP) net.IP {
+	return t.cryptoPAn.Anonymize(ip)
+}
@@ -0,0 +1,120 @@
+package anonip
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// key from the Crypto-PAn reference implementation
+var cryptoPAnTestKey = []byte{
+	21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16,
+	216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2,
+}
+
+// cryptoPAnVector is an address and its anonymized form under cryptoPAnTestKey
+type cryptoPAnVector struct {
+	Input    string
+	Expected string
+}
+
+func testCryptoPAnVectors(t *testing.T, testMap []cryptoPAnVector) {
+	cryptoPAn, err := NewCryptoPAn(cryptoPAnTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			anonymized := cryptoPAn.Anonymize(net.ParseIP(tCase.Input))
+			assert.Equal(t, tCase.Expected, anonymized.String())
+		})
+	}
+}
+
+// vectors from the Crypto-PAn reference implementation
+func TestCryptoPAn(t *testing.T) {
+	testCryptoPAnVectors(t, []cryptoPAnVector{
+		{Input: "128.11.68.132", Expected: "135.242.180.132"},
+		{Input: "129.118.74.4", Expected: "134.136.186.123"},
+		{Input: "130.132.252.244", Expected: "133.68.164.234"},
+		{Input: "141.223.7.43", Expected: "141.167.8.160"},
+		{Input: "141.233.145.108", Expected: "141.129.237.235"},
+		{Input: "152.163.225.39", Expected: "151.140.114.167"},
+		{Input: "156.29.3.236", Expected: "147.225.12.42"},
+		{Input: "165.247.96.84", Expected: "162.9.99.234"},
+		{Input: "166.107.77.190", Expected: "160.132.178.185"},
+		{Input: "192.102.249.13", Expected: "252.138.62.131"},
+		{Input: "192.215.32.125", Expected: "252.43.47.189"},
+		{Input: "192.233.80.103", Expected: "252.25.108.8"},
+		{Input: "192.41.57.43", Expected: "252.222.221.184"},
+		{Input: "193.150.244.223", Expected: "253.169.52.216"},
+		{Input: "195.205.63.100", Expected: "255.186.223.5"},
+		{Input: "198.200.171.101", Expected: "249.199.68.213"},
+		{Input: "199.217.79.101", Expected: "248.38.184.213"},
+		{Input: "202.49.198.20", Expected: "245.206.7.234"},
+		{Input: "203.12.160.252", Expected: "244.248.163.4"},
+		{Input: "204.184.162.189", Expected: "243.192.77.90"},
+	})
+}
+
+// the reference implementation is IPv4 only, these are regression vectors
+// generated by this implementation
+func TestCryptoPAnIPv6(t *testing.T) {
+	testCryptoPAnVectors(t, []cryptoPAnVector{
+		{Input: "::1", Expected: "78ff:f001:9fc0:20df:8380:b1f1:704:ed"},
+		{Input: "::2", Expected: "78ff:f001:9fc0:20df:8380:b1f1:704:ef"},
+		{Input: "::ffff", Expected: "78ff:f001:9fc0:20df:8380:b1f1:704:f838"},
+		{Input: "2001:db8::1", Expected: "4401:2bc:603f:d91d:27f:ff8e:e6f1:dc1e"},
+		{Input: "2001:db8::2", Expected: "4401:2bc:603f:d91d:27f:ff8e:e6f1:dc1c"},
+	})
+}
+
+func commonPrefixLength(a, b net.IP) int {
+	for i := 0; i < len(a)*8; i++ {
+		if (a[i/8]^b[i/8])&(0x80>>uint(i%8)) != 0 {
+			return i
+		}
+	}
+	return len(a) * 8
+}
+
+func TestCryptoPAnPrefixPreserving(t *testing.T) {
+	cryptoPAn, err := NewCryptoPAn(cryptoPAnTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testMap = [][2]string{
+		{"10.1.2.3", "10.1.2.4"},
+		{"10.1.2.3", "10.1.200.4"},
+		{"10.1.2.3", "138.1.2.3"},
+		{"2001:db8::1", "2001:db8:ffff::1"},
+		{"2001:db8::1", "fe80::1"},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase[0]+" "+tCase[1], func(t *testing.T) {
+			a, b := net.ParseIP(tCase[0]), net.ParseIP(tCase[1])
+			if a4 := a.To4(); a4 != nil {
+				a, b = a4, b.To4()
+			}
+			assert.Equal(t,
+				commonPrefixLength(a, b),
+				commonPrefixLength(cryptoPAn.Anonymize(a), cryptoPAn.Anonymize(b)),
+			)
+		})
+	}
+}
+
+func TestCryptoPAnMode(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Mode = ModeCryptoPAn
+	opts.Key = cryptoPAnTestKey
+	assert.Equal(t, "135.242.180.132 - foo", newAnonymizer(t, opts).HandleLine("128.11.68.132 - foo"))
+
+	opts.Key = testKey[:20]
+	_, err := New(opts)
+	assert.Error(t, err)
+}
@@ -0,0 +1,130 @@
+package anonip
+
+import (
+	"errors"
+	"strings"
+)
+
+var errInvalidCSV = errors.New("invalid CSV")
+
+// GetCSVFieldIndex returns the byte offsets of all fields of a CSV record
+// according to RFC 4180. Quoted fields include their quotes. A quote inside an
+// unquoted field is invalid, so the lines of a record spanning multiple lines
+// are not taken for records of their own.
+func GetCSVFieldIndex(line string, delimiter byte) ([][]int, error) {
+	var indexes [][]int
+	pos := 0
+	for {
+		start := pos
+		if pos < len(line) && line[pos] == '"' {
+			pos++
+			for {
+				end := strings.IndexByte(line[pos:], '"')
+				if end < 0 {
+					return nil, errInvalidCSV
+				}
+				pos += end + 1
+				if pos < len(line) && line[pos] == '"' {
+					// escaped quote
+					pos++
+					continue
+				}
+				break
+			}
+			if pos < len(line) && line[pos] != delimiter {
+				return nil, errInvalidCSV
+			}
+		} else {
+			end := strings.IndexByte(line[pos:], delimiter)
+			if end < 0 {
+				end = len(line) - pos
+			}
+			if strings.IndexByte(line[pos:pos+end], '"') >= 0 {
+				return nil, errInvalidCSV
+			}
+			pos += end
+		}
+		indexes = append(indexes, []int{start, pos})
+		if pos == len(line) {
+			return indexes, nil
+		}
+		pos++ // delimiter
+	}
+}
+
+// unquoteCSV returns the value of a CSV field and whether it was quoted
+func unquoteCSV(field string) (string, bool) {
+	if len(field) < 2 || field[0] != '"' {
+		return field, false
+	}
+	return strings.Replace(field[1:len(field)-1], `""`, `"`, -1), true
+}
+
+func quoteCSV(value string) string {
+	return `"` + strings.Replace(value, `"`, `""`, -1) + `"`
+}
+
+func (a *Anonymizer) csvDelimiter() byte {
+	if a.opts.Format == FormatTSV {
+		return '\t'
+	}
+	return ','
+}
+
+// NeedsHeader returns true if the column names have not been resolved yet.
+// Run takes care of this by passing the first line to ParseHeader.
+func (a *Anonymizer) NeedsHeader() bool {
+	return len(a.opts.ColumnNames) > 0 && !a.headerParsed && a.opts.Format != FormatW3C
+}
+
+// ParseHeader resolves the column names to indexes, using the header line of
+// a CSV or TSV log
+func (a *Anonymizer) ParseHeader(line string) error {
+	indexes, err := GetCSVFieldIndex(line, a.csvDelimiter())
+	if err != nil {
+		return err
+	}
+	names := map[string]uint{}
+	for i, index := range indexes {
+		name, _ := unquoteCSV(line[index[0]:index[1]])
+		names[strings.TrimSpace(name)] = uint(i)
+	}
+	for _, name := range a.opts.ColumnNames {
+		column, ok := names[name]
+		if !ok {
+			return errors.New("column not found in header: " + name)
+		}
+		a.columns = append(a.columns, column)
+	}
+	a.headerParsed = true
+	return nil
+}
+
+// csvLine anonymizes the selected columns of a CSV record. Quoting is
+// preserved; unquoted values are only quoted if their replacement requires it.
+// Records that are not valid CSV, like the lines of a record spanning
+// multiple lines, are scanned as a whole.
+func (a *Anonymizer) csvLine(line string) string {
+	delimiter := a.csvDelimiter()
+	indexes, err := GetCSVFieldIndex(line, delimiter)
+	if err != nil {
+		return a.scanLine(line)
+	}
+	var replacements []replacement
+	for _, column := range a.columns {
+		if int(column) > len(indexes)-1 {
+			continue
+		}
+		index := indexes[column]
+		value, quoted := unquoteCSV(line[index[0]:index[1]])
+		maskedValue := a.anonymizeList(value)
+		if maskedValue == value {
+			continue
+		}
+		if quoted || strings.ContainsAny(maskedValue, string(delimiter)+"\"\r\n") {
+			maskedValue = quoteCSV(maskedValue)
+		}
+		replacements = append(replacements, replacement{start: index[0], end: index[1], value: maskedValue})
+	}
+	return applyReplacements(line, replacements)
+}
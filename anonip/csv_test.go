@@ -0,0 +1,127 @@
+package anonip
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSV(t *testing.T) {
+	replaceString := "not, an address"
+
+	var testMap = []struct {
+		Input    string
+		Expected string
+		Format   string
+		Replace  *string
+	}{
+		{
+			Input:    `2020-01-01,1.2.3.4,"GET /?ip=1.2.3.4, ok",200`,
+			Expected: `2020-01-01,1.2.0.0,"GET /?ip=1.2.3.4, ok",200`,
+		},
+		{
+			Input:    `"2020-01-01","1.2.3.4:443","say ""hi""",200`,
+			Expected: `"2020-01-01","1.2.0.0:443","say ""hi""",200`,
+		},
+		{
+			Input:    `x,"1.2.3.4, 5.6.7.8"`,
+			Expected: `x,"1.2.0.0, 5.6.0.0"`,
+		},
+		{
+			Input:    `x,unknown`,
+			Expected: `x,"not, an address"`,
+			Replace:  &replaceString,
+		},
+		{
+			Input:    "2020-01-01\t1.2.3.4\tGET / 1.2.3.4",
+			Expected: "2020-01-01\t1.2.0.0\tGET / 1.2.3.4",
+			Format:   FormatTSV,
+		},
+		{
+			Input:    `x`,
+			Expected: `x`,
+		},
+		{
+			Input:    `x,"1.2.3.4`,
+			Expected: `x,"1.2.0.0`,
+		},
+		{
+			Input:    `x,"1.2.3.4"5`,
+			Expected: `x,"1.2.0.0"5`,
+		},
+		{
+			Input:    `"a"b,1.2.3.4`,
+			Expected: `"a"b,1.2.0.0`,
+		},
+		{
+			// the lines of a record spanning multiple lines
+			Input:    `x,"GET / from 1.2.3.4`,
+			Expected: `x,"GET / from 1.2.0.0`,
+		},
+		{
+			Input:    `and 5.6.7.8",1.2.3.4`,
+			Expected: `and 5.6.0.0",1.2.0.0`,
+		},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Format = FormatCSV
+			if tCase.Format != "" {
+				opts.Format = tCase.Format
+			}
+			opts.Columns = []uint{1}
+			opts.Replace = tCase.Replace
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, tCase.Expected, maskedLine, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestCSVHeader(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Format = FormatCSV
+	opts.ColumnNames = []string{"forwarded", "client"}
+	a := newAnonymizer(t, opts)
+	assert.True(t, a.NeedsHeader())
+	// the columns are unknown, all addresses are anonymized
+	assert.Equal(t, "2020,1.2.0.0,\"5.6.0.0, 9.9.0.0\"", a.HandleLine("2020,1.2.3.4,\"5.6.7.8, 9.9.9.9\""))
+
+	input := "time,\"client\", forwarded\n2020,1.2.3.4,\"5.6.7.8, 9.9.9.9\"\n"
+	var output bytes.Buffer
+	assert.NoError(t, a.Run(strings.NewReader(input), &output))
+	assert.Equal(t, "time,\"client\", forwarded\n2020,1.2.0.0,\"5.6.0.0, 9.9.0.0\"\n", output.String())
+	assert.False(t, a.NeedsHeader())
+
+	for _, input := range []string{
+		"time,client\n1,1.2.3.4\n",
+		"time,\"client\n",
+	} {
+		t.Run(input, func(t *testing.T) {
+			a := newAnonymizer(t, opts)
+			assert.Error(t, a.Run(strings.NewReader(input), &output))
+		})
+	}
+
+	a = newAnonymizer(t, opts)
+	assert.NoError(t, a.Run(strings.NewReader(""), &output))
+	assert.Error(t, a.Run(iotest.ErrReader(errors.New("read error")), &output))
+	assert.Error(t, a.Run(strings.NewReader("time,client,forwarded\n"), failingWriter{}))
+
+	opts.Format = FormatText
+	_, err := New(opts)
+	assert.Error(t, err)
+}
+
+func TestGetCSVFieldIndex(t *testing.T) {
+	indexes, err := GetCSVFieldIndex(`a,"b,""c""",,d`, ',')
+	assert.NoError(t, err)
+	assert.Equal(t, [][]int{{0, 1}, {2, 11}, {12, 12}, {13, 14}}, indexes)
+	_, err = GetCSVFieldIndex(`a,d"e`, ',')
+	assert.Error(t, err)
+}
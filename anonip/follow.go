@@ -0,0 +1,396 @@
+package anonip
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultPollInterval is how often a followed file is checked for new data
+// and rotation
+const DefaultPollInterval = 250 * time.Millisecond
+
+// stateInterval is how often the state file is saved while there is data
+// to read, it is saved whenever there isn't as well
+const stateInterval = time.Second
+
+// statFile returns the FileInfo of an open file, tests replace it to make it
+// fail
+var statFile = (*os.File).Stat
+
+// Position identifies the end of a line in a followed file. Device and Inode
+// are zero on windows.
+type Position struct {
+	Device uint64 `json:"device"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// Follower reads a file like tail -F: it keeps reading as the file grows and
+// reopens the file found at its path once it is rotated. It never returns
+// io.EOF before it is closed.
+type Follower struct {
+	path     string
+	interval time.Duration
+	mutex    sync.Mutex
+	file     *os.File
+	device   uint64
+	inode    uint64
+	offset   int64
+	lastByte byte
+	// rotating is set once the path refers to a new file, the old one is
+	// still read until it has been idle for a poll interval
+	rotating bool
+	// newline terminates the last line of a rotated file, if it wasn't
+	newline bool
+	done    chan struct{}
+	once    sync.Once
+
+	// the state file records the position after the last line written
+	stateFile string
+	// pending holds the ends of the lines read but not written yet
+	pending   []Position
+	committed Position
+	saved     Position
+	savedAt   time.Time
+}
+
+// Follow opens the file at path for following, reading from its beginning
+func Follow(path string, interval time.Duration) (*Follower, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &Follower{
+		path:     path,
+		interval: interval,
+		lastByte: '\n',
+		done:     make(chan struct{}),
+	}
+	if err := f.setFile(file); err != nil {
+		return nil, err
+	}
+	f.committed = Position{Device: f.device, Inode: f.inode}
+	return f, nil
+}
+
+// Resume is like Follow, but continues after the last line written in a
+// previous run, as recorded in stateFile. If the file has been rotated in
+// the meantime, the rest of the old file is read first, as long as it is
+// still found in the same directory. A missing state file starts at the
+// beginning. All output has to be written through Output, which tracks the
+// lines written.
+func Resume(path string, interval time.Duration, stateFile string) (*Follower, error) {
+	position, err := loadPosition(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	f, err := Follow(path, interval)
+	if err != nil {
+		return nil, err
+	}
+	f.stateFile = stateFile
+	if err := f.resume(position); err != nil {
+		_ = f.file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// resume continues reading at position
+func (f *Follower) resume(position Position) error {
+	if position.Offset == 0 {
+		return nil
+	}
+	if position.Device != f.device || position.Inode != f.inode {
+		// rotated while stopped
+		file := findFile(filepath.Dir(f.path), position)
+		if file == nil {
+			// the rest of the old file is lost
+			return nil
+		}
+		_ = f.file.Close()
+		if err := f.setFile(file); err != nil {
+			return err
+		}
+		f.committed = Position{Device: f.device, Inode: f.inode}
+	}
+	info, err := f.file.Stat()
+	if err == nil && info.Size() < position.Offset {
+		// truncated while stopped
+		return nil
+	}
+	if err == nil {
+		_, err = f.file.Seek(position.Offset, io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+	f.offset = position.Offset
+	f.committed = position
+	f.saved = position
+	return nil
+}
+
+// findFile opens the regular file in dir at position, if there is one
+func findFile(dir string, position Position) *os.File {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if device, inode := fileID(info); device == position.Device && inode == position.Inode {
+			// nil if it can't be opened
+			file, _ := os.Open(filepath.Join(dir, info.Name()))
+			return file
+		}
+	}
+	return nil
+}
+
+// setFile starts reading from file. The file is closed on failure.
+func (f *Follower) setFile(file *os.File) error {
+	info, err := statFile(file)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file = file
+	f.device, f.inode = fileID(info)
+	return nil
+}
+
+// Read reads the next data of the followed file, waiting for it if needed
+func (f *Follower) Read(p []byte) (int, error) {
+	for {
+		select {
+		case <-f.done:
+			return 0, io.EOF
+		default:
+		}
+
+		f.mutex.Lock()
+		n, err := f.read(p)
+		if err == nil && (n == 0 || time.Since(f.savedAt) >= stateInterval) {
+			err = f.save()
+		}
+		f.mutex.Unlock()
+		if n > 0 || err != nil {
+			return n, err
+		}
+
+		select {
+		case <-f.done:
+			return 0, io.EOF
+		case <-time.After(f.interval):
+		}
+	}
+}
+
+// read reads from the current file. At its end, it checks for rotation and
+// truncation, and returns 0 and no error if there is nothing to read yet.
+func (f *Follower) read(p []byte) (int, error) {
+	if f.newline && len(p) > 0 {
+		f.newline = false
+		p[0] = '\n'
+		return 1, nil
+	}
+	n, err := f.file.Read(p)
+	if n > 0 {
+		if f.stateFile != "" {
+			for i, b := range p[:n] {
+				if b == '\n' {
+					f.pending = append(f.pending, Position{Device: f.device, Inode: f.inode, Offset: f.offset + int64(i) + 1})
+				}
+			}
+		}
+		f.offset += int64(n)
+		f.lastByte = p[n-1]
+		f.rotating = false
+		return n, nil
+	}
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	current, err := f.file.Stat()
+	var info os.FileInfo
+	if err == nil {
+		info, err = os.Stat(f.path)
+	}
+	switch {
+	case os.IsNotExist(err):
+		// moved away, the new file has not been created yet
+		return 0, nil
+	case err != nil:
+		return 0, err
+	case !os.SameFile(info, current):
+		if !f.rotating {
+			// writers may still append to the old file
+			f.rotating = true
+			return 0, nil
+		}
+		file, err := os.Open(f.path)
+		if err != nil {
+			return 0, nil
+		}
+		f.restart()
+		_ = f.file.Close()
+		return 0, f.setFile(file)
+	case current.Size() < f.offset:
+		// truncated in place
+		_, err = f.file.Seek(0, io.SeekStart)
+		f.restart()
+	}
+	return 0, err
+}
+
+// restart continues at the beginning of the file
+func (f *Follower) restart() {
+	f.newline = f.lastByte != '\n'
+	if f.newline && f.stateFile != "" {
+		f.pending = append(f.pending, Position{Device: f.device, Inode: f.inode, Offset: f.offset})
+	}
+	f.lastByte = '\n'
+	f.offset = 0
+	f.rotating = false
+}
+
+// Stop makes pending and subsequent reads return io.EOF
+func (f *Follower) Stop() {
+	f.once.Do(func() {
+		close(f.done)
+	})
+}
+
+// Reopen switches to the file now found at the path as soon as the current
+// one has been read to its end, without waiting for writers to be done with
+// it
+func (f *Follower) Reopen() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	current, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	f.rotating = !os.SameFile(info, current)
+	return nil
+}
+
+// Close stops following and records the position after the last line written
+// in the state file
+func (f *Follower) Close() error {
+	f.Stop()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err := f.save()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Position returns the position after the last line written through Output
+func (f *Follower) Position() Position {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.committed
+}
+
+// Output wraps w, all lines written to it count as done and are recorded in
+// the state file
+func (f *Follower) Output(w io.Writer) io.Writer {
+	return &followerOutput{follower: f, w: w}
+}
+
+type followerOutput struct {
+	follower *Follower
+	w        io.Writer
+}
+
+func (o *followerOutput) Write(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	o.follower.commit(bytes.Count(p[:n], []byte{'\n'}))
+	return n, err
+}
+
+// commit marks the next lines read as written
+func (f *Follower) commit(lines int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if lines > len(f.pending) {
+		// an unterminated last line, it is read again on resume
+		lines = len(f.pending)
+	}
+	if lines > 0 {
+		f.committed = f.pending[lines-1]
+		f.pending = f.pending[lines:]
+	}
+}
+
+// save writes the position after the last line written to the state file,
+// if it has changed
+func (f *Follower) save() error {
+	if f.stateFile == "" || f.committed == f.saved {
+		return nil
+	}
+	if err := savePosition(f.stateFile, f.committed); err != nil {
+		return err
+	}
+	f.saved = f.committed
+	f.savedAt = time.Now()
+	return nil
+}
+
+// loadPosition reads a state file, which may not exist yet
+func loadPosition(path string) (Position, error) {
+	var position Position
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return position, nil
+	}
+	if err != nil {
+		return position, err
+	}
+	if err := json.Unmarshal(data, &position); err != nil {
+		return position, errors.New("invalid state file " + path + ": " + err.Error())
+	}
+	return position, nil
+}
+
+// savePosition replaces the state file atomically
+func savePosition(path string, position Position) error {
+	data, _ := json.Marshal(position)
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".anonip-*")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(append(data, '\n'))
+	if err == nil {
+		// the state must not be lost or empty after a crash
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(temp.Name())
+	}
+	return err
+}
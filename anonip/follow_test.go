@@ -0,0 +1,348 @@
+package anonip
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func appendFile(t *testing.T, path string, data string) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// followLines reads the lines of f through its output
+func followLines(f *Follower) chan string {
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(f)
+		output := f.Output(ioutil.Discard)
+		for scanner.Scan() {
+			_, _ = io.WriteString(output, scanner.Text()+"\n")
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	return lines
+}
+
+func expectLines(t *testing.T, lines chan string, expected ...string) {
+	for _, e := range expected {
+		select {
+		case line := <-lines:
+			assert.Equal(t, e, line)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for " + e)
+		}
+	}
+}
+
+func TestFollow(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("open files can't be renamed on windows")
+	}
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	appendFile(t, path, "a\n")
+
+	_, err = Follow(filepath.Join(dir, "missing"), time.Millisecond)
+	assert.Error(t, err)
+
+	follower, err := Follow(path, 5*time.Millisecond)
+	assert.NoError(t, err)
+	lines := followLines(follower)
+	expectLines(t, lines, "a")
+	appendFile(t, path, "b\n")
+	expectLines(t, lines, "b")
+
+	// rotated by rename, while the old file is still written to
+	assert.NoError(t, os.Rename(path, path+".1"))
+	time.Sleep(20 * time.Millisecond)
+	appendFile(t, path+".1", "c\n")
+	appendFile(t, path, "d\n")
+	expectLines(t, lines, "c")
+	expectLines(t, lines, "d")
+
+	// an unterminated line doesn't run into the first line of the new file
+	appendFile(t, path, "e")
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, os.Rename(path, path+".2"))
+	appendFile(t, path, "f\n")
+	expectLines(t, lines, "e")
+	expectLines(t, lines, "f")
+
+	// truncated in place
+	assert.NoError(t, os.Truncate(path, 0))
+	time.Sleep(20 * time.Millisecond)
+	appendFile(t, path, "g\n")
+	expectLines(t, lines, "g")
+
+	// reopened on request
+	assert.NoError(t, os.Rename(path, path+".3"))
+	assert.Error(t, follower.Reopen())
+	appendFile(t, path, "h\n")
+	assert.NoError(t, follower.Reopen())
+	expectLines(t, lines, "h")
+
+	assert.NoError(t, follower.Close())
+	select {
+	case _, ok := <-lines:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the end")
+	}
+	n, err := follower.Read(make([]byte, 1))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+	assert.Error(t, follower.Reopen())
+}
+
+func TestFollowFail(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("open files can't be renamed on windows")
+	}
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "logs", "access.log")
+	if err := os.Mkdir(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "a\n")
+	statFail := func(*os.File) (os.FileInfo, error) {
+		return nil, errors.New("stat failed")
+	}
+	defer func() { statFile = (*os.File).Stat }()
+
+	statFile = statFail
+	_, err = Follow(path, time.Millisecond)
+	assert.EqualError(t, err, "stat failed")
+	statFile = (*os.File).Stat
+
+	t.Run("directory", func(t *testing.T) {
+		follower, err := Follow(dir, time.Millisecond)
+		assert.NoError(t, err)
+		defer follower.Close()
+		_, err = follower.Read(make([]byte, 10))
+		assert.Error(t, err)
+	})
+
+	buf := make([]byte, 10)
+	t.Run("moved away with its directory", func(t *testing.T) {
+		follower, err := Follow(path, time.Millisecond)
+		assert.NoError(t, err)
+		defer follower.Close()
+		_, err = follower.read(buf)
+		assert.NoError(t, err)
+		assert.NoError(t, os.Rename(filepath.Dir(path), filepath.Dir(path)+".1"))
+		defer os.Rename(filepath.Dir(path)+".1", filepath.Dir(path))
+		appendFile(t, filepath.Dir(path), "not a directory")
+		defer os.Remove(filepath.Dir(path))
+		_, err = follower.read(buf)
+		assert.Error(t, err)
+	})
+
+	t.Run("new file can't be opened", func(t *testing.T) {
+		follower, err := Follow(path, time.Millisecond)
+		assert.NoError(t, err)
+		defer follower.Close()
+		_, err = follower.read(buf)
+		assert.NoError(t, err)
+		assert.NoError(t, os.Rename(path, path+".1"))
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			n, err := follower.read(buf)
+			assert.Equal(t, 0, n)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, listener.Close())
+		_ = os.Remove(path)
+		assert.NoError(t, os.Rename(path+".1", path))
+	})
+
+	t.Run("new file can't be read", func(t *testing.T) {
+		follower, err := Follow(path, time.Millisecond)
+		assert.NoError(t, err)
+		defer follower.Close()
+		_, err = follower.read(buf)
+		assert.NoError(t, err)
+		assert.NoError(t, os.Rename(path, path+".1"))
+		appendFile(t, path, "b\n")
+		_, err = follower.read(buf)
+		assert.NoError(t, err)
+		statFile = statFail
+		_, err = follower.read(buf)
+		assert.EqualError(t, err, "stat failed")
+	})
+}
+
+func TestResume(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("open files can't be renamed on windows")
+	}
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	state := filepath.Join(dir, "state.json")
+	appendFile(t, path, "a\nb\n")
+
+	resume := func(expected ...string) Position {
+		follower, err := Resume(path, 5*time.Millisecond, state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := followLines(follower)
+		expectLines(t, lines, expected...)
+		assert.NoError(t, follower.Close())
+		for range lines {
+		}
+		position, err := loadPosition(state)
+		assert.NoError(t, err)
+		assert.Equal(t, follower.Position(), position)
+		return position
+	}
+	offset := func(position Position) int64 {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		device, inode := fileID(info)
+		assert.Equal(t, device, position.Device)
+		assert.Equal(t, inode, position.Inode)
+		return position.Offset
+	}
+
+	// without a state file, from the beginning
+	assert.Equal(t, int64(4), offset(resume("a", "b")))
+	appendFile(t, path, "c\n")
+	assert.Equal(t, int64(6), offset(resume("c")))
+
+	// rotated while stopped
+	appendFile(t, path, "d\n")
+	assert.NoError(t, os.Rename(path, path+".1"))
+	appendFile(t, path, "e\n")
+	assert.Equal(t, int64(2), offset(resume("d", "e")))
+
+	// rotated and removed while stopped
+	appendFile(t, path, "f\n")
+	assert.NoError(t, os.Rename(path, path+".1"))
+	appendFile(t, path, "g\n")
+	assert.NoError(t, os.Remove(path+".1"))
+	assert.Equal(t, int64(2), offset(resume("g")))
+
+	// truncated while stopped
+	assert.NoError(t, os.Truncate(path, 0))
+	follower, err := Resume(path, 5*time.Millisecond, state)
+	assert.NoError(t, err)
+	lines := followLines(follower)
+	appendFile(t, path, "h\n")
+	expectLines(t, lines, "h")
+	// an unterminated line is read again
+	appendFile(t, path, "i")
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, follower.Close())
+	expectLines(t, lines, "i")
+	assert.Equal(t, int64(2), offset(follower.Position()))
+
+	_, err = Resume(filepath.Join(dir, "missing"), time.Millisecond, state)
+	assert.Error(t, err)
+	_, err = Resume(path, time.Millisecond, dir)
+	assert.Error(t, err)
+	if err := ioutil.WriteFile(state, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Resume(path, time.Millisecond, state)
+	assert.EqualError(t, err, "invalid state file "+state+": unexpected end of JSON input")
+
+	// the state file can't be written
+	follower, err = Resume(path, time.Millisecond, filepath.Join(dir, "missing", "state.json"))
+	assert.NoError(t, err)
+	_, err = follower.Read(make([]byte, 10))
+	assert.Error(t, err)
+	assert.Error(t, follower.Close())
+}
+
+func TestResumeFail(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("open files can't be renamed on windows")
+	}
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	state := filepath.Join(dir, "state.json")
+	appendFile(t, path, "a\n")
+	// not taken for the rotated file, listed first
+	if err := os.Mkdir(filepath.Join(dir, "a"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	follower, err := Resume(path, time.Millisecond, state)
+	assert.NoError(t, err)
+	lines := followLines(follower)
+	expectLines(t, lines, "a")
+	// truncated after an unterminated line
+	appendFile(t, path, "b")
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, os.Truncate(path, 0))
+	appendFile(t, path, "c\n")
+	expectLines(t, lines, "b", "c")
+	assert.NoError(t, follower.Close())
+	for range lines {
+	}
+
+	// the rotated file can't be read
+	assert.NoError(t, os.Rename(path, path+".1"))
+	appendFile(t, path, "d\n")
+	defer func() { statFile = (*os.File).Stat }()
+	statFile = func(file *os.File) (os.FileInfo, error) {
+		if file.Name() == path+".1" {
+			return nil, errors.New("stat failed")
+		}
+		return file.Stat()
+	}
+	_, err = Resume(path, time.Millisecond, state)
+	assert.EqualError(t, err, "stat failed")
+	statFile = (*os.File).Stat
+
+	follower, err = Follow(path, time.Millisecond)
+	assert.NoError(t, err)
+	assert.NoError(t, follower.file.Close())
+	assert.Error(t, follower.resume(Position{Device: follower.device, Inode: follower.inode, Offset: 1}))
+
+	assert.Nil(t, findFile(filepath.Join(dir, "missing"), Position{}))
+	// a directory can't replace the state file
+	assert.Error(t, savePosition(dir, Position{}))
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 4)
+}
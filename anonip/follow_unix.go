@@ -0,0 +1,14 @@
+//go:build !windows
+
+package anonip
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the device and inode of info
+func fileID(info os.FileInfo) (uint64, uint64) {
+	stat := info.Sys().(*syscall.Stat_t)
+	return uint64(stat.Dev), uint64(stat.Ino)
+}
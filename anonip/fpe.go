@@ -0,0 +1,92 @@
+package anonip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// number of Feistel rounds used for IPv4 addresses
+const fpeRounds = 12
+
+// FPE encrypts IP addresses into IP addresses of the same family, so the
+// anonymization can be reversed with the same key.
+//
+// IPv6 addresses are encrypted with AES directly, as they have the size of an
+// AES block. IPv4 addresses are encrypted with a balanced Feistel network on
+// their two 16 bit halves, using AES as round function.
+type FPE struct {
+	block cipher.Block
+}
+
+// NewFPE creates an FPE cipher. The AES-256 key is derived from the given
+// secret with SHA-256.
+func NewFPE(key []byte) (*FPE, error) {
+	if len(key) < MinKeyLength {
+		return nil, fmt.Errorf("encryption requires a key of at least %d bytes", MinKeyLength)
+	}
+	aesKey := sha256.Sum256(key)
+	// 32 bytes are always a valid AES key
+	block, _ := aes.NewCipher(aesKey[:])
+	return &FPE{block: block}, nil
+}
+
+// round is the Feistel round function for IPv4 addresses
+func (f *FPE) round(i int, half uint16) uint16 {
+	var input, output [aes.BlockSize]byte
+	input[0] = net.IPv4len
+	input[1] = byte(i)
+	binary.BigEndian.PutUint16(input[2:], half)
+	f.block.Encrypt(output[:], input[:])
+	return binary.BigEndian.Uint16(output[:])
+}
+
+// Encrypt encrypts an IP address
+func (f *FPE) Encrypt(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		left, right := binary.BigEndian.Uint16(ip4), binary.BigEndian.Uint16(ip4[2:])
+		for i := 0; i < fpeRounds; i++ {
+			left, right = right, left^f.round(i, right)
+		}
+		return feistelIP(left, right)
+	}
+	result := make(net.IP, net.IPv6len)
+	f.block.Encrypt(result, ip)
+	return result
+}
+
+// Decrypt reverses Encrypt
+func (f *FPE) Decrypt(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		left, right := binary.BigEndian.Uint16(ip4), binary.BigEndian.Uint16(ip4[2:])
+		for i := fpeRounds - 1; i >= 0; i-- {
+			left, right = right^f.round(i, left), left
+		}
+		return feistelIP(left, right)
+	}
+	result := make(net.IP, net.IPv6len)
+	f.block.Decrypt(result, ip)
+	return result
+}
+
+func feistelIP(left, right uint16) net.IP {
+	result := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint16(result, left)
+	binary.BigEndian.PutUint16(result[2:], right)
+	return result
+}
+
+type fpeTransformer struct {
+	fpe     *FPE
+	reverse bool
+}
+
+func (t fpeTransformer) transform(ip net.IP) net.IP {
+	if t.reverse {
+		return t.fpe.Decrypt(ip)
+	}
+	return t.fpe.Encrypt(ip)
+}
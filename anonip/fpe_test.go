@@ -0,0 +1,100 @@
+package anonip
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFPE(t *testing.T) {
+	var testMap = []struct {
+		Input    string
+		Expected string
+	}{
+		{
+			Input:    "1.2.3.4",
+			Expected: "110.20.210.192",
+		},
+		{
+			Input:    "2001:db8::1",
+			Expected: "30f5:cb11:9370:c29:38fb:aecf:e96b:79f5",
+		},
+	}
+
+	fpe, err := NewFPE(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			encrypted := fpe.Encrypt(net.ParseIP(tCase.Input))
+			assert.Equal(t, tCase.Expected, encrypted.String())
+			assert.Equal(t, tCase.Input, fpe.Decrypt(encrypted).String())
+		})
+	}
+}
+
+func TestFPERoundTrip(t *testing.T) {
+	fpe, err := NewFPE(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		ip := net.IPv4(byte(i>>8), byte(i), byte(i*7), byte(i*13))
+		encrypted := fpe.Encrypt(ip)
+		assert.Len(t, encrypted, net.IPv4len)
+		assert.False(t, seen[encrypted.String()], "collision for %v", ip)
+		seen[encrypted.String()] = true
+		assert.True(t, ip.Equal(fpe.Decrypt(encrypted)), "round trip failed for %v", ip)
+	}
+}
+
+func TestEncryptMode(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Mode = ModeEncrypt
+	opts.Key = testKey
+	opts.Columns = []uint{0, 1}
+	line := "1.2.3.4 [2001:db8::1]:443 foo"
+
+	encrypted := newAnonymizer(t, opts).HandleLine(line)
+	assert.Equal(t, "110.20.210.192 [30f5:cb11:9370:c29:38fb:aecf:e96b:79f5]:443 foo", encrypted)
+
+	opts.Reverse = true
+	assert.Equal(t, line, newAnonymizer(t, opts).HandleLine(encrypted))
+}
+
+func TestEncryptModeFail(t *testing.T) {
+	var testMap = []struct {
+		Name string
+		Opts func(opts *Options)
+	}{
+		{
+			Name: "short key",
+			Opts: func(opts *Options) { opts.Key = []byte("short") },
+		},
+		{
+			Name: "reverse other mode",
+			Opts: func(opts *Options) { opts.Mode = ModeHMAC },
+		},
+		{
+			Name: "reverse skip private",
+			Opts: func(opts *Options) { opts.SkipPrivate = true },
+		},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Mode = ModeEncrypt
+			opts.Key = testKey
+			opts.Reverse = true
+			tCase.Opts(&opts)
+			_, err := New(opts)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package anonip
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ReplaceFile replaces the regular file at path with the content written by
+// write. The content goes to a temporary file in the same directory, which
+// gets the mode, owner and modification time of the original, is synced and
+// then renamed over the original. So a crash leaves either the original or
+// the complete new file behind, never a partially written one. If
+// backupSuffix is not empty, the original is kept under its name with the
+// suffix appended. Symbolic links are followed.
+func ReplaceFile(path, backupSuffix string, write func(io.Writer) error) error {
+	path, err := filepath.EvalSymlinks(path)
+	var info os.FileInfo
+	if err == nil {
+		info, err = os.Stat(path)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New("not a regular file: " + path)
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".anonip-*")
+	if err != nil {
+		return err
+	}
+	err = write(temp)
+	if err == nil {
+		err = chown(temp, info)
+	}
+	if err == nil {
+		err = temp.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(temp.Name(), time.Time{}, info.ModTime())
+	}
+	if err == nil && backupSuffix != "" {
+		err = backup(path, path+backupSuffix)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(temp.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// backup links the original to its backup name, replacing an earlier backup.
+// The original stays in place until the rename.
+func backup(path, backup string) error {
+	if err := os.Remove(backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Link(path, backup)
+}
@@ -0,0 +1,113 @@
+package anonip
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplaceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	if err := ioutil.WriteFile(path, []byte("1.2.3.4\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "current.log")
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newAnonymizer(t, DefaultOptions())
+	anonymize := func(w io.Writer) error {
+		input, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer input.Close()
+		return a.Run(input, w)
+	}
+	assert.NoError(t, ReplaceFile(link, ".orig", anonymize))
+
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.0.0\n", string(content))
+	content, err = ioutil.ReadFile(path + ".orig")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.4\n", string(content))
+	info, err := os.Lstat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode())
+	assert.True(t, modTime.Equal(info.ModTime()))
+	info, err = os.Lstat(link)
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeSymlink, info.Mode()&os.ModeSymlink)
+
+	// an existing backup is replaced
+	assert.NoError(t, ReplaceFile(path, ".orig", anonymize))
+	content, err = ioutil.ReadFile(path + ".orig")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.0.0\n", string(content))
+
+	// nothing is left behind on failure
+	assert.EqualError(t, ReplaceFile(path, "", func(w io.Writer) error {
+		_, _ = io.WriteString(w, "partial")
+		return errors.New("write failed")
+	}), "write failed")
+	content, err = ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.0.0\n", string(content))
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 3)
+
+	assert.Error(t, ReplaceFile(filepath.Join(dir, "missing"), "", anonymize))
+	assert.Error(t, ReplaceFile(dir, "", anonymize))
+	// a backup that can't be replaced
+	if err := os.MkdirAll(filepath.Join(dir, "access.log.bak", "x"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, ReplaceFile(path, ".bak", anonymize))
+	// the directory of the backup doesn't exist
+	assert.Error(t, ReplaceFile(path, ".d/bak", anonymize))
+
+	// the name of the temporary file is too long
+	long := filepath.Join(dir, strings.Repeat("x", 250))
+	if err := ioutil.WriteFile(long, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, ReplaceFile(long, "", anonymize))
+
+	// the file is replaced by a directory while writing
+	assert.Error(t, ReplaceFile(path, "", func(io.Writer) error {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		return os.MkdirAll(filepath.Join(path, "x"), 0700)
+	}))
+	files, err = ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 5)
+
+	if runtime.GOOS != "windows" {
+		assert.Error(t, syncDir(filepath.Join(dir, "missing")))
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package anonip
+
+import (
+	"os"
+	"syscall"
+)
+
+// chown gives file the owner and group of info
+func chown(file *os.File, info os.FileInfo) error {
+	stat := info.Sys().(*syscall.Stat_t)
+	return file.Chown(int(stat.Uid), int(stat.Gid))
+}
+
+// syncDir makes a rename within dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,15 @@
+package anonip
+
+import (
+	"os"
+)
+
+// chown is not supported on windows, files get the owner of their directory
+func chown(*os.File, os.FileInfo) error {
+	return nil
+}
+
+// syncDir is a no-op, directories can't be synced on windows
+func syncDir(string) error {
+	return nil
+}
@@ -0,0 +1,246 @@
+package anonip
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// jsonScanner walks a JSON document and records the byte offsets of all
+// string values found at the selected field paths. It does not decode the
+// document, so the line can be rewritten without touching anything else.
+type jsonScanner struct {
+	data    string
+	pos     int
+	fields  [][]string
+	indexes [][]int
+}
+
+var errInvalidJSON = errors.New("invalid JSON")
+
+// FindJSONFields returns the byte offsets of all string literals (including
+// their quotes) found at the given field paths of a JSON document. A path is a
+// list of object keys; arrays on the way are traversed element by element.
+func FindJSONFields(data string, fields [][]string) ([][]int, error) {
+	s := &jsonScanner{data: data, fields: fields}
+	s.skipSpace()
+	if err := s.value(nil); err != nil {
+		return nil, err
+	}
+	s.skipSpace()
+	if s.pos != len(s.data) {
+		return nil, errInvalidJSON
+	}
+	return s.indexes, nil
+}
+
+// ParseFieldPath splits a dotted field path like "client.ip" into its keys
+func ParseFieldPath(field string) []string {
+	return strings.Split(field, ".")
+}
+
+func (s *jsonScanner) skipSpace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (s *jsonScanner) selected(path []string) bool {
+	for _, field := range s.fields {
+		if len(field) != len(path) {
+			continue
+		}
+		match := true
+		for i := range field {
+			if field[i] != path[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *jsonScanner) value(path []string) error {
+	if s.pos >= len(s.data) {
+		return errInvalidJSON
+	}
+	switch c := s.data[s.pos]; {
+	case c == '{':
+		return s.object(path)
+	case c == '[':
+		return s.array(path)
+	case c == '"':
+		start := s.pos
+		if _, err := s.str(); err != nil {
+			return err
+		}
+		if s.selected(path) {
+			s.indexes = append(s.indexes, []int{start, s.pos})
+		}
+		return nil
+	case c == '-' || c >= '0' && c <= '9':
+		return s.number()
+	}
+	for _, literal := range []string{"true", "false", "null"} {
+		if strings.HasPrefix(s.data[s.pos:], literal) {
+			s.pos += len(literal)
+			return nil
+		}
+	}
+	return errInvalidJSON
+}
+
+func (s *jsonScanner) object(path []string) error {
+	s.pos++ // {
+	s.skipSpace()
+	if s.pos < len(s.data) && s.data[s.pos] == '}' {
+		s.pos++
+		return nil
+	}
+	for {
+		if s.pos >= len(s.data) || s.data[s.pos] != '"' {
+			return errInvalidJSON
+		}
+		key, err := s.str()
+		if err != nil {
+			return err
+		}
+		s.skipSpace()
+		if s.pos >= len(s.data) || s.data[s.pos] != ':' {
+			return errInvalidJSON
+		}
+		s.pos++
+		s.skipSpace()
+		if err := s.value(append(path[:len(path):len(path)], key)); err != nil {
+			return err
+		}
+		s.skipSpace()
+		if s.pos >= len(s.data) {
+			return errInvalidJSON
+		}
+		switch s.data[s.pos] {
+		case ',':
+			s.pos++
+			s.skipSpace()
+		case '}':
+			s.pos++
+			return nil
+		default:
+			return errInvalidJSON
+		}
+	}
+}
+
+func (s *jsonScanner) array(path []string) error {
+	s.pos++ // [
+	s.skipSpace()
+	if s.pos < len(s.data) && s.data[s.pos] == ']' {
+		s.pos++
+		return nil
+	}
+	for {
+		if err := s.value(path); err != nil {
+			return err
+		}
+		s.skipSpace()
+		if s.pos >= len(s.data) {
+			return errInvalidJSON
+		}
+		switch s.data[s.pos] {
+		case ',':
+			s.pos++
+			s.skipSpace()
+		case ']':
+			s.pos++
+			return nil
+		default:
+			return errInvalidJSON
+		}
+	}
+}
+
+// str consumes a string literal and returns its decoded value
+func (s *jsonScanner) str() (string, error) {
+	start := s.pos
+	s.pos++ // "
+	escaped := false
+	for s.pos < len(s.data) {
+		switch c := s.data[s.pos]; {
+		case c == '\\':
+			escaped = true
+			s.pos += 2
+		case c == '"':
+			s.pos++
+			raw := s.data[start:s.pos]
+			if !escaped {
+				return raw[1 : len(raw)-1], nil
+			}
+			var value string
+			if err := json.Unmarshal([]byte(raw), &value); err != nil {
+				return "", errInvalidJSON
+			}
+			return value, nil
+		case c < 0x20:
+			return "", errInvalidJSON
+		default:
+			s.pos++
+		}
+	}
+	return "", errInvalidJSON
+}
+
+func (s *jsonScanner) number() error {
+	start := s.pos
+	for s.pos < len(s.data) && strings.IndexByte("+-0123456789.eE", s.data[s.pos]) >= 0 {
+		s.pos++
+	}
+	var n json.Number
+	if err := json.Unmarshal([]byte(s.data[start:s.pos]), &n); err != nil {
+		return errInvalidJSON
+	}
+	return nil
+}
+
+// encodeJSONString encodes a string as JSON literal, without escaping HTML
+func encodeJSONString(value string) string {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(value) // strings can always be encoded
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// jsonLine anonymizes the selected fields of a JSON document. Lines that are
+// not valid JSON are scanned as a whole.
+func (a *Anonymizer) jsonLine(line string) string {
+	indexes, err := FindJSONFields(line, a.fieldPaths)
+	if err != nil {
+		return a.scanLine(line)
+	}
+	var replacements []replacement
+	for _, index := range indexes {
+		var value string
+		// the literal has already been validated by the scanner
+		_ = json.Unmarshal([]byte(line[index[0]:index[1]]), &value)
+		maskedValue := a.anonymizeList(value)
+		if maskedValue == value {
+			continue
+		}
+		replacements = append(replacements, replacement{
+			start: index[0],
+			end:   index[1],
+			value: encodeJSONString(maskedValue),
+		})
+	}
+	return applyReplacements(line, replacements)
+}
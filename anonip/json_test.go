@@ -0,0 +1,130 @@
+package anonip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSON(t *testing.T) {
+	replaceString := "0.0.0.0"
+
+	var testMap = []struct {
+		Input    string
+		Expected string
+		Replace  *string
+	}{
+		{
+			Input:    `{"b":1,"client":{"ip":"203.0.113.7","port":5522},"a":"203.0.113.7"}`,
+			Expected: `{"b":1,"client":{"ip":"203.0.112.0","port":5522},"a":"203.0.113.7"}`,
+		},
+		{
+			Input:    `{ "headers" : { "x-forwarded-for" : "1.2.3.4, 5.6.7.8" } }`,
+			Expected: `{ "headers" : { "x-forwarded-for" : "1.2.0.0, 5.6.0.0" } }`,
+		},
+		{
+			Input:    `{"headers":{"x-forwarded-for":["1.2.3.4","[2001:db8::1]:443",null,7]}}`,
+			Expected: `{"headers":{"x-forwarded-for":["1.2.0.0","[2001:db8::]:443",null,7]}}`,
+		},
+		{
+			Input:    `{"hops":[{"ip":"1.2.3.4"},{"ip":"5.6.7.8","x":[true,false,{}]}]}`,
+			Expected: `{"hops":[{"ip":"1.2.0.0"},{"ip":"5.6.0.0","x":[true,false,{}]}]}`,
+		},
+		{
+			Input:    `{"client":{"ip":"1.2.3.4"},"msg":"a \"quoted\" <b>"}`,
+			Expected: `{"client":{"ip":"1.2.0.0"},"msg":"a \"quoted\" <b>"}`,
+		},
+		{
+			Input:    `{"cli\u0065nt":{"ip":"1.2.3.\u0034"}}`,
+			Expected: `{"cli\u0065nt":{"ip":"1.2.0.0"}}`,
+		},
+		{
+			Input:    `{"client":{"ip":"unknown"},"n":-1.5E+3}`,
+			Expected: `{"client":{"ip":"0.0.0.0"},"n":-1.5E+3}`,
+			Replace:  &replaceString,
+		},
+		{
+			Input:    `{"client":{"ip":"unknown"}}`,
+			Expected: `{"client":{"ip":"unknown"}}`,
+		},
+		{
+			Input:    `{"client":"1.2.3.4","ip":"1.2.3.4"}`,
+			Expected: `{"client":"1.2.3.4","ip":"1.2.3.4"}`,
+		},
+		{
+			Input:    `not json 1.2.3.4`,
+			Expected: `not json 1.2.0.0`,
+		},
+		{
+			Input:    `{"client":{"ip":"1.2.3.4",}}`,
+			Expected: `{"client":{"ip":"1.2.0.0",}}`,
+		},
+		{
+			Input:    `{"client":{"ip":"1.2.3.4"}} trailing 2001:db8::1`,
+			Expected: `{"client":{"ip":"1.2.0.0"}} trailing 2001:db8::`,
+		},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Format = FormatJSON
+			opts.Fields = []string{"client.ip", "headers.x-forwarded-for", "hops.ip"}
+			opts.Replace = tCase.Replace
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, tCase.Expected, maskedLine, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestFindJSONFields(t *testing.T) {
+	fields := [][]string{ParseFieldPath("a.b")}
+
+	indexes, err := FindJSONFields(` {"a": {"b": "x"}} `, fields)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]int{{13, 16}}, indexes)
+
+	indexes, err = FindJSONFields(`[[], {"a": {"b": "y"}}]`, fields)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]int{{17, 20}}, indexes)
+
+	for _, input := range []string{
+		``,
+		`{`,
+		`{"a"`,
+		`{"a" 1}`,
+		`{"a":1`,
+		`{"a":1 "b":2}`,
+		`{1:1}`,
+		`{"a":}`,
+		`[1`,
+		`[1 2]`,
+		`[`,
+		`"abc`,
+		`"a\"`,
+		"\"a\tb\"",
+		`"\x"`,
+		`{"\x":1}`,
+		`1.2.3`,
+		`-`,
+		`nope`,
+		`{} {}`,
+	} {
+		t.Run(input, func(t *testing.T) {
+			_, err := FindJSONFields(input, fields)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNewFormatFail(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Format = FormatJSON
+	_, err := New(opts)
+	assert.Error(t, err)
+
+	opts.Format = "yaml"
+	opts.Fields = []string{"ip"}
+	_, err = New(opts)
+	assert.Error(t, err)
+}
@@ -0,0 +1,105 @@
+package anonip
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errInvalidLogfmt = errors.New("invalid logfmt")
+
+// FindLogfmtValues returns the byte offsets of the values of the given keys in
+// a logfmt line. Quoted values include their quotes.
+func FindLogfmtValues(line string, keys []string) ([][]int, error) {
+	var indexes [][]int
+	pos := 0
+	for {
+		for pos < len(line) && line[pos] == ' ' {
+			pos++
+		}
+		if pos == len(line) {
+			return indexes, nil
+		}
+
+		keyStart := pos
+		for pos < len(line) && line[pos] != '=' && line[pos] != ' ' {
+			if line[pos] == '"' {
+				return nil, errInvalidLogfmt
+			}
+			pos++
+		}
+		key := line[keyStart:pos]
+		if pos == len(line) || line[pos] == ' ' {
+			// key without value
+			continue
+		}
+		pos++ // =
+
+		valueStart := pos
+		if pos < len(line) && line[pos] == '"' {
+			pos++
+			for pos < len(line) && line[pos] != '"' {
+				if line[pos] == '\\' {
+					pos++
+				}
+				pos++
+			}
+			if pos >= len(line) {
+				return nil, errInvalidLogfmt
+			}
+			pos++ // "
+			if pos < len(line) && line[pos] != ' ' {
+				return nil, errInvalidLogfmt
+			}
+		} else {
+			for pos < len(line) && line[pos] != ' ' {
+				pos++
+			}
+		}
+
+		for _, k := range keys {
+			if k == key {
+				indexes = append(indexes, []int{valueStart, pos})
+				break
+			}
+		}
+	}
+}
+
+// needsQuoting returns true if a logfmt value can't be written bare
+func needsQuoting(value string) bool {
+	return value == "" || strings.ContainsAny(value, " =\"\\") || strings.IndexFunc(value, func(r rune) bool {
+		return r < 0x20
+	}) >= 0
+}
+
+// logfmtLine anonymizes the values of the selected keys of a logfmt line.
+// Quoting is preserved; bare values are only quoted if their replacement
+// requires it. Lines that are not valid logfmt are scanned as a whole.
+func (a *Anonymizer) logfmtLine(line string) string {
+	indexes, err := FindLogfmtValues(line, a.opts.Fields)
+	if err != nil {
+		return a.scanLine(line)
+	}
+	var replacements []replacement
+	for _, index := range indexes {
+		raw := line[index[0]:index[1]]
+		quoted := strings.HasPrefix(raw, "\"")
+		value := raw
+		if quoted {
+			value = raw[1 : len(raw)-1]
+			if unquoted, err := strconv.Unquote(raw); err == nil {
+				value = unquoted
+			}
+		}
+		maskedValue := a.anonymizeList(value)
+		if maskedValue == value {
+			continue
+		}
+		if quoted || needsQuoting(maskedValue) {
+			maskedValue = strconv.Quote(maskedValue)
+		}
+		replacements = append(replacements, replacement{start: index[0], end: index[1], value: maskedValue})
+	}
+	return applyReplacements(line, replacements)
+}
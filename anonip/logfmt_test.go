@@ -0,0 +1,96 @@
+package anonip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogfmt(t *testing.T) {
+	replaceString := "not an address"
+
+	var testMap = []struct {
+		Input    string
+		Expected string
+		Replace  *string
+	}{
+		{
+			Input:    `ts=2020-01-01T00:00:00Z remote_addr=1.2.3.4:5555 msg="from 1.2.3.4" other=1.2.3.4`,
+			Expected: `ts=2020-01-01T00:00:00Z remote_addr=1.2.0.0:5555 msg="from 1.2.3.4" other=1.2.3.4`,
+		},
+		{
+			Input:    `remote_addr="[2001:db8::1]:443"  level=info`,
+			Expected: `remote_addr="[2001:db8::]:443"  level=info`,
+		},
+		{
+			Input:    `debug forwarded="1.2.3.4, 5.6.7.8" remote_addr=3.3.3.3`,
+			Expected: `debug forwarded="1.2.0.0, 5.6.0.0" remote_addr=3.3.0.0`,
+		},
+		{
+			Input:    `remote_addr="1.2.3.4"`,
+			Expected: `remote_addr="1.2.0.0"`,
+		},
+		{
+			Input:    `remote_addr="1.2.3.\/4"`,
+			Expected: `remote_addr="1.2.3.\/4"`,
+		},
+		{
+			Input:    `remote_addr=unknown`,
+			Expected: `remote_addr="not an address"`,
+			Replace:  &replaceString,
+		},
+		{
+			Input:    `remote_addr= msg=x`,
+			Expected: `remote_addr= msg=x`,
+		},
+		{
+			Input:    `remote_addr="1.2.3.4`,
+			Expected: `remote_addr="1.2.0.0`,
+		},
+		{
+			Input:    `remote_addr=1.2.3.4:5555 msg="unterminated`,
+			Expected: `remote_addr=1.2.0.0:5555 msg="unterminated`,
+		},
+		{
+			Input:    `remote_addr=1.2.3.4 a"b=1`,
+			Expected: `remote_addr=1.2.0.0 a"b=1`,
+		},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Format = FormatLogfmt
+			opts.Fields = []string{"remote_addr", "forwarded"}
+			opts.Replace = tCase.Replace
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, tCase.Expected, maskedLine, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestFindLogfmtValues(t *testing.T) {
+	indexes, err := FindLogfmtValues(`a=1 b="x y" c`, []string{"b", "c"})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]int{{6, 11}}, indexes)
+
+	for _, input := range []string{
+		`a="1`,
+		`a="1"b=2`,
+		`"a"=1`,
+		`a="\"`,
+	} {
+		t.Run(input, func(t *testing.T) {
+			_, err := FindLogfmtValues(input, []string{"a"})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNeedsQuoting(t *testing.T) {
+	assert.False(t, needsQuoting("1.2.0.0"))
+	assert.True(t, needsQuoting(""))
+	assert.True(t, needsQuoting("a b"))
+	assert.True(t, needsQuoting("a\tb"))
+	assert.True(t, needsQuoting(`a"b`))
+}
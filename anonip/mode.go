@@ -0,0 +1,112 @@
+package anonip
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// Anonymization modes
+const (
+	// ModeTruncate zeroes the trailing bits of an address
+	ModeTruncate = "truncate"
+	// ModeHMAC replaces an address with a keyed pseudonym of the same family
+	ModeHMAC = "hmac"
+	// ModeCryptoPAn replaces an address with a keyed, prefix-preserving
+	// pseudonym of the same family
+	ModeCryptoPAn = "cryptopan"
+	// ModeEncrypt replaces an address with an encrypted address of the same
+	// family. It is the only mode that can be reversed
+	ModeEncrypt = "encrypt"
+)
+
+// Modes lists all available anonymization modes
+var Modes = []string{ModeTruncate, ModeHMAC, ModeCryptoPAn, ModeEncrypt}
+
+// MinKeyLength is the minimal length of a key in bytes
+const MinKeyLength = 16
+
+// transformer maps an IP address to its anonymized counterpart
+type transformer interface {
+	transform(ip net.IP) net.IP
+}
+
+type truncateTransformer struct {
+	ipv4Mask  int
+	ipv6Mask  int
+	increment uint
+}
+
+func (t truncateTransformer) transform(ip net.IP) net.IP {
+	maskedIP := MaskIP(ip, t.ipv4Mask, t.ipv6Mask)
+	if t.increment > 0 {
+		IncrementIP(maskedIP, t.increment)
+	}
+	return maskedIP
+}
+
+type hmacTransformer struct {
+	key []byte
+}
+
+func (t hmacTransformer) transform(ip net.IP) net.IP {
+	return PseudonymizeIP(ip, t.key)
+}
+
+// PseudonymizeIP maps an IP address to a pseudonymous address of the same
+// family, derived from HMAC-SHA256. The result is stable for a given key.
+func PseudonymizeIP(ip net.IP, key []byte) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(ip)
+	return net.IP(mac.Sum(nil)[:len(ip)])
+}
+
+// ReadKeyFile reads a secret key from a file. A single trailing newline is
+// ignored, all other bytes belong to the key so binary keys are read as is.
+func ReadKeyFile(name string) ([]byte, error) {
+	key, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSuffix(key, []byte("\n"))
+	return bytes.TrimSuffix(key, []byte("\r")), nil
+}
+
+func newTransformer(opts Options) (transformer, error) {
+	if opts.Reverse && opts.Mode != ModeEncrypt {
+		return nil, errors.New("only mode " + ModeEncrypt + " can be reversed")
+	}
+	switch opts.Mode {
+	case "", ModeTruncate:
+		return truncateTransformer{
+			ipv4Mask:  opts.IPV4Mask,
+			ipv6Mask:  opts.IPV6Mask,
+			increment: opts.Increment,
+		}, nil
+	case ModeHMAC:
+		if len(opts.Key) < MinKeyLength {
+			return nil, fmt.Errorf("mode %s requires a key of at least %d bytes", opts.Mode, MinKeyLength)
+		}
+		return hmacTransformer{key: opts.Key}, nil
+	case ModeCryptoPAn:
+		cryptoPAn, err := NewCryptoPAn(opts.Key)
+		if err != nil {
+			return nil, err
+		}
+		return cryptoPAnTransformer{cryptoPAn: cryptoPAn}, nil
+	case ModeEncrypt:
+		fpe, err := NewFPE(opts.Key)
+		if err != nil {
+			return nil, err
+		}
+		return fpeTransformer{fpe: fpe, reverse: opts.Reverse}, nil
+	}
+	return nil, errors.New("unknown mode: " + opts.Mode)
+}
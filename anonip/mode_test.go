@@ -0,0 +1,106 @@
+package anonip
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestHMACMode(t *testing.T) {
+	var testMap = []struct {
+		Input    string
+		Expected string
+	}{
+		{
+			Input:    "192.168.100.200",
+			Expected: "100.220.67.13",
+		},
+		{
+			Input:    "192.168.100.201",
+			Expected: "55.94.72.182",
+		},
+		{
+			Input:    "[2001:db8:85a3::8a2e:370:7334]:443",
+			Expected: "[4a5a:3c1e:aebd:7270:64bd:85d:e550:38f3]:443",
+		},
+		{
+			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+			Expected: "4a5a:3c1e:aebd:7270:64bd:85d:e550:38f3",
+		},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Mode = ModeHMAC
+			opts.Key = testKey
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, tCase.Expected, maskedLine, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestPseudonymizeIP(t *testing.T) {
+	ip := net.ParseIP("3.3.3.3")
+	pseudonym := PseudonymizeIP(ip, testKey)
+	assert.Len(t, pseudonym, net.IPv4len)
+	assert.Equal(t, pseudonym, PseudonymizeIP(ip, testKey))
+	assert.NotEqual(t, pseudonym, PseudonymizeIP(ip, []byte("another key, another pseudonym")))
+	assert.NotEqual(t, pseudonym, PseudonymizeIP(net.ParseIP("3.3.3.4"), testKey))
+
+	assert.Len(t, PseudonymizeIP(net.ParseIP("2001:db8::1"), testKey), net.IPv6len)
+}
+
+func TestNewModeFail(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Mode = "unknown"
+	_, err := New(opts)
+	assert.Error(t, err)
+
+	opts.Mode = ModeHMAC
+	opts.Key = []byte("short")
+	_, err = New(opts)
+	assert.Error(t, err)
+}
+
+func TestReadKeyFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "anonipKey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	name := filepath.Join(tempDir, "key")
+	if err := ioutil.WriteFile(name, append(testKey, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ReadKeyFile(name)
+	assert.NoError(t, err)
+	assert.Equal(t, testKey, key)
+
+	for _, tc := range []struct {
+		content  string
+		expected string
+	}{
+		{"\tsecret key\r\n", "\tsecret key"},
+		{" secret key \n\n", " secret key \n"},
+		{"\x00secret\x0bkey\x20", "\x00secret\x0bkey\x20"},
+	} {
+		if err := ioutil.WriteFile(name, []byte(tc.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		key, err := ReadKeyFile(name)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(tc.expected), key, "content %q", tc.content)
+	}
+
+	_, err = ReadKeyFile(filepath.Join(tempDir, "missing"))
+	assert.Error(t, err)
+}
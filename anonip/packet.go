@@ -0,0 +1,302 @@
+package anonip
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+)
+
+// Link layer header types, see https://www.tcpdump.org/linktypes.html
+const (
+	LinkTypeNull     = 0
+	LinkTypeEthernet = 1
+	LinkTypeRaw      = 101
+	LinkTypeLoop     = 108
+	LinkTypeLinuxSLL = 113
+	LinkTypeIPv4     = 228
+	LinkTypeIPv6     = 229
+	LinkTypeSLL2     = 276
+)
+
+const (
+	etherTypeIPv4  = 0x0800
+	etherTypeARP   = 0x0806
+	etherTypeVLAN  = 0x8100
+	etherTypeQinQ  = 0x88a8
+	etherTypeIPv6  = 0x86dd
+	protocolICMP   = 1
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+)
+
+// onesSum adds data to the one's complement sum, as used by the internet
+// checksum (RFC 1071)
+func onesSum(data []byte, sum uint32) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return sum
+}
+
+// updateChecksum adjusts a checksum for the 16-bit aligned data that changed
+// from old to new (RFC 1624). Unlike a full recomputation, this works for
+// truncated packets as well.
+func updateChecksum(checksum uint16, old, new []byte) uint16 {
+	sum := uint32(^checksum)
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^(uint16(old[i])<<8 | uint16(old[i+1])))
+		sum += uint32(new[i])<<8 | uint32(new[i+1])
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(onesSum(nil, sum))
+}
+
+// updateChecksumAt adjusts the checksum stored at data[offset:], if present
+func updateChecksumAt(data []byte, offset int, old, new []byte) {
+	if len(data) < offset+2 {
+		return
+	}
+	checksum := binary.BigEndian.Uint16(data[offset:])
+	binary.BigEndian.PutUint16(data[offset:], updateChecksum(checksum, old, new))
+}
+
+// anonymizeAddress anonymizes the IPv4 or IPv6 address stored in b in place
+func (a *Anonymizer) anonymizeAddress(b []byte) {
+	ip := make(net.IP, len(b))
+	copy(ip, b)
+	maskedIP := a.AnonymizeIP(ip)
+	if maskedIP == nil {
+		return
+	}
+	if len(b) == net.IPv4len {
+		maskedIP = maskedIP.To4()
+	} else {
+		// IPv4-mapped addresses are anonymized as IPv4
+		maskedIP = maskedIP.To16()
+	}
+	copy(b, maskedIP)
+}
+
+// AnonymizeFrame anonymizes all addresses of a captured frame in place and
+// updates the checksums. Frames that are truncated or not IP or ARP are left
+// untouched.
+func (a *Anonymizer) AnonymizeFrame(data []byte, linkType uint32) error {
+	switch linkType {
+	case LinkTypeEthernet:
+		if len(data) >= 14 {
+			a.anonymizeEtherType(binary.BigEndian.Uint16(data[12:]), data[14:])
+		}
+	case LinkTypeNull, LinkTypeLoop:
+		// the address family is in host byte order for null, the version
+		// nibble is less ambiguous
+		if len(data) >= 4 {
+			a.anonymizeIP(data[4:], false)
+		}
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		a.anonymizeIP(data, false)
+	case LinkTypeLinuxSLL:
+		if len(data) >= 16 {
+			a.anonymizeEtherType(binary.BigEndian.Uint16(data[14:]), data[16:])
+		}
+	case LinkTypeSLL2:
+		if len(data) >= 20 {
+			a.anonymizeEtherType(binary.BigEndian.Uint16(data[0:]), data[20:])
+		}
+	default:
+		return errors.New("unsupported link type: " + strconv.FormatUint(uint64(linkType), 10))
+	}
+	return nil
+}
+
+func (a *Anonymizer) anonymizeEtherType(etherType uint16, data []byte) {
+	for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+		if len(data) < 4 {
+			return
+		}
+		etherType = binary.BigEndian.Uint16(data[2:])
+		data = data[4:]
+	}
+	switch etherType {
+	case etherTypeIPv4, etherTypeIPv6:
+		a.anonymizeIP(data, false)
+	case etherTypeARP:
+		a.anonymizeARP(data)
+	}
+}
+
+// anonymizeARP anonymizes the sender and target protocol addresses
+func (a *Anonymizer) anonymizeARP(data []byte) {
+	if len(data) < 8 {
+		return
+	}
+	hardwareLength := int(data[4])
+	protocolLength := int(data[5])
+	if protocolLength != net.IPv4len && protocolLength != net.IPv6len {
+		return
+	}
+	sender := 8 + hardwareLength
+	target := sender + protocolLength + hardwareLength
+	if len(data) < target+protocolLength {
+		return
+	}
+	a.anonymizeAddress(data[sender : sender+protocolLength])
+	a.anonymizeAddress(data[target : target+protocolLength])
+}
+
+// anonymizeIP anonymizes an IPv4 or IPv6 packet. inner is set for the packet
+// quoted by an ICMP error, which is not descended into again.
+func (a *Anonymizer) anonymizeIP(data []byte, inner bool) {
+	if len(data) == 0 {
+		return
+	}
+	switch data[0] >> 4 {
+	case 4:
+		a.anonymizeIPv4(data, inner)
+	case 6:
+		a.anonymizeIPv6(data, inner)
+	}
+}
+
+func (a *Anonymizer) anonymizeIPv4(data []byte, inner bool) {
+	headerLength := int(data[0]&0x0f) * 4
+	if headerLength < 20 || len(data) < headerLength {
+		return
+	}
+	addresses := data[12:20]
+	old := append([]byte{}, addresses...)
+	a.anonymizeAddress(addresses[:4])
+	a.anonymizeAddress(addresses[4:])
+
+	binary.BigEndian.PutUint16(data[10:], 0)
+	binary.BigEndian.PutUint16(data[10:], ^uint16(onesSum(data[:headerLength], 0)))
+
+	if binary.BigEndian.Uint16(data[6:])&0x1fff != 0 {
+		// not the first fragment, there is no transport header
+		return
+	}
+	payload := data[headerLength:]
+	if totalLength := int(binary.BigEndian.Uint16(data[2:])); totalLength >= headerLength && totalLength-headerLength < len(payload) {
+		// ethernet padding
+		payload = payload[:totalLength-headerLength]
+	}
+	a.anonymizeTransport(data[9], payload, old, addresses, inner)
+}
+
+func (a *Anonymizer) anonymizeIPv6(data []byte, inner bool) {
+	if len(data) < 40 {
+		return
+	}
+	addresses := data[8:40]
+	old := append([]byte{}, addresses...)
+	a.anonymizeAddress(addresses[:16])
+	a.anonymizeAddress(addresses[16:])
+
+	payload := data[40:]
+	if payloadLength := int(binary.BigEndian.Uint16(data[4:])); payloadLength > 0 && payloadLength < len(payload) {
+		payload = payload[:payloadLength]
+	}
+	next := data[6]
+	for {
+		var length int
+		switch next {
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if len(payload) < 2 {
+				return
+			}
+			length = (int(payload[1]) + 1) * 8
+		case 44: // fragment
+			if len(payload) < 8 || binary.BigEndian.Uint16(payload[2:])&0xfff8 != 0 {
+				return
+			}
+			length = 8
+		case 51: // authentication header
+			if len(payload) < 2 {
+				return
+			}
+			length = (int(payload[1]) + 2) * 4
+		default:
+			a.anonymizeTransport(next, payload, old, addresses, inner)
+			return
+		}
+		if len(payload) < length {
+			return
+		}
+		next = payload[0]
+		payload = payload[length:]
+	}
+}
+
+// anonymizeTransport updates the checksums of the transport header, whose
+// pseudo header contains the addresses that changed from old to new. ICMP
+// errors and neighbor discovery messages contain addresses themselves.
+func (a *Anonymizer) anonymizeTransport(protocol byte, payload, old, new []byte, inner bool) {
+	switch protocol {
+	case protocolTCP:
+		updateChecksumAt(payload, 16, old, new)
+	case protocolUDP:
+		if len(payload) < 8 || binary.BigEndian.Uint16(payload[6:]) == 0 {
+			// no checksum
+			return
+		}
+		updateChecksumAt(payload, 6, old, new)
+		if binary.BigEndian.Uint16(payload[6:]) == 0 {
+			binary.BigEndian.PutUint16(payload[6:], 0xffff)
+		}
+	case protocolICMP:
+		if len(old) == net.IPv4len*2 && !inner {
+			a.anonymizeICMPMessage(payload, false)
+		}
+	case protocolICMPv6:
+		if len(old) != net.IPv6len*2 {
+			return
+		}
+		updateChecksumAt(payload, 2, old, new)
+		if !inner {
+			a.anonymizeICMPMessage(payload, true)
+		}
+	}
+}
+
+func isICMPError(icmpType byte) bool {
+	switch icmpType {
+	case 3, 4, 5, 11, 12: // destination unreachable, source quench, redirect, time exceeded, parameter problem
+		return true
+	}
+	return false
+}
+
+// anonymizeICMPMessage anonymizes the packet quoted by ICMP and ICMPv6 error
+// messages, as well as the gateway of ICMP redirects and the addresses of
+// neighbor discovery messages, and updates the checksum of the message
+func (a *Anonymizer) anonymizeICMPMessage(payload []byte, ipv6 bool) {
+	if len(payload) < 8 {
+		return
+	}
+	// from the rest of the header on
+	body := payload[4 : 4+(len(payload)-4)&^1]
+	old := append([]byte{}, body...)
+	switch icmpType := payload[0]; {
+	case !ipv6 && isICMPError(icmpType), ipv6 && icmpType < 128:
+		if !ipv6 && icmpType == 5 {
+			// redirect: gateway address
+			a.anonymizeAddress(payload[4:8])
+		}
+		a.anonymizeIP(payload[8:], true)
+	case ipv6 && icmpType >= 135 && icmpType <= 137 && len(payload) >= 24:
+		// neighbor solicitation and advertisement, redirect: target address
+		a.anonymizeAddress(payload[8:24])
+		if icmpType == 137 && len(payload) >= 40 {
+			// redirect: destination address
+			a.anonymizeAddress(payload[24:40])
+		}
+	}
+	updateChecksumAt(payload, 2, old, body)
+}
@@ -0,0 +1,310 @@
+package anonip
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func concat(parts ...[]byte) []byte {
+	var data []byte
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	return data
+}
+
+func ipBytes(address string) net.IP {
+	ip := net.ParseIP(address)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func pseudoHeader(src, dst net.IP, protocol byte, length int) []byte {
+	if len(src) == net.IPv4len {
+		return concat(src, dst, []byte{0, protocol, byte(length >> 8), byte(length)})
+	}
+	return concat(src, dst, []byte{0, 0, byte(length >> 8), byte(length), 0, 0, 0, protocol})
+}
+
+func putChecksum(data []byte, offset int, parts ...[]byte) {
+	binary.BigEndian.PutUint16(data[offset:], 0)
+	binary.BigEndian.PutUint16(data[offset:], ^uint16(onesSum(concat(parts...), 0)))
+}
+
+func validChecksum(parts ...[]byte) bool {
+	return onesSum(concat(parts...), 0) == 0xffff
+}
+
+func udpSegment(src, dst string, payload []byte) []byte {
+	segment := concat([]byte{0x30, 0x39, 0x00, 0x35, 0, 0, 0, 0}, payload)
+	binary.BigEndian.PutUint16(segment[4:], uint16(len(segment)))
+	putChecksum(segment, 6, pseudoHeader(ipBytes(src), ipBytes(dst), protocolUDP, len(segment)), segment)
+	return segment
+}
+
+func tcpSegment(src, dst string, payload []byte) []byte {
+	segment := concat([]byte{0x30, 0x39, 0x00, 0x50, 0, 0, 0, 1, 0, 0, 0, 0, 0x50, 0x18, 0xff, 0xff, 0, 0, 0, 0}, payload)
+	putChecksum(segment, 16, pseudoHeader(ipBytes(src), ipBytes(dst), protocolTCP, len(segment)), segment)
+	return segment
+}
+
+func ipv4Packet(src, dst string, protocol byte, payload []byte) []byte {
+	header := []byte{0x45, 0, 0, 0, 0x12, 0x34, 0x40, 0, 64, protocol, 0, 0}
+	header = concat(header, ipBytes(src), ipBytes(dst))
+	binary.BigEndian.PutUint16(header[2:], uint16(len(header)+len(payload)))
+	putChecksum(header, 10, header)
+	return concat(header, payload)
+}
+
+func ipv6Packet(src, dst string, next byte, payload []byte) []byte {
+	header := []byte{0x60, 0, 0, 0, byte(len(payload) >> 8), byte(len(payload)), next, 64}
+	return concat(header, ipBytes(src), ipBytes(dst), payload)
+}
+
+func ethernetFrame(etherType uint16, payload []byte) []byte {
+	header := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, byte(etherType >> 8), byte(etherType)}
+	return concat(header, payload)
+}
+
+func icmpMessage(icmpType byte, body []byte) []byte {
+	message := concat([]byte{icmpType, 0, 0, 0, 0, 0, 0, 0}, body)
+	putChecksum(message, 2, message)
+	return message
+}
+
+func icmpv6Message(src, dst string, icmpType byte, body []byte) []byte {
+	message := concat([]byte{icmpType, 0, 0, 0, 0, 0, 0, 0}, body)
+	putChecksum(message, 2, pseudoHeader(ipBytes(src), ipBytes(dst), protocolICMPv6, len(message)), message)
+	return message
+}
+
+// assertIPv4 checks the addresses and all checksums of an IPv4 packet
+func assertIPv4(t *testing.T, packet []byte, src, dst string) {
+	assert.Equal(t, ipBytes(src), net.IP(packet[12:16]))
+	assert.Equal(t, ipBytes(dst), net.IP(packet[16:20]))
+	assert.True(t, validChecksum(packet[:20]), "IPv4 header checksum")
+	segment := packet[20:]
+	switch packet[9] {
+	case protocolTCP, protocolUDP:
+		assert.True(t, validChecksum(pseudoHeader(packet[12:16], packet[16:20], packet[9], len(segment)), segment), "transport checksum")
+	case protocolICMP:
+		assert.True(t, validChecksum(segment), "ICMP checksum")
+	}
+}
+
+// assertIPv6 checks the addresses and the transport checksum of an IPv6
+// packet without extension headers
+func assertIPv6(t *testing.T, packet []byte, src, dst string) {
+	assert.Equal(t, ipBytes(src), net.IP(packet[8:24]))
+	assert.Equal(t, ipBytes(dst), net.IP(packet[24:40]))
+	segment := packet[40:]
+	assert.True(t, validChecksum(pseudoHeader(packet[8:24], packet[24:40], packet[6], len(segment)), segment), "transport checksum")
+}
+
+func TestAnonymizeFrame(t *testing.T) {
+	a := newAnonymizer(t, DefaultOptions())
+
+	t.Run("ethernet ipv4 udp", func(t *testing.T) {
+		frame := ethernetFrame(etherTypeIPv4, ipv4Packet("1.2.3.4", "5.6.7.8", protocolUDP, udpSegment("1.2.3.4", "5.6.7.8", []byte("hello"))))
+		frame = append(frame, 0, 0, 0) // padding
+		assert.NoError(t, a.AnonymizeFrame(frame, LinkTypeEthernet))
+		assertIPv4(t, frame[14:len(frame)-3], "1.2.0.0", "5.6.0.0")
+	})
+
+	t.Run("vlan ipv4 tcp", func(t *testing.T) {
+		packet := ipv4Packet("1.2.3.4", "5.6.7.8", protocolTCP, tcpSegment("1.2.3.4", "5.6.7.8", []byte("hello!")))
+		frame := ethernetFrame(etherTypeQinQ, concat([]byte{0, 1, 0x81, 0x00, 0, 2, 0x08, 0x00}, packet))
+		assert.NoError(t, a.AnonymizeFrame(frame, LinkTypeEthernet))
+		assertIPv4(t, frame[22:], "1.2.0.0", "5.6.0.0")
+	})
+
+	t.Run("udp without checksum", func(t *testing.T) {
+		segment := udpSegment("1.2.3.4", "5.6.7.8", nil)
+		binary.BigEndian.PutUint16(segment[6:], 0)
+		packet := ipv4Packet("1.2.3.4", "5.6.7.8", protocolUDP, segment)
+		assert.NoError(t, a.AnonymizeFrame(packet, LinkTypeRaw))
+		assert.Equal(t, []byte{0, 0}, packet[26:28])
+		assert.Equal(t, ipBytes("1.2.0.0"), net.IP(packet[12:16]))
+	})
+
+	t.Run("icmp error", func(t *testing.T) {
+		inner := ipv4Packet("5.6.7.8", "1.2.3.4", protocolUDP, udpSegment("5.6.7.8", "1.2.3.4", []byte("hello")))
+		// only the header and 8 bytes of the transport header are quoted
+		quoted := inner[:28]
+		packet := ipv4Packet("1.2.3.4", "5.6.7.8", protocolICMP, icmpMessage(3, quoted))
+		frame := concat([]byte{2, 0, 0, 0}, packet)
+		assert.NoError(t, a.AnonymizeFrame(frame, LinkTypeNull))
+		assertIPv4(t, frame[4:], "1.2.0.0", "5.6.0.0")
+		quoted = frame[32:]
+		assert.Equal(t, ipBytes("5.6.0.0"), net.IP(quoted[12:16]))
+		assert.Equal(t, ipBytes("1.2.0.0"), net.IP(quoted[16:20]))
+		assert.True(t, validChecksum(quoted[:20]), "inner IPv4 header checksum")
+		// the inner UDP checksum covers the whole datagram, so only the
+		// difference can be verified
+		original := udpSegment("5.6.0.0", "1.2.0.0", []byte("hello"))
+		assert.Equal(t, original[6:8], quoted[26:28])
+	})
+
+	t.Run("icmp redirect", func(t *testing.T) {
+		inner := ipv4Packet("1.2.3.4", "5.6.7.8", protocolUDP, udpSegment("1.2.3.4", "5.6.7.8", nil))
+		message := concat([]byte{5, 1, 0, 0}, ipBytes("9.10.11.12"), inner[:28])
+		putChecksum(message, 2, message)
+		packet := ipv4Packet("9.10.11.13", "1.2.3.4", protocolICMP, message)
+		assert.NoError(t, a.AnonymizeFrame(packet, LinkTypeRaw))
+		assertIPv4(t, packet, "9.10.0.0", "1.2.0.0")
+		assert.Equal(t, ipBytes("9.10.0.0"), net.IP(packet[24:28]))
+		assert.Equal(t, ipBytes("1.2.0.0"), net.IP(packet[40:44]))
+	})
+
+	t.Run("icmp echo", func(t *testing.T) {
+		packet := ipv4Packet("1.2.3.4", "5.6.7.8", protocolICMP, icmpMessage(8, []byte("1.2.3.4")))
+		assert.NoError(t, a.AnonymizeFrame(packet, LinkTypeIPv4))
+		assertIPv4(t, packet, "1.2.0.0", "5.6.0.0")
+		assert.Equal(t, "1.2.3.4", string(packet[28:]))
+	})
+
+	t.Run("fragment", func(t *testing.T) {
+		packet := ipv4Packet("1.2.3.4", "5.6.7.8", protocolTCP, []byte("not a header"))
+		binary.BigEndian.PutUint16(packet[6:], 0x0010)
+		putChecksum(packet, 10, packet[:20])
+		assert.NoError(t, a.AnonymizeFrame(packet, LinkTypeRaw))
+		assert.True(t, validChecksum(packet[:20]))
+		assert.Equal(t, "not a header", string(packet[20:]))
+	})
+
+	t.Run("ipv6 mapped address", func(t *testing.T) {
+		for _, mode := range []string{ModeTruncate, ModeHMAC, ModeCryptoPAn, ModeEncrypt} {
+			opts := DefaultOptions()
+			opts.Mode = mode
+			opts.Key = testKey
+			a := newAnonymizer(t, opts)
+			src := net.ParseIP("::ffff:203.0.113.77")
+			packet := concat([]byte{0x60, 0, 0, 0, 0, 0, 59, 64}, src, ipBytes("2001:db8::1"))
+			assert.NoError(t, a.AnonymizeFrame(packet, LinkTypeIPv6))
+			assert.Equal(t, a.AnonymizeIP(src).To16(), net.IP(packet[8:24]), mode)
+			assert.NotContains(t, string(packet), string(src.To4()), mode)
+		}
+	})
+
+	t.Run("ipv6 extension header udp", func(t *testing.T) {
+		segment := udpSegment("2001:db8::1", "2001:db8:1::2", []byte("hello"))
+		packet := ipv6Packet("2001:db8::1", "2001:db8:1::2", 0, concat([]byte{protocolUDP, 0, 1, 4, 0, 0, 0, 0}, segment))
+		assert.NoError(t, a.AnonymizeFrame(packet, LinkTypeIPv6))
+		assert.Equal(t, ipBytes("2001:db8::"), net.IP(packet[8:24]))
+		assert.Equal(t, ipBytes("2001:db8::"), net.IP(packet[24:40]))
+		segment = packet[48:]
+		assert.True(t, validChecksum(pseudoHeader(packet[8:24], packet[24:40], protocolUDP, len(segment)), segment))
+	})
+
+	t.Run("ipv6 fragment", func(t *testing.T) {
+		packet := ipv6Packet("2001:db8::1", "2001:db8::2", 44, concat([]byte{protocolUDP, 0, 0, 8, 0, 0, 0, 1}, []byte("not a header")))
+		assert.NoError(t, a.AnonymizeFrame(packet, LinkTypeRaw))
+		assert.Equal(t, "not a header", string(packet[48:]))
+	})
+
+	t.Run("ipv6 first fragment udp", func(t *testing.T) {
+		segment := udpSegment("2001:db8::1", "2001:db8::2", []byte("hello"))
+		packet := ipv6Packet("2001:db8::1", "2001:db8::2", 44, concat([]byte{protocolUDP, 0, 0, 0, 0, 0, 0, 1}, segment))
+		// ethernet padding
+		packet = append(packet, 0, 0, 0, 0)
+		assert.NoError(t, a.AnonymizeFrame(packet, LinkTypeRaw))
+		segment = packet[48 : len(packet)-4]
+		assert.True(t, validChecksum(pseudoHeader(packet[8:24], packet[24:40], protocolUDP, len(segment)), segment))
+	})
+
+	t.Run("udp checksum zero", func(t *testing.T) {
+		// a computed checksum of 0 is sent as 0xffff
+		segment := []byte{0, 1, 0, 2, 0, 8, 0xff, 0xff}
+		addresses := concat(ipBytes("1.2.3.4"), ipBytes("5.6.7.8"))
+		a.anonymizeTransport(protocolUDP, segment, addresses, addresses, false)
+		assert.Equal(t, []byte{0xff, 0xff}, segment[6:])
+	})
+
+	t.Run("ipv6 authentication header tcp", func(t *testing.T) {
+		segment := tcpSegment("2001:db8::1", "2001:db8::2", nil)
+		packet := ipv6Packet("2001:db8::1", "2001:db8::2", 51, concat([]byte{protocolTCP, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, segment))
+		assert.NoError(t, a.AnonymizeFrame(packet, LinkTypeRaw))
+		segment = packet[52:]
+		assert.True(t, validChecksum(pseudoHeader(packet[8:24], packet[24:40], protocolTCP, len(segment)), segment))
+	})
+
+	t.Run("icmpv6 error", func(t *testing.T) {
+		inner := ipv6Packet("2001:db8::2", "2001:db8::1", protocolUDP, udpSegment("2001:db8::2", "2001:db8::1", []byte("hello")))
+		packet := ipv6Packet("2001:db8::1", "2001:db8::2", protocolICMPv6, icmpv6Message("2001:db8::1", "2001:db8::2", 1, inner))
+		frame := concat(make([]byte, 20), packet)
+		binary.BigEndian.PutUint16(frame, etherTypeIPv6)
+		assert.NoError(t, a.AnonymizeFrame(frame, LinkTypeSLL2))
+		assertIPv6(t, frame[20:], "2001:db8::", "2001:db8::")
+		assertIPv6(t, frame[68:], "2001:db8::", "2001:db8::")
+	})
+
+	t.Run("icmpv6 neighbor discovery", func(t *testing.T) {
+		packet := ipv6Packet("fe80::1", "ff02::1:ff00:2", protocolICMPv6, icmpv6Message("fe80::1", "ff02::1:ff00:2", 137, concat(ipBytes("2001:db8::2"), ipBytes("2001:db8::3"))))
+		assert.NoError(t, a.AnonymizeFrame(packet, LinkTypeRaw))
+		assertIPv6(t, packet, "fe80::", "ff02::")
+		assert.Equal(t, ipBytes("2001:db8::"), net.IP(packet[48:64]))
+		assert.Equal(t, ipBytes("2001:db8::"), net.IP(packet[64:80]))
+	})
+
+	t.Run("arp", func(t *testing.T) {
+		arp := concat([]byte{0, 1, 8, 0, 6, 4, 0, 1}, []byte{0, 1, 2, 3, 4, 5}, ipBytes("1.2.3.4"), make([]byte, 6), ipBytes("5.6.7.8"))
+		frame := concat(make([]byte, 14), []byte{0x08, 0x06}, arp)
+		assert.NoError(t, a.AnonymizeFrame(frame, LinkTypeLinuxSLL))
+		assert.Equal(t, ipBytes("1.2.0.0"), net.IP(frame[30:34]))
+		assert.Equal(t, ipBytes("5.6.0.0"), net.IP(frame[40:44]))
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		packet := ipv4Packet("1.2.3.4", "5.6.7.8", protocolTCP, tcpSegment("1.2.3.4", "5.6.7.8", nil))
+		for length := 0; length < len(packet); length++ {
+			data := append([]byte{}, packet[:length]...)
+			assert.NoError(t, a.AnonymizeFrame(data, LinkTypeRaw))
+		}
+		for _, linkType := range []uint32{LinkTypeEthernet, LinkTypeNull, LinkTypeLinuxSLL, LinkTypeSLL2} {
+			assert.NoError(t, a.AnonymizeFrame([]byte{0x81, 0, 0}, linkType))
+		}
+		assert.NoError(t, a.AnonymizeFrame(ethernetFrame(etherTypeVLAN, []byte{0}), LinkTypeEthernet))
+		assert.NoError(t, a.AnonymizeFrame(ethernetFrame(etherTypeARP, []byte{0, 1, 8, 0, 6, 4, 0, 1, 0}), LinkTypeEthernet))
+		assert.NoError(t, a.AnonymizeFrame(ethernetFrame(etherTypeARP, []byte{0, 1, 8, 0, 6, 2, 0, 1, 0}), LinkTypeEthernet))
+		assert.NoError(t, a.AnonymizeFrame(ethernetFrame(etherTypeARP, []byte{0}), LinkTypeEthernet))
+		for _, next := range []byte{0, 44, 51} {
+			assert.NoError(t, a.AnonymizeFrame(ipv6Packet("::1", "::1", next, []byte{0}), LinkTypeRaw))
+			assert.NoError(t, a.AnonymizeFrame(ipv6Packet("::1", "::1", next, []byte{0, 2}), LinkTypeRaw))
+		}
+		assert.NoError(t, a.AnonymizeFrame(ipv4Packet("1.2.3.4", "5.6.7.8", protocolICMP, []byte{3}), LinkTypeRaw))
+		assert.NoError(t, a.AnonymizeFrame([]byte{0x60, 0, 0, 0}, LinkTypeRaw))
+	})
+
+	t.Run("icmpv6 over ipv4", func(t *testing.T) {
+		packet := ipv4Packet("1.2.3.4", "5.6.7.8", protocolICMPv6, []byte{1, 0, 0, 0})
+		assert.NoError(t, a.AnonymizeFrame(packet, LinkTypeRaw))
+		assertIPv4(t, packet, "1.2.0.0", "5.6.0.0")
+		assert.Equal(t, []byte{1, 0, 0, 0}, packet[20:])
+	})
+
+	t.Run("skipped", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.SkipPrivate = true
+		packet := ipv4Packet("10.1.2.3", "5.6.7.8", protocolUDP, udpSegment("10.1.2.3", "5.6.7.8", nil))
+		assert.NoError(t, newAnonymizer(t, opts).AnonymizeFrame(packet, LinkTypeRaw))
+		assertIPv4(t, packet, "10.1.2.3", "5.6.0.0")
+	})
+
+	t.Run("unsupported link type", func(t *testing.T) {
+		assert.Error(t, a.AnonymizeFrame(nil, 127))
+	})
+}
+
+func TestUpdateChecksum(t *testing.T) {
+	old := []byte{0x12, 0x34, 0xff, 0xff}
+	new := []byte{0x00, 0x00, 0x00, 0x01}
+	data := concat(old, []byte{0xab, 0xcd})
+	checksum := ^uint16(onesSum(data, 0))
+	copy(data, new)
+	assert.Equal(t, ^uint16(onesSum(data, 0)), updateChecksum(checksum, old, new))
+}
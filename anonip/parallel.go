@@ -0,0 +1,139 @@
+package anonip
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// maximum number of lines handed to a worker at once
+const batchSize = 256
+
+// number of batches per worker that may be in flight before the reader blocks
+const reorderFactor = 4
+
+type batch struct {
+	lines []string
+	// no more input was buffered when the batch was dispatched
+	drained bool
+	done    chan struct{}
+}
+
+// flusher is implemented by buffered writers, like bufio.Writer
+type flusher interface {
+	Flush() error
+}
+
+func newBatch() *batch {
+	return &batch{
+		lines: make([]string, 0, batchSize),
+		done:  make(chan struct{}),
+	}
+}
+
+func (b *batch) process(a *Anonymizer) {
+	for i, line := range b.lines {
+		b.lines[i] = a.HandleLine(line)
+	}
+	close(b.done)
+}
+
+// readLine reads a single line and strips the line ending the same way
+// bufio.ScanLines does
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	return line, err
+}
+
+// runParallel anonymizes lines with a pool of workers. Lines are handed out in
+// batches, which are written back in the order they have been read. A batch is
+// dispatched as soon as it is full or no more input is buffered, so lines from
+// slow inputs are not held back. For the same reason, w is flushed once all
+// lines read before the input ran dry have been written. If writing fails, it
+// returns without waiting for a pending read; the reading goroutine and the
+// workers end as soon as that read returns.
+func (a *Anonymizer) runParallel(r io.Reader, w io.Writer) error {
+	jobs := make(chan *batch)
+	ordered := make(chan *batch, a.opts.Workers*reorderFactor)
+	quit := make(chan struct{})
+	readErr := make(chan error, 1)
+
+	for i := 0; i < a.opts.Workers; i++ {
+		go func() {
+			for b := range jobs {
+				b.process(a)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		defer close(ordered)
+
+		reader := bufio.NewReader(r)
+		b := newBatch()
+		dispatch := func() bool {
+			select {
+			case ordered <- b:
+			case <-quit:
+				return false
+			}
+			jobs <- b
+			b = newBatch()
+			return true
+		}
+		for {
+			line, err := readLine(reader)
+			select {
+			case <-quit:
+				// writing failed
+				return
+			default:
+			}
+			if err != nil {
+				if len(b.lines) > 0 {
+					dispatch()
+				}
+				if err != io.EOF {
+					readErr <- err
+				}
+				return
+			}
+			b.lines = append(b.lines, line)
+			if len(b.lines) == batchSize || reader.Buffered() == 0 {
+				b.drained = reader.Buffered() == 0
+				if !dispatch() {
+					return
+				}
+			}
+		}
+	}()
+
+	output, buffered := w.(flusher)
+	for b := range ordered {
+		<-b.done
+		for _, line := range b.lines {
+			if _, err := io.WriteString(w, line+"\n"); err != nil {
+				close(quit)
+				return err
+			}
+		}
+		if buffered && b.drained && len(ordered) == 0 {
+			// the input may be idle, so the lines read are not held back. An
+			// error is returned by the next write.
+			_ = output.Flush()
+		}
+	}
+
+	select {
+	case err := <-readErr:
+		return err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,149 @@
+package anonip
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func generateLog(lines int) string {
+	var b strings.Builder
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&b, "%d.%d.%d.%d - - [20/May/2015:21:05:01 +0000] \"GET /%d HTTP/1.1\" 200 13358\n", i%223+1, i%251, i%241, i%239, i)
+	}
+	return b.String()
+}
+
+func TestRunParallel(t *testing.T) {
+	input := generateLog(batchSize*10 + 3)
+
+	serialOpts := DefaultOptions()
+	var expected bytes.Buffer
+	assert.NoError(t, newAnonymizer(t, serialOpts).Run(strings.NewReader(input), &expected))
+
+	for _, workers := range []int{2, 3, 8} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Workers = workers
+			var out bytes.Buffer
+			// one byte at a time makes batches of varying size
+			err := newAnonymizer(t, opts).Run(iotest.HalfReader(strings.NewReader(input)), &out)
+			assert.NoError(t, err)
+			assert.Equal(t, expected.String(), out.String())
+		})
+	}
+}
+
+func TestRunParallelLineEndings(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Workers = 2
+	var out bytes.Buffer
+	err := newAnonymizer(t, opts).Run(strings.NewReader("3.3.3.3 a\r\n\n4.4.4.4 b"), &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "3.3.0.0 a\n\n4.4.0.0 b\n", out.String())
+}
+
+func TestRunParallelFail(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Workers = 2
+	a := newAnonymizer(t, opts)
+
+	err := a.Run(iotest.TimeoutReader(bytes.NewReader([]byte("foo\nbar"))), &bytes.Buffer{})
+	assert.Equal(t, iotest.ErrTimeout, err)
+
+	// fails while the reader waits for batches to be written
+	err = a.Run(strings.NewReader(generateLog(batchSize*reorderFactor*opts.Workers*2)), slowFailingWriter{})
+	assert.Error(t, err)
+}
+
+// slowFailingWriter fails after a while
+type slowFailingWriter struct{}
+
+func (slowFailingWriter) Write(p []byte) (int, error) {
+	time.Sleep(50 * time.Millisecond)
+	return failingWriter{}.Write(p)
+}
+
+func TestRunParallelFlush(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Workers = 8
+	r, w := io.Pipe()
+	output := &syncBuffer{}
+	done := make(chan error)
+	go func() {
+		done <- newAnonymizer(t, opts).Run(r, NewBufferedWriter(output, FlushOptions{}))
+	}()
+
+	// more than a batch, written before the input becomes idle
+	input := generateLog(batchSize + 44)
+	_, err := io.WriteString(w, input)
+	assert.NoError(t, err)
+	var expected bytes.Buffer
+	assert.NoError(t, newAnonymizer(t, DefaultOptions()).Run(strings.NewReader(input), &expected))
+	assert.Eventually(t, func() bool {
+		return output.String() == expected.String()
+	}, 5*time.Second, time.Millisecond)
+
+	assert.NoError(t, w.Close())
+	assert.NoError(t, <-done)
+}
+
+// chanReader returns the chunks sent to it, one per read
+type chanReader chan string
+
+func (c chanReader) Read(p []byte) (int, error) {
+	return copy(p, <-c), nil
+}
+
+func TestRunParallelAbandonRead(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Workers = 2
+	input := make(chanReader)
+	go func() { input <- "1.2.3.4\n" }()
+	assert.EqualError(t, newAnonymizer(t, opts).Run(input, failingWriter{}), "write failed")
+
+	// the read pending when writing failed is the last one
+	input <- "5.6.7.8\n"
+	select {
+	case input <- "9.10.11.12\n":
+		t.Fatal("read after writing failed")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNewNegativeWorkers(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Workers = -1
+	_, err := New(opts)
+	assert.Error(t, err)
+}
+
+func benchmarkRun(b *testing.B, workers int) {
+	input := generateLog(100000)
+	opts := DefaultOptions()
+	opts.Workers = workers
+	a, err := New(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := a.Run(strings.NewReader(input), ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRun1(b *testing.B)  { benchmarkRun(b, 1) }
+func BenchmarkRun2(b *testing.B)  { benchmarkRun(b, 2) }
+func BenchmarkRun4(b *testing.B)  { benchmarkRun(b, 4) }
+func BenchmarkRun8(b *testing.B)  { benchmarkRun(b, 8) }
+func BenchmarkRun16(b *testing.B) { benchmarkRun(b, 16) }
@@ -0,0 +1,233 @@
+package anonip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+const (
+	// maxCaptureSize limits the memory used for a single packet or block
+	maxCaptureSize = 1 << 28
+
+	pcapngSectionHeader        = 0x0a0d0d0a
+	pcapngInterfaceDescription = 1
+	pcapngObsoletePacket       = 2
+	pcapngSimplePacket         = 3
+	pcapngNameResolution       = 4
+	pcapngEnhancedPacket       = 6
+	pcapngByteOrderMagic       = 0x1a2b3c4d
+)
+
+var errInvalidPcap = errors.New("invalid capture file: neither pcap nor pcapng")
+
+// RunPcap anonymizes a capture file in pcap or pcapng format, read from r and
+// written to w. All addresses of IPv4, IPv6 and ARP packets are anonymized,
+// including the ones quoted by ICMP errors and the ones of pcapng name
+// resolution blocks. Everything else is copied unchanged.
+func (a *Anonymizer) RunPcap(r io.Reader, w io.Writer) error {
+	reader := bufio.NewReader(r)
+	writer := bufio.NewWriter(w)
+	magic, err := reader.Peek(4)
+	if err != nil {
+		return errInvalidPcap
+	}
+	if binary.BigEndian.Uint32(magic) == pcapngSectionHeader {
+		err = a.runPcapng(reader, writer)
+	} else {
+		err = a.runPcap(reader, writer)
+	}
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// readBlock reads length bytes into buf, growing it if needed
+func readBlock(r io.Reader, buf []byte, length uint32) ([]byte, error) {
+	if length > maxCaptureSize {
+		return nil, errors.New("invalid capture file: block too large")
+	}
+	if int(length) > cap(buf) {
+		buf = make([]byte, length)
+	}
+	buf = buf[:length]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (a *Anonymizer) runPcap(r io.Reader, w *bufio.Writer) error {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return errInvalidPcap
+	}
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(header) {
+	case 0xa1b2c3d4, 0xa1b23c4d: // microsecond and nanosecond resolution
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return errInvalidPcap
+	}
+	// the upper bits may contain the FCS length
+	linkType := order.Uint32(header[20:]) & 0x0fffffff
+	// the header fits into the buffer, errors are returned by the next write
+	_, _ = w.Write(header)
+
+	record := make([]byte, 16)
+	var data []byte
+	for {
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var err error
+		data, err = readBlock(r, data, order.Uint32(record[8:]))
+		if err != nil {
+			return err
+		}
+		if err := a.AnonymizeFrame(data, linkType); err != nil {
+			return err
+		}
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *Anonymizer) runPcapng(r io.Reader, w *bufio.Writer) error {
+	var order binary.ByteOrder
+	var linkTypes []uint32
+	head := make([]byte, 8)
+	var block []byte
+	for {
+		if _, err := io.ReadFull(r, head); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		blockType := binary.BigEndian.Uint32(head)
+		if blockType == pcapngSectionHeader {
+			// the byte order may change with every section
+			bom := make([]byte, 4)
+			if _, err := io.ReadFull(r, bom); err != nil {
+				return err
+			}
+			switch uint32(pcapngByteOrderMagic) {
+			case binary.LittleEndian.Uint32(bom):
+				order = binary.LittleEndian
+			case binary.BigEndian.Uint32(bom):
+				order = binary.BigEndian
+			default:
+				return errInvalidPcap
+			}
+			linkTypes = nil
+			head = append(head, bom...)
+		} else {
+			// RunPcap made sure the file starts with a section header
+			blockType = order.Uint32(head)
+		}
+
+		length := order.Uint32(head[4:])
+		if length < 12+uint32(len(head)-8) || length%4 != 0 {
+			return errors.New("invalid capture file: invalid block length")
+		}
+		var err error
+		block, err = readBlock(r, block, length-uint32(len(head)))
+		if err != nil {
+			return err
+		}
+		// without the trailing block length
+		body := block[:len(block)-4]
+
+		switch blockType {
+		case pcapngInterfaceDescription:
+			if len(body) < 2 {
+				return errors.New("invalid capture file: invalid interface description")
+			}
+			linkTypes = append(linkTypes, uint32(order.Uint16(body)))
+		case pcapngEnhancedPacket, pcapngObsoletePacket:
+			if len(body) < 20 {
+				return errors.New("invalid capture file: invalid packet block")
+			}
+			iface := order.Uint32(body)
+			if blockType == pcapngObsoletePacket {
+				iface = uint32(order.Uint16(body))
+			}
+			data := body[20:]
+			if capLen := order.Uint32(body[12:]); capLen < uint32(len(data)) {
+				data = data[:capLen]
+			}
+			if err := a.anonymizePcapngPacket(data, iface, linkTypes); err != nil {
+				return err
+			}
+		case pcapngSimplePacket:
+			if len(body) < 4 {
+				return errors.New("invalid capture file: invalid packet block")
+			}
+			data := body[4:]
+			if origLen := order.Uint32(body); origLen < uint32(len(data)) {
+				data = data[:origLen]
+			}
+			if err := a.anonymizePcapngPacket(data, 0, linkTypes); err != nil {
+				return err
+			}
+		case pcapngNameResolution:
+			a.anonymizeNameResolution(body, order)
+		}
+
+		if _, err := w.Write(head); err != nil {
+			return err
+		}
+		if _, err := w.Write(block); err != nil {
+			return err
+		}
+		head = head[:8]
+	}
+}
+
+func (a *Anonymizer) anonymizePcapngPacket(data []byte, iface uint32, linkTypes []uint32) error {
+	if iface >= uint32(len(linkTypes)) {
+		return errors.New("invalid capture file: packet of unknown interface")
+	}
+	return a.AnonymizeFrame(data, linkTypes[iface])
+}
+
+// anonymizeNameResolution anonymizes the addresses of the records of a name
+// resolution block
+func (a *Anonymizer) anonymizeNameResolution(body []byte, order binary.ByteOrder) {
+	for len(body) >= 4 {
+		recordType := order.Uint16(body)
+		length := int(order.Uint16(body[2:]))
+		value := body[4:]
+		if length > len(value) {
+			return
+		}
+		value = value[:length]
+		switch {
+		case recordType == 0:
+			return
+		case recordType == 1 && length >= net.IPv4len:
+			a.anonymizeAddress(value[:net.IPv4len])
+		case recordType == 2 && length >= net.IPv6len:
+			a.anonymizeAddress(value[:net.IPv6len])
+		}
+		// values are padded to 32 bits
+		padded := 4 + (length+3)&^3
+		if padded > len(body) {
+			return
+		}
+		body = body[padded:]
+	}
+}
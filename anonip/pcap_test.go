@@ -0,0 +1,174 @@
+package anonip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func pcapFile(order binary.ByteOrder, linkType uint32, frames ...[]byte) []byte {
+	header := make([]byte, 24)
+	order.PutUint32(header, 0xa1b2c3d4)
+	order.PutUint16(header[4:], 2)
+	order.PutUint16(header[6:], 4)
+	order.PutUint32(header[16:], 65535)
+	order.PutUint32(header[20:], linkType)
+	data := header
+	for _, frame := range frames {
+		record := make([]byte, 16)
+		order.PutUint32(record, 1600000000)
+		order.PutUint32(record[8:], uint32(len(frame)))
+		order.PutUint32(record[12:], uint32(len(frame)))
+		data = concat(data, record, frame)
+	}
+	return data
+}
+
+func pcapngBlock(order binary.ByteOrder, blockType uint32, body []byte) []byte {
+	padded := concat(body, make([]byte, (4-len(body)%4)%4))
+	block := make([]byte, 8)
+	order.PutUint32(block, blockType)
+	order.PutUint32(block[4:], uint32(len(padded)+12))
+	return concat(block, padded, block[4:8])
+}
+
+func pcapngFile(order binary.ByteOrder, linkType uint16, frame []byte) []byte {
+	shb := make([]byte, 16)
+	order.PutUint32(shb, pcapngByteOrderMagic)
+	order.PutUint16(shb[4:], 1)
+	order.PutUint64(shb[8:], 0xffffffffffffffff)
+	idb := make([]byte, 8)
+	order.PutUint16(idb, linkType)
+	order.PutUint32(idb[4:], 65535)
+	epb := make([]byte, 20)
+	order.PutUint32(epb[12:], uint32(len(frame)))
+	order.PutUint32(epb[16:], uint32(len(frame)))
+	spb := make([]byte, 4)
+	order.PutUint32(spb, uint32(len(frame)))
+	nrb := make([]byte, 4)
+	order.PutUint16(nrb, 1)
+	order.PutUint16(nrb[2:], 9)
+	nrb = concat(nrb, ipBytes("1.2.3.4"), []byte("host\x00"), []byte{0, 0, 0})
+	nrbIPv6 := make([]byte, 4)
+	order.PutUint16(nrbIPv6, 2)
+	order.PutUint16(nrbIPv6[2:], 18)
+	nrb = concat(nrb, nrbIPv6, ipBytes("2001:db8::1"), []byte("h\x00"), []byte{0, 0}, []byte{0, 0, 0, 0})
+
+	return concat(
+		pcapngBlock(order, pcapngSectionHeader, shb),
+		pcapngBlock(order, pcapngInterfaceDescription, idb),
+		pcapngBlock(order, pcapngEnhancedPacket, concat(epb, frame)),
+		pcapngBlock(order, pcapngSimplePacket, concat(spb, frame)),
+		pcapngBlock(order, pcapngNameResolution, nrb),
+		pcapngBlock(order, 5, []byte{1, 2, 3, 4}),
+	)
+}
+
+func TestRunPcap(t *testing.T) {
+	packet := ipv4Packet("1.2.3.4", "5.6.7.8", protocolUDP, udpSegment("1.2.3.4", "5.6.7.8", []byte("hello")))
+	masked := ipv4Packet("1.2.0.0", "5.6.0.0", protocolUDP, udpSegment("1.2.0.0", "5.6.0.0", []byte("hello")))
+	a := newAnonymizer(t, DefaultOptions())
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run("pcap "+order.String(), func(t *testing.T) {
+			var output bytes.Buffer
+			assert.NoError(t, a.RunPcap(bytes.NewReader(pcapFile(order, LinkTypeRaw, packet, packet)), &output))
+			assert.Equal(t, pcapFile(order, LinkTypeRaw, masked, masked), output.Bytes())
+		})
+
+		t.Run("pcapng "+order.String(), func(t *testing.T) {
+			var output bytes.Buffer
+			input := pcapngFile(order, LinkTypeRaw, packet)
+			expected := pcapngFile(order, LinkTypeRaw, masked)
+			copy(expected[len(expected)-60:], ipBytes("1.2.0.0"))
+			copy(expected[len(expected)-44:], ipBytes("2001:db8::"))
+			// a second section
+			input = concat(input, input)
+			expected = concat(expected, expected)
+			assert.NoError(t, a.RunPcap(bytes.NewReader(input), &output))
+			assert.Equal(t, expected, output.Bytes())
+		})
+	}
+}
+
+func TestRunPcapObsoletePacket(t *testing.T) {
+	packet := ipv4Packet("1.2.3.4", "5.6.7.8", protocolUDP, udpSegment("1.2.3.4", "5.6.7.8", nil))
+	input := pcapngFile(binary.LittleEndian, LinkTypeRaw, nil)[:48]
+	opb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(opb[12:], uint32(len(packet)))
+	input = concat(input, pcapngBlock(binary.LittleEndian, pcapngObsoletePacket, concat(opb, packet)))
+
+	var output bytes.Buffer
+	assert.NoError(t, newAnonymizer(t, DefaultOptions()).RunPcap(bytes.NewReader(input), &output))
+	assert.Equal(t, ipBytes("1.2.0.0"), net.IP(output.Bytes()[88:92]))
+}
+
+func TestRunPcapFail(t *testing.T) {
+	packet := ipv4Packet("1.2.3.4", "5.6.7.8", protocolUDP, udpSegment("1.2.3.4", "5.6.7.8", nil))
+	valid := pcapFile(binary.LittleEndian, LinkTypeRaw, packet)
+	validng := pcapngFile(binary.LittleEndian, LinkTypeRaw, packet)
+
+	tooLarge := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint32(tooLarge[32:], maxCaptureSize+1)
+	badBOM := append([]byte{}, validng...)
+	badBOM[8] = 0
+	badLength := append([]byte{}, validng...)
+	badLength[4] = 13
+	unknownInterface := append([]byte{}, validng...)
+	unknownInterface[48+8] = 1
+
+	for name, input := range map[string][]byte{
+		"empty":             {},
+		"short header":      valid[:10],
+		"unknown magic":     []byte("not a capture file at all"),
+		"truncated record":  valid[:30],
+		"truncated packet":  valid[:len(valid)-1],
+		"too large":         tooLarge,
+		"unsupported":       pcapFile(binary.LittleEndian, 127, packet),
+		"ng truncated bom":  validng[:10],
+		"ng bad bom":        badBOM,
+		"ng bad length":     badLength,
+		"ng truncated":      validng[:20],
+		"ng truncated head": validng[:30],
+		"ng no section":     validng[28:],
+		"ng interface":      concat(validng[:28], pcapngBlock(binary.LittleEndian, pcapngInterfaceDescription, nil)),
+		"ng epb":            concat(validng[:48], pcapngBlock(binary.LittleEndian, pcapngEnhancedPacket, make([]byte, 8))),
+		"ng spb":            concat(validng[:48], pcapngBlock(binary.LittleEndian, pcapngSimplePacket, nil)),
+		"ng unknown iface":  unknownInterface,
+		"ng spb no iface":   concat(validng[:28], pcapngBlock(binary.LittleEndian, pcapngSimplePacket, packet)),
+		"ng unsupported":    pcapngFile(binary.LittleEndian, 127, packet),
+	} {
+		t.Run(name, func(t *testing.T) {
+			var output bytes.Buffer
+			assert.Error(t, newAnonymizer(t, DefaultOptions()).RunPcap(bytes.NewReader(input), &output))
+		})
+	}
+
+	for _, input := range [][]byte{
+		valid,
+		validng,
+		// the packet is written after its record
+		pcapFile(binary.LittleEndian, LinkTypeRaw, make([]byte, 5000)),
+		// the header of the second block is written to a full buffer
+		concat(validng[:48], pcapngBlock(binary.LittleEndian, 5, make([]byte, 4032)), pcapngBlock(binary.LittleEndian, 5, nil)),
+		concat(validng[:48], pcapngBlock(binary.LittleEndian, 5, make([]byte, 5000))),
+	} {
+		assert.Error(t, newAnonymizer(t, DefaultOptions()).RunPcap(bytes.NewReader(concat(input, make([]byte, 5000))), failingWriter{}))
+	}
+}
+
+func TestAnonymizeNameResolution(t *testing.T) {
+	a := newAnonymizer(t, DefaultOptions())
+	for _, body := range [][]byte{
+		{1, 0, 10, 0, 1, 2, 3, 4},
+		{1, 0, 2, 0, 1, 2},
+		{0, 0, 0, 0, 1, 0, 4, 0, 1, 2, 3, 4},
+	} {
+		original := append([]byte{}, body...)
+		a.anonymizeNameResolution(body, binary.LittleEndian)
+		assert.Equal(t, original, body)
+	}
+}
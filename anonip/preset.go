@@ -0,0 +1,59 @@
+package anonip
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+)
+
+// Preset describes where the addresses are located in a well-known log format
+type Preset struct {
+	Format  string
+	Columns []uint
+	Regexes []*regexp.Regexp
+}
+
+// Presets are the built-in log format presets, selected with Options.Preset
+var Presets = map[string]Preset{
+	// $remote_addr - $remote_user [$time_local] "$request" ...
+	"nginx-combined": {Format: FormatText, Columns: []uint{0}},
+	// %h %l %u %t "%r" %>s %b
+	"apache-common": {Format: FormatText, Columns: []uint{0}},
+	// [syslog header: ]client_ip:port [accept_date] frontend ...
+	// IPv6 addresses are logged without brackets, the port follows the last colon
+	"haproxy-http": {Format: FormatText, Regexes: []*regexp.Regexp{
+		regexp.MustCompile(`(?:^|\]: )(?P<client>\S+):\d+ \[\d{2}/\w{3}/\d{4}:`),
+	}},
+	// W3C extended log format, the fields are taken from the #Fields directive
+	"iis-w3c": {Format: FormatW3C},
+	// [%START_TIME%] "%REQ(:METHOD)% ..." ... "%REQ(X-FORWARDED-FOR)%" ...
+	// "%UPSTREAM_HOST%", which may start with a scheme like tcp://
+	"envoy": {Format: FormatText, Regexes: []*regexp.Regexp{
+		regexp.MustCompile(`^\[[^\]]*\] "[^"]*" \S+ \S+ \S+ \S+ \S+ \S+ "(?P<forwarded>[^"]*)" .* "(?:\w+://)?(?P<upstream>[^"]*)"$`),
+	}},
+}
+
+// PresetNames returns the sorted names of all Presets
+func PresetNames() []string {
+	var names []string
+	for name := range Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyPreset overrides the format and the address locations of opts with the
+// ones of the named preset
+func applyPreset(opts *Options) error {
+	preset, ok := Presets[opts.Preset]
+	if !ok {
+		return errors.New("unknown preset: " + opts.Preset)
+	}
+	opts.Format = preset.Format
+	opts.Columns = preset.Columns
+	opts.Regexes = preset.Regexes
+	opts.Delimiter = DefaultDelimiter
+	opts.Scan = false
+	return nil
+}
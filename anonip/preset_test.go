@@ -0,0 +1,78 @@
+package anonip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresets(t *testing.T) {
+	var testMap = []struct {
+		Preset   string
+		Input    string
+		Expected string
+	}{
+		{
+			Preset:   "nginx-combined",
+			Input:    `1.2.3.4 - - [10/Oct/2000:13:55:36 -0700] "GET /?ip=1.2.3.4 HTTP/1.1" 200 2326 "-" "curl/7.0"`,
+			Expected: `1.2.0.0 - - [10/Oct/2000:13:55:36 -0700] "GET /?ip=1.2.3.4 HTTP/1.1" 200 2326 "-" "curl/7.0"`,
+		},
+		{
+			Preset:   "apache-common",
+			Input:    `2001:db8:85a3::8a2e:370:7334 - frank [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.0" 200 2326`,
+			Expected: `2001:db8:85a0:: - frank [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.0" 200 2326`,
+		},
+		{
+			Preset:   "haproxy-http",
+			Input:    `Feb  6 12:14:14 localhost haproxy[14389]: 10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 {1.2.3.4} {} "GET / HTTP/1.1"`,
+			Expected: `Feb  6 12:14:14 localhost haproxy[14389]: 10.0.0.0:33317 [06/Feb/2009:12:14:14.655] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 {1.2.3.4} {} "GET / HTTP/1.1"`,
+		},
+		{
+			Preset:   "haproxy-http",
+			Input:    `2001:db8::1:33317 [06/Feb/2009:12:14:14.655] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 "GET / HTTP/1.1"`,
+			Expected: `2001:db8:::33317 [06/Feb/2009:12:14:14.655] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 "GET / HTTP/1.1"`,
+		},
+		{
+			Preset:   "envoy",
+			Input:    `[2016-04-15T20:17:00.310Z] "POST /api/v1/locations HTTP/2" 204 - 154 0 226 100 "1.2.3.4, 5.6.7.8" "nsq2http" "cc21d9b0-cf5c-432b-8c7e-98aeb7988cd2" "locations" "10.0.35.28:8080"`,
+			Expected: `[2016-04-15T20:17:00.310Z] "POST /api/v1/locations HTTP/2" 204 - 154 0 226 100 "1.2.0.0, 5.6.0.0" "nsq2http" "cc21d9b0-cf5c-432b-8c7e-98aeb7988cd2" "locations" "10.0.32.0:8080"`,
+		},
+		{
+			// the example of the envoy documentation
+			Preset:   "envoy",
+			Input:    `[2016-04-15T20:17:00.310Z] "POST /api/v1/locations HTTP/2" 204 - 154 0 226 100 "10.0.35.28" "nsq2http" "cc21d9b0-cf5c-432b-8c7e-98aeb7988cd2" "locations" "tcp://10.0.2.1:80"`,
+			Expected: `[2016-04-15T20:17:00.310Z] "POST /api/v1/locations HTTP/2" 204 - 154 0 226 100 "10.0.32.0" "nsq2http" "cc21d9b0-cf5c-432b-8c7e-98aeb7988cd2" "locations" "tcp://10.0.0.0:80"`,
+		},
+		{
+			Preset:   "envoy",
+			Input:    `[2016-04-15T20:17:00.310Z] "GET / HTTP/1.1" 503 UF 0 91 0 - "-" "curl/7.0" "cc21d9b0" "example.com" "-"`,
+			Expected: `[2016-04-15T20:17:00.310Z] "GET / HTTP/1.1" 503 UF 0 91 0 - "-" "curl/7.0" "cc21d9b0" "example.com" "-"`,
+		},
+		{
+			Preset:   "iis-w3c",
+			Input:    `2020-01-01 00:00:00 10.1.2.3 GET / - 443 - 1.2.3.4 Mozilla/5.0 - 200 0 0 15`,
+			Expected: `2020-01-01 00:00:00 10.1.0.0 GET / - 443 - 1.2.0.0 Mozilla/5.0 - 200 0 0 15`,
+		},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Preset+" "+tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Preset = tCase.Preset
+			opts.Scan = true
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, tCase.Expected, maskedLine, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestPresetUnknown(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Preset = "lighttpd"
+	_, err := New(opts)
+	assert.Error(t, err)
+}
+
+func TestPresetNames(t *testing.T) {
+	assert.Equal(t, []string{"apache-common", "envoy", "haproxy-http", "iis-w3c", "nginx-combined"}, PresetNames())
+}
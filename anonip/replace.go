@@ -0,0 +1,39 @@
+package anonip
+
+import (
+	"sort"
+	"strings"
+)
+
+// replacement replaces line[start:end] with value
+type replacement struct {
+	start int
+	end   int
+	value string
+}
+
+// applyReplacements replaces the bytes at the exact positions where the
+// addresses have been found, so other occurrences of the same substring stay
+// untouched. Replacements overlapping a previous one are ignored.
+func applyReplacements(line string, replacements []replacement) string {
+	if len(replacements) == 0 {
+		return line
+	}
+	sort.SliceStable(replacements, func(i, j int) bool {
+		return replacements[i].start < replacements[j].start
+	})
+
+	var b strings.Builder
+	b.Grow(len(line))
+	last := 0
+	for _, r := range replacements {
+		if r.start < last {
+			continue
+		}
+		b.WriteString(line[last:r.start])
+		b.WriteString(r.value)
+		last = r.end
+	}
+	b.WriteString(line[last:])
+	return b.String()
+}
@@ -0,0 +1,95 @@
+package anonip
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPositionAwareReplacement(t *testing.T) {
+	replaceString := "-"
+
+	var testMap = []struct {
+		Name     string
+		Input    string
+		Expected string
+		Opts     func(opts *Options)
+	}{
+		{
+			Name:     "address inside a longer address",
+			Input:    "1.2.3.4 11.2.3.45",
+			Expected: "1.2.0.0 11.2.3.45",
+			Opts:     func(opts *Options) {},
+		},
+		{
+			Name:     "address in URL and user agent",
+			Input:    "1.2.3.4 \"GET /1.2.3.4/index.html\" \"agent 1.2.3.4\"",
+			Expected: "1.2.0.0 \"GET /1.2.3.4/index.html\" \"agent 1.2.3.4\"",
+			Opts:     func(opts *Options) {},
+		},
+		{
+			Name:     "second column repeats the first",
+			Input:    "foo 1.2.3.4 1.2.3.4",
+			Expected: "foo 1.2.3.4 1.2.0.0",
+			Opts:     func(opts *Options) { opts.Columns = []uint{2} },
+		},
+		{
+			Name:     "same address in two columns",
+			Input:    "1.2.3.4 1.2.3.4 1.2.3.4",
+			Expected: "1.2.0.0 1.2.3.4 1.2.0.0",
+			Opts:     func(opts *Options) { opts.Columns = []uint{0, 2} },
+		},
+		{
+			Name:     "bracketed with port",
+			Input:    "[2001:db8::1]:443 2001:db8::1",
+			Expected: "[2001:db8::]:443 2001:db8::1",
+			Opts:     func(opts *Options) {},
+		},
+		{
+			Name:     "multi byte delimiter",
+			Input:    "foo||1.2.3.4||1.2.3.4x",
+			Expected: "foo||1.2.0.0||1.2.3.4x",
+			Opts:     func(opts *Options) { opts.Delimiter = "||"; opts.Columns = []uint{1} },
+		},
+		{
+			Name:     "replace only the failing column",
+			Input:    "x y x",
+			Expected: "x y -",
+			Opts:     func(opts *Options) { opts.Columns = []uint{2}; opts.Replace = &replaceString },
+		},
+		{
+			Name:     "replace an empty column",
+			Input:    "a  b",
+			Expected: "a - b",
+			Opts:     func(opts *Options) { opts.Columns = []uint{1}; opts.Replace = &replaceString },
+		},
+		{
+			Name:     "regex group repeated in the line",
+			Input:    "1.2.3.4 said 1.2.3.4",
+			Expected: "1.2.3.4 said 1.2.0.0",
+			Opts:     func(opts *Options) { opts.Regexes = []*regexp.Regexp{regexp.MustCompile(`said (\S+)`)} },
+		},
+		{
+			Name:     "nested regex groups",
+			Input:    "ip=1.2.3.4",
+			Expected: "ip=1.2.0.0",
+			Opts:     func(opts *Options) { opts.Regexes = []*regexp.Regexp{regexp.MustCompile(`ip=((\S+))`)} },
+		},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Name, func(t *testing.T) {
+			opts := DefaultOptions()
+			tCase.Opts(&opts)
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, tCase.Expected, maskedLine, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestGetIPIndexColumn(t *testing.T) {
+	assert.Equal(t, [][]int{{0, 7}, {8, 15}}, GetIPIndexColumn("1.1.1.1 2.2.2.2", []uint{0, 1, 5}, " "))
+	assert.Equal(t, [][]int{{0, 15}}, GetIPIndexColumn("1.1.1.1 2.2.2.2", []uint{0, 1}, ""))
+	assert.Equal(t, []string{"2.2.2.2"}, GetIPStringsColumn("1.1.1.1 2.2.2.2", []uint{1}, " "))
+}
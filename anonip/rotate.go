@@ -0,0 +1,306 @@
+package anonip
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedLayout is the UTC time of rotation appended to rotated file names
+const rotatedLayout = "20060102-150405.000"
+
+// RotateOptions control when a RotatingFile is rotated and what happens to
+// the rotated files
+type RotateOptions struct {
+	// Size rotates the file before it grows beyond this many bytes
+	Size int64
+	// Interval rotates the file at multiples of this duration, so 24h rotates
+	// at midnight UTC
+	Interval time.Duration
+	// Keep is the number of rotated files kept, 0 keeps all
+	Keep int
+	// Compression compresses rotated files: none, gzip or zstd
+	Compression string
+}
+
+// RotatingFile appends to a file, which is rotated by size and time. The
+// rotated files are renamed by appending the time of rotation to their name,
+// and are compressed and pruned in the background. Lines are never split
+// across files.
+type RotatingFile struct {
+	path      string
+	opts      RotateOptions
+	extension string
+	mutex     sync.Mutex
+	file      *os.File
+	size      int64
+	next      time.Time
+	// the last write ended in the middle of a line
+	unterminated bool
+
+	// rotated files are compressed and pruned one after another, each waits
+	// for the previous one to be done
+	previous chan struct{}
+	wg       sync.WaitGroup
+	err      error
+}
+
+// OpenRotating opens the file at path for appending, rotating it as opts
+// say. A file left from an earlier interval is rotated on the first write.
+func OpenRotating(path string, opts RotateOptions) (*RotatingFile, error) {
+	if opts.Compression == "" {
+		opts.Compression = CompressionNone
+	}
+	extension, ok := compressionExtensions[opts.Compression]
+	if !ok {
+		return nil, errors.New("unsupported compression: " + opts.Compression)
+	}
+	f := &RotatingFile{path: path, opts: opts, extension: extension}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file and sets the time of the next rotation by the time it
+// was last written
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	info, err := statFile(file)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	if f.opts.Interval > 0 {
+		f.next = info.ModTime().Truncate(f.opts.Interval).Add(f.opts.Interval)
+	}
+	return nil
+}
+
+// Write appends p to the file, rotating it as needed. Lines are split
+// across files, but never a single line, even if it is written in parts.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	written := 0
+	for len(p) > 0 {
+		n := 0
+		// a line started in the file is finished in it
+		if !f.unterminated {
+			now := time.Now()
+			expired := f.opts.Interval > 0 && !now.Before(f.next)
+			n = f.fit(p)
+			if f.size > 0 && (expired || n == 0) {
+				if err := f.rotate(now); err != nil {
+					return written, err
+				}
+				n = f.fit(p)
+			} else if expired {
+				// nothing to rotate
+				f.next = now.Truncate(f.opts.Interval).Add(f.opts.Interval)
+			}
+		}
+		if n == 0 {
+			// the first line is longer than the size, or the rest of one
+			n = bytes.IndexByte(p, '\n') + 1
+			if n == 0 {
+				n = len(p)
+			}
+		}
+		m, err := f.file.Write(p[:n])
+		f.size += int64(m)
+		written += m
+		if err != nil {
+			return written, err
+		}
+		f.unterminated = p[n-1] != '\n'
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// fit returns the length of the lines at the start of p which fit into the
+// file
+func (f *RotatingFile) fit(p []byte) int {
+	room := f.opts.Size - f.size
+	if f.opts.Size == 0 || int64(len(p)) <= room {
+		return len(p)
+	}
+	if room <= 0 {
+		return 0
+	}
+	return bytes.LastIndexByte(p[:room], '\n') + 1
+}
+
+// rotate renames the file and opens a new one
+func (f *RotatingFile) rotate(now time.Time) error {
+	// open files can't be renamed on windows
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	rotated := f.rotatedName(now)
+	renameErr := os.Rename(f.path, rotated)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	done := make(chan struct{})
+	f.wg.Add(1)
+	go f.finish(rotated, f.previous, done)
+	f.previous = done
+	return nil
+}
+
+// rotatedName returns a name for the file rotated at now, which isn't taken
+func (f *RotatingFile) rotatedName(now time.Time) string {
+	for {
+		name := f.path + "." + now.UTC().Format(rotatedLayout)
+		if !exists(name) && !exists(name+f.extension) {
+			return name
+		}
+		now = now.Add(time.Millisecond)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// finish compresses a rotated file and prunes old ones, once the previous
+// rotated file is done. The first error is returned by Close.
+func (f *RotatingFile) finish(rotated string, previous <-chan struct{}, done chan<- struct{}) {
+	defer f.wg.Done()
+	defer close(done)
+	if previous != nil {
+		<-previous
+	}
+	err := f.compress(rotated)
+	if err == nil {
+		err = f.prune(rotated + f.extension)
+	}
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+}
+
+// compress replaces a rotated file by its compressed version
+func (f *RotatingFile) compress(path string) error {
+	if f.opts.Compression == CompressionNone {
+		return nil
+	}
+	input, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".anonip-*")
+	if err != nil {
+		return err
+	}
+	// the compression has been validated already
+	compressor, _ := NewCompressingWriter(temp, f.opts.Compression)
+	_, err = io.Copy(compressor, input)
+	if closeErr := compressor.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = temp.Chmod(0660)
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path+f.extension)
+	}
+	if err != nil {
+		_ = os.Remove(temp.Name())
+		return err
+	}
+	return os.Remove(path)
+}
+
+// prune removes the oldest rotated files beyond the number to keep, up to
+// last. Later ones may still be waiting to be compressed.
+func (f *RotatingFile) prune(last string) error {
+	if f.opts.Keep == 0 {
+		return nil
+	}
+	rotated, err := f.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	for len(rotated) > f.opts.Keep && rotated[0] <= last {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// rotatedFiles returns the rotated files, oldest first
+func (f *RotatingFile) rotatedFiles() ([]string, error) {
+	dir := filepath.Dir(f.path)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(f.path) + "."
+	var rotated []string
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		suffix := strings.TrimPrefix(name, prefix)
+		for _, extension := range compressionExtensions {
+			if extension != "" {
+				suffix = strings.TrimSuffix(suffix, extension)
+			}
+		}
+		if _, err := time.Parse(rotatedLayout, suffix); err == nil {
+			rotated = append(rotated, filepath.Join(dir, name))
+		}
+	}
+	return rotated, nil
+}
+
+// Reopen reopens the file by its name, e.g. after it has been moved away
+func (f *RotatingFile) Reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Close syncs and closes the file, and waits for rotated files to be
+// compressed and pruned
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err := f.file.Sync()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	f.wg.Wait()
+	if err == nil {
+		err = f.err
+	}
+	return err
+}
@@ -0,0 +1,320 @@
+package anonip
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readRotated(t *testing.T, path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewDecompressingReader(bytes.NewReader(content))
+	assert.NoError(t, err)
+	content, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	return string(content)
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	_, err = OpenRotating(path, RotateOptions{Compression: CompressionBzip2})
+	assert.EqualError(t, err, "unsupported compression: bzip2")
+	_, err = OpenRotating(filepath.Join(dir, "missing", "access.log"), RotateOptions{})
+	assert.Error(t, err)
+
+	// by size, keeping the newest two compressed
+	if err := ioutil.WriteFile(path+".old", []byte("unrelated\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenRotating(path, RotateOptions{Size: 10, Keep: 2, Compression: CompressionGzip})
+	assert.NoError(t, err)
+	for _, line := range []string{"1.2.3.4\n", "2.3.4.5\n", "3.4.5.6\n", "4.5.6.7\n"} {
+		_, err := f.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, f.Close())
+	assert.Equal(t, "4.5.6.7\n", readRotated(t, path))
+	rotated, err := f.rotatedFiles()
+	assert.NoError(t, err)
+	if assert.Len(t, rotated, 2) {
+		assert.Equal(t, ".gz", filepath.Ext(rotated[0]))
+		assert.Equal(t, "2.3.4.5\n", readRotated(t, rotated[0]))
+		assert.Equal(t, "3.4.5.6\n", readRotated(t, rotated[1]))
+	}
+	assert.Equal(t, "unrelated\n", readRotated(t, path+".old"))
+	for _, name := range rotated {
+		assert.NoError(t, os.Remove(name))
+	}
+
+	// by time
+	f, err = OpenRotating(path, RotateOptions{Interval: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	time.Sleep(60 * time.Millisecond)
+	_, err = f.Write([]byte("5.6.7.8\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, "5.6.7.8\n", readRotated(t, path))
+	rotated, err = f.rotatedFiles()
+	assert.NoError(t, err)
+	if assert.Len(t, rotated, 1) {
+		assert.Equal(t, "4.5.6.7\n", readRotated(t, rotated[0]))
+		assert.NoError(t, os.Remove(rotated[0]))
+	}
+
+	// an empty file from an earlier interval is kept
+	assert.NoError(t, os.Truncate(path, 0))
+	past := time.Now().Add(-48 * time.Hour)
+	assert.NoError(t, os.Chtimes(path, past, past))
+	f, err = OpenRotating(path, RotateOptions{Interval: 24 * time.Hour, Compression: CompressionZstd})
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("6.7.8.9\n"))
+	assert.NoError(t, err)
+	rotated, err = f.rotatedFiles()
+	assert.NoError(t, err)
+	assert.Len(t, rotated, 0)
+	assert.NoError(t, f.Close())
+
+	// while one with content is rotated on the first write
+	assert.NoError(t, os.Chtimes(path, past, past))
+	f, err = OpenRotating(path, RotateOptions{Interval: 24 * time.Hour, Compression: CompressionZstd})
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("7.8.9.10\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	rotated, err = f.rotatedFiles()
+	assert.NoError(t, err)
+	if assert.Len(t, rotated, 1) {
+		assert.Equal(t, ".zst", filepath.Ext(rotated[0]))
+		assert.Equal(t, "6.7.8.9\n", readRotated(t, rotated[0]))
+	}
+	assert.Equal(t, "7.8.9.10\n", readRotated(t, path))
+
+	// names are not reused
+	now := time.Now()
+	assert.NotEqual(t, f.rotatedName(now), path+"."+now.UTC().Format(rotatedLayout)+".zst")
+	if err := ioutil.WriteFile(path+"."+now.UTC().Format(rotatedLayout), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, path+"."+now.Add(time.Millisecond).UTC().Format(rotatedLayout), f.rotatedName(now))
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("open files can't be renamed on windows")
+	}
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	f, err := OpenRotating(path, RotateOptions{Size: 100})
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("1.2.3.4\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.Rename(path, path+".moved"))
+	assert.NoError(t, f.Reopen())
+	_, err = f.Write([]byte("3.4.5.6\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, "1.2.3.4\n", readRotated(t, path+".moved"))
+	assert.Equal(t, "3.4.5.6\n", readRotated(t, path))
+	assert.Error(t, f.Close())
+}
+
+func TestRotatingFileSplit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	f, err := OpenRotating(path, RotateOptions{Size: 20})
+	assert.NoError(t, err)
+	// split between lines
+	n, err := f.Write([]byte("1.2.3.4\n2.3.4.5\n3.4.5.6\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 24, n)
+	// a line longer than the size gets a file of its own
+	n, err = f.Write([]byte("2001:db8::1 foo bar baz\n4.5.6.7"))
+	assert.NoError(t, err)
+	assert.Equal(t, 31, n)
+	assert.NoError(t, f.Close())
+
+	rotated, err := f.rotatedFiles()
+	assert.NoError(t, err)
+	var contents []string
+	for _, name := range append(rotated, path) {
+		contents = append(contents, readRotated(t, name))
+	}
+	assert.Equal(t, []string{"1.2.3.4\n2.3.4.5\n", "3.4.5.6\n", "2001:db8::1 foo bar baz\n", "4.5.6.7"}, contents)
+}
+
+func TestRotatingFileFail(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("open files can't be renamed on windows")
+	}
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	defer func() { statFile = (*os.File).Stat }()
+	statFile = func(*os.File) (os.FileInfo, error) {
+		return nil, errors.New("stat failed")
+	}
+	_, err = OpenRotating(path, RotateOptions{})
+	assert.EqualError(t, err, "stat failed")
+	statFile = (*os.File).Stat
+
+	// a closed file can't be rotated, reopened or written
+	f, err := OpenRotating(path, RotateOptions{Size: 10})
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("1.2.3.4\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.file.Close())
+	_, err = f.Write([]byte("2.3.4.5\n"))
+	assert.Error(t, err)
+	assert.Error(t, f.Reopen())
+	f, err = OpenRotating(path, RotateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, f.file.Close())
+	_, err = f.Write([]byte("2.3.4.5\n"))
+	assert.Error(t, err)
+
+	// an unterminated line longer than the size is written anyway
+	f, err = OpenRotating(filepath.Join(dir, "long.log"), RotateOptions{Size: 4})
+	assert.NoError(t, err)
+	n, err := f.Write([]byte("1.2.3.4"))
+	assert.NoError(t, err)
+	assert.Equal(t, 7, n)
+	assert.NoError(t, f.Close())
+
+	// a deleted file can't be renamed, but a new one is opened
+	deleted := filepath.Join(dir, "deleted.log")
+	f, err = OpenRotating(deleted, RotateOptions{Size: 10})
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("1.2.3.4\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(deleted))
+	_, err = f.Write([]byte("2.3.4.5\n"))
+	assert.Error(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, "", readRotated(t, deleted))
+
+	// without the directory, there is no new file either
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0700); err != nil {
+		t.Fatal(err)
+	}
+	f, err = OpenRotating(filepath.Join(sub, "access.log"), RotateOptions{Size: 10})
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("1.2.3.4\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.RemoveAll(sub))
+	_, err = f.Write([]byte("2.3.4.5\n"))
+	assert.Error(t, err)
+	assert.Error(t, f.Close())
+
+	// failing compression
+	f, err = OpenRotating(path, RotateOptions{Compression: CompressionGzip, Keep: 1})
+	assert.NoError(t, err)
+	assert.Error(t, f.compress(filepath.Join(dir, "missing")))
+	assert.Error(t, f.compress(dir))
+	long := filepath.Join(dir, strings.Repeat("a", 240))
+	if err := ioutil.WriteFile(long, []byte("1.2.3.4\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, f.compress(long))
+	if err := os.MkdirAll(filepath.Join(path+".1.gz", "taken"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".1", []byte("1.2.3.4\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, f.compress(path+".1"))
+	assert.Equal(t, "1.2.3.4\n", readRotated(t, path+".1"))
+	temps, err := filepath.Glob(filepath.Join(dir, ".*.anonip-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, temps)
+	// is returned by Close
+	f.wg.Add(1)
+	f.finish(filepath.Join(dir, "missing"), nil, make(chan struct{}))
+	assert.Error(t, f.Close())
+
+	// failing pruning
+	missing := &RotatingFile{path: filepath.Join(dir, "missing", "access.log"), opts: RotateOptions{Keep: 1}}
+	assert.Error(t, missing.prune(""))
+	pruned := filepath.Join(dir, "pruned.log")
+	now := time.Now()
+	oldest := pruned + "." + now.UTC().Format(rotatedLayout)
+	if err := os.MkdirAll(filepath.Join(oldest, "taken"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	last := pruned + "." + now.Add(time.Second).UTC().Format(rotatedLayout)
+	if err := ioutil.WriteFile(last, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f = &RotatingFile{path: pruned, opts: RotateOptions{Keep: 1}}
+	assert.Error(t, f.prune(last))
+}
+
+func TestRotatingFileBuffered(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("open files can't be renamed on windows")
+	}
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	// full buffers end in the middle of a line
+	f, err := OpenRotating(path, RotateOptions{Interval: time.Millisecond})
+	assert.NoError(t, err)
+	b := NewBufferedWriter(f, FlushOptions{})
+	line := strings.Repeat("1.2.0.0 ", 12) + "\n"
+	for i := 0; i < 5000; i++ {
+		_, err := io.WriteString(b, line)
+		assert.NoError(t, err)
+		if i%1000 == 0 {
+			time.Sleep(2 * time.Millisecond)
+		}
+	}
+	assert.NoError(t, b.Flush())
+	assert.NoError(t, f.Close())
+
+	rotated, err := f.rotatedFiles()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, rotated)
+	lines := 0
+	for _, name := range append(rotated, path) {
+		content := readRotated(t, name)
+		assert.Equal(t, strings.Repeat(line, len(content)/len(line)), content)
+		lines += len(content) / len(line)
+	}
+	assert.Equal(t, 5000, lines)
+}
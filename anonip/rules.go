@@ -0,0 +1,155 @@
+package anonip
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rule actions
+const (
+	// ActionKeep leaves matching addresses untouched
+	ActionKeep = "keep"
+	// ActionMask truncates the last n bits of matching addresses
+	ActionMask = "mask"
+)
+
+// DefaultRuleNetwork matches all addresses no other rule matches
+const DefaultRuleNetwork = "default"
+
+// Rule defines how addresses in a network are anonymized
+type Rule struct {
+	// Network the rule applies to. A nil network matches all addresses no
+	// other rule matches
+	Network *net.IPNet
+	// Action is either ActionKeep or ActionMask
+	Action string
+	// Mask is the number of trailing bits to truncate with ActionMask. A mask
+	// bigger than the address truncates the whole address
+	Mask int
+}
+
+// ParseRule parses a rule in the form "NETWORK keep" or "NETWORK mask BITS",
+// where NETWORK is a CIDR or "default".
+func ParseRule(s string) (Rule, error) {
+	var rule Rule
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return rule, errors.New("invalid rule \"" + s + "\": expected NETWORK keep or NETWORK mask BITS")
+	}
+
+	bits := 128
+	if fields[0] != DefaultRuleNetwork {
+		_, network, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return rule, errors.New("invalid rule \"" + s + "\": " + err.Error())
+		}
+		rule.Network = network
+		_, bits = network.Mask.Size()
+	}
+
+	rule.Action = fields[1]
+	switch {
+	case rule.Action == ActionKeep && len(fields) == 2:
+		return rule, nil
+	case rule.Action == ActionMask && len(fields) == 3:
+		mask, err := strconv.Atoi(fields[2])
+		if err != nil || mask < 0 || mask > bits {
+			return rule, errors.New("invalid rule \"" + s + "\": mask must be an integer between 0 and " + strconv.Itoa(bits))
+		}
+		rule.Mask = mask
+		return rule, nil
+	}
+	return rule, errors.New("invalid rule \"" + s + "\": expected NETWORK keep or NETWORK mask BITS")
+}
+
+// ParseRules parses multiple rules. See ParseRule.
+func ParseRules(rules []string) ([]Rule, error) {
+	var parsed []Rule
+	for _, s := range rules {
+		rule, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+// readListFile reads the entries of a file, one per line. Empty lines and
+// lines starting with # are ignored.
+func readListFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ReadRulesFile reads rules from a file, one per line. Empty lines and lines
+// starting with # are ignored.
+func ReadRulesFile(name string) ([]Rule, error) {
+	rules, err := readListFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRules(rules)
+}
+
+// sortRules orders rules longest prefix first, so the most specific rule is
+// found first. The default rule is always last.
+func sortRules(rules []Rule) []Rule {
+	sorted := make([]Rule, len(rules))
+	copy(sorted, rules)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[j].Network == nil {
+			return sorted[i].Network != nil
+		}
+		if sorted[i].Network == nil {
+			return false
+		}
+		iOnes, _ := sorted[i].Network.Mask.Size()
+		jOnes, _ := sorted[j].Network.Mask.Size()
+		return iOnes > jOnes
+	})
+	return sorted
+}
+
+// matchRule returns the first rule matching ip
+func matchRule(rules []Rule, ip net.IP) *Rule {
+	for i := range rules {
+		if rules[i].Network == nil || rules[i].Network.Contains(ip) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func (r *Rule) apply(ip net.IP, increment uint) net.IP {
+	if r.Action == ActionKeep {
+		return nil
+	}
+	ipv4Mask := r.Mask
+	if ipv4Mask > 32 {
+		ipv4Mask = 32
+	}
+	return truncateTransformer{ipv4Mask: ipv4Mask, ipv6Mask: r.Mask, increment: increment}.transform(ip)
+}
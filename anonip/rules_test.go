@@ -0,0 +1,150 @@
+package anonip
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRule(t *testing.T) {
+	var testMap = []struct {
+		Input   string
+		Action  string
+		Mask    int
+		Default bool
+		Success bool
+	}{
+		{Input: "10.0.0.0/8 keep", Action: ActionKeep, Success: true},
+		{Input: "100.64.0.0/10 mask 16", Action: ActionMask, Mask: 16, Success: true},
+		{Input: "2001:db8::/32   mask 96", Action: ActionMask, Mask: 96, Success: true},
+		{Input: "default mask 12", Action: ActionMask, Mask: 12, Default: true, Success: true},
+		{Input: "default keep", Action: ActionKeep, Default: true, Success: true},
+		{Input: "10.0.0.0/8", Success: false},
+		{Input: "10.0.0.0 keep", Success: false},
+		{Input: "10.0.0.0/8 drop", Success: false},
+		{Input: "10.0.0.0/8 keep 8", Success: false},
+		{Input: "10.0.0.0/8 mask", Success: false},
+		{Input: "10.0.0.0/8 mask 33", Success: false},
+		{Input: "10.0.0.0/8 mask -1", Success: false},
+		{Input: "10.0.0.0/8 mask foo", Success: false},
+		{Input: "2001:db8::/32 mask 129", Success: false},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			rule, err := ParseRule(tCase.Input)
+			assert.True(t, err == nil == tCase.Success, "Failed with input: %v", tCase.Input)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tCase.Action, rule.Action)
+			assert.Equal(t, tCase.Mask, rule.Mask)
+			assert.Equal(t, tCase.Default, rule.Network == nil)
+		})
+	}
+}
+
+func TestRules(t *testing.T) {
+	rules, err := ParseRules([]string{
+		"default mask 12",
+		"10.0.0.0/8 keep",
+		"10.1.0.0/16 mask 8",
+		"100.64.0.0/10 mask 16",
+		"2001:db8::/32 mask 96",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testMap = []struct {
+		Input    string
+		Expected string
+	}{
+		{Input: "10.2.3.4", Expected: "10.2.3.4"},
+		{Input: "10.1.3.4", Expected: "10.1.3.0"},
+		{Input: "100.64.5.6", Expected: "100.64.0.0"},
+		{Input: "2001:0db8:1:2:3:4:5:6", Expected: "2001:db8::"},
+		{Input: "3.3.3.3", Expected: "3.3.0.0"},
+		{Input: "2a00:1:2:3:4:5:6:7", Expected: "2a00:1:2:3:4:5:6:0"},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Rules = rules
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, tCase.Expected, maskedLine, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestRulesFallback(t *testing.T) {
+	rules, err := ParseRules([]string{"10.0.0.0/8 keep", "default mask 40"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.Rules = rules[:1]
+	a := newAnonymizer(t, opts)
+	assert.Equal(t, "10.1.2.3", a.HandleLine("10.1.2.3"))
+	assert.Equal(t, "3.3.0.0", a.HandleLine("3.3.3.3"))
+
+	// masks bigger than the address truncate everything
+	opts.Rules = rules
+	assert.Equal(t, "0.0.0.0", newAnonymizer(t, opts).HandleLine("3.3.3.3"))
+}
+
+func TestRulesFail(t *testing.T) {
+	_, err := ParseRules([]string{"10.0.0.0/8 keep", "nope"})
+	assert.Error(t, err)
+
+	opts := DefaultOptions()
+	opts.Rules = []Rule{{Action: "drop"}}
+	_, err = New(opts)
+	assert.Error(t, err)
+
+	opts = DefaultOptions()
+	opts.Mode = ModeEncrypt
+	opts.Key = testKey
+	opts.Rules = []Rule{{Action: ActionKeep}}
+	_, err = New(opts)
+	assert.Error(t, err)
+	opts.Reverse = true
+	_, err = New(opts)
+	assert.Error(t, err)
+}
+
+func TestReadRulesFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "anonipRules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	name := filepath.Join(tempDir, "rules")
+	content := "# corporate network\n10.0.0.0/8 keep\n\n  default mask 12  \n"
+	if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ReadRulesFile(name)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 2)
+
+	invalid := filepath.Join(tempDir, "invalid")
+	if err := ioutil.WriteFile(invalid, []byte("10.0.0.0/8 drop\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadRulesFile(invalid)
+	assert.Error(t, err)
+
+	_, err = ReadRulesFile(filepath.Join(tempDir, "missing"))
+	assert.Error(t, err)
+
+	// a directory can be opened, but not read
+	_, err = ReadRulesFile(tempDir)
+	assert.Error(t, err)
+}
@@ -0,0 +1,121 @@
+package anonip
+
+import (
+	"net"
+	"strings"
+)
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// isAddressChar returns true for all characters an IPv4 or IPv6 address can
+// consist of
+func isAddressChar(c byte) bool {
+	return isHex(c) || c == '.' || c == ':'
+}
+
+// isTokenEnd checks whether an address ending at line[end] is not followed by
+// something that makes it part of a longer word, number or version string
+func isTokenEnd(line string, end int, ipv4 bool) bool {
+	if end == len(line) {
+		return true
+	}
+	next := byte(' ')
+	if end+1 < len(line) {
+		next = line[end+1]
+	}
+	switch c := line[end]; {
+	case c == '.':
+		// end of a sentence
+		return !isAlnum(next)
+	case c == ':':
+		// IPv4 with port, or IPv6 followed by punctuation
+		return ipv4 || !isHex(next)
+	case c == '%':
+		// IPv6 zone index
+		return !ipv4
+	case isAlnum(c) || c == '_':
+		return false
+	}
+	return true
+}
+
+// maxAddressLength is the length of the longest textual address,
+// ffff:ffff:ffff:ffff:ffff:ffff:255.255.255.255
+const maxAddressLength = 45
+
+// findIP returns the end of the longest address starting at line[start:]
+func findIP(line string, start int) (int, bool) {
+	end := start
+	for end < len(line) && end-start < maxAddressLength && isAddressChar(line[end]) {
+		end++
+	}
+	for ; end > start; end-- {
+		candidate := line[start:end]
+		if !strings.ContainsAny(candidate, "0123456789abcdefABCDEF") {
+			// "::" or a lone dot
+			break
+		}
+		ip := net.ParseIP(candidate)
+		if ip == nil {
+			continue
+		}
+		ipv4 := strings.Contains(candidate, ".") && !strings.Contains(candidate, ":")
+		if isTokenEnd(line, end, ipv4) {
+			return end, true
+		}
+	}
+	return 0, false
+}
+
+// FindAllIPIndex finds all IPv4 and IPv6 addresses in a line of free text.
+// Addresses may be surrounded by brackets, followed by a port or an IPv6 zone
+// index. It returns the byte offsets of the addresses themselves, in the same
+// format as regexp.Regexp.FindAllStringIndex.
+func FindAllIPIndex(line string) [][]int {
+	var indexes [][]int
+	for start := 0; start < len(line); start++ {
+		if !isHex(line[start]) && line[start] != ':' {
+			continue
+		}
+		if start > 0 && (isAlnum(line[start-1]) || line[start-1] == '.' || line[start-1] == '_') {
+			// part of a longer word, number or version string
+			continue
+		}
+		if end, ok := findIP(line, start); ok {
+			indexes = append(indexes, []int{start, end})
+			start = end - 1
+		}
+	}
+	return indexes
+}
+
+// scanLine anonymizes all addresses found anywhere in a line
+func (a *Anonymizer) scanLine(line string) string {
+	return a.scanIndexes(line, [][]int{{0, len(line)}})
+}
+
+// scanIndexes anonymizes all addresses found within the given byte offsets
+func (a *Anonymizer) scanIndexes(line string, indexes [][]int) string {
+	var found [][]int
+	for _, index := range indexes {
+		for _, ipIndex := range FindAllIPIndex(line[index[0]:index[1]]) {
+			found = append(found, []int{index[0] + ipIndex[0], index[0] + ipIndex[1]})
+		}
+	}
+	var replacements []replacement
+	for _, index := range found {
+		ip := net.ParseIP(line[index[0]:index[1]])
+		maskedIP := a.AnonymizeIP(ip)
+		if maskedIP == nil {
+			continue
+		}
+		replacements = append(replacements, replacement{start: index[0], end: index[1], value: maskedIP.String()})
+	}
+	return applyReplacements(line, replacements)
+}
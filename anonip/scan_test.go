@@ -0,0 +1,92 @@
+package anonip
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindAllIPIndex(t *testing.T) {
+	var testMap = []struct {
+		Input    string
+		Expected []string
+	}{
+		{Input: "login failed for bob from 203.0.113.7 port 5522", Expected: []string{"203.0.113.7"}},
+		{Input: "203.0.113.7", Expected: []string{"203.0.113.7"}},
+		{Input: "client:1.2.3.4 peer=[2001:db8::1]:443", Expected: []string{"1.2.3.4", "2001:db8::1"}},
+		{Input: "connect to 1.2.3.4:8080 failed", Expected: []string{"1.2.3.4"}},
+		{Input: "via fe80::1%eth0", Expected: []string{"fe80::1"}},
+		{Input: "from 2001:db8::2: timeout", Expected: []string{"2001:db8::2"}},
+		{Input: "route 10.0.0.0/8 added.", Expected: []string{"10.0.0.0"}},
+		{Input: "the end is 9.9.9.9.", Expected: []string{"9.9.9.9"}},
+		{Input: "(1.1.1.1,2.2.2.2)", Expected: []string{"1.1.1.1", "2.2.2.2"}},
+		{Input: "mapped ::ffff:1.2.3.4", Expected: []string{"::ffff:1.2.3.4"}},
+		{Input: "version v1.2.3.4 and 1.2.3.4.5 and 1.2.3.4a", Expected: nil},
+		{Input: "at 10:20:30 from 00:1a:2b:3c:4d:5e", Expected: nil},
+		{Input: "std::vector :: dead:beef cafe", Expected: nil},
+		{Input: "x_1.2.3.4 999.1.1.1", Expected: nil},
+		{Input: "", Expected: nil},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			var found []string
+			for _, index := range FindAllIPIndex(tCase.Input) {
+				found = append(found, tCase.Input[index[0]:index[1]])
+			}
+			assert.Equal(t, tCase.Expected, found)
+		})
+	}
+}
+
+func TestFindAllIPIndexLongRun(t *testing.T) {
+	longest := "ffff:ffff:ffff:ffff:ffff:ffff:255.255.255.255"
+	assert.Equal(t, [][]int{{5, 50}}, FindAllIPIndex("from "+longest+" port 1"))
+
+	for _, run := range []string{"a:", "1:", "1.", "f"} {
+		t.Run(run, func(t *testing.T) {
+			line := "from " + strings.Repeat(run, 20000/len(run)) + " port 1"
+			start := time.Now()
+			for _, index := range FindAllIPIndex(line) {
+				assert.True(t, index[1]-index[0] <= maxAddressLength)
+			}
+			assert.True(t, time.Since(start) < 5*time.Second, "took %s", time.Since(start))
+		})
+	}
+}
+
+func TestScan(t *testing.T) {
+	var testMap = []struct {
+		Input    string
+		Expected string
+	}{
+		{
+			Input:    "login failed for bob from 203.0.113.7 port 5522",
+			Expected: "login failed for bob from 203.0.112.0 port 5522",
+		},
+		{
+			Input:    "peer [2001:db8:85a3::8a2e:370:7334]:443 via 10.1.1.1:80, fe80::1%eth0",
+			Expected: "peer [2001:db8:85a0::]:443 via 10.1.1.1:80, fe80::%eth0",
+		},
+		{
+			Input:    "3.3.3.3 and 3.3.3.3 again",
+			Expected: "3.3.0.0 and 3.3.0.0 again",
+		},
+		{
+			Input:    "no address here",
+			Expected: "no address here",
+		},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Scan = true
+			opts.Skip, _ = ParseSkipList([]string{"10.0.0.0/8"})
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, tCase.Expected, maskedLine, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
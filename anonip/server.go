@@ -0,0 +1,394 @@
+package anonip
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultQueueSize is the default number of messages buffered between
+	// receiving and forwarding
+	DefaultQueueSize = 10000
+	// MaxMessageSize is the maximum size of a syslog message received over a
+	// stream
+	MaxMessageSize = 1 << 20
+
+	maxPacketSize   = 65535
+	maxLengthDigits = 7
+	minBackoff      = 100 * time.Millisecond
+	maxBackoff      = 5 * time.Second
+)
+
+// ServerOptions configure a syslog Server
+type ServerOptions struct {
+	// Listen are the URLs to receive syslog messages on, like udp://:514,
+	// tcp://:601 or tls://:6514
+	Listen []string
+	// Forward is the URL anonymized messages are forwarded to
+	Forward string
+	// TLSConfig is used by tls:// listeners and must contain a certificate
+	TLSConfig *tls.Config
+	// ForwardTLSConfig is used when forwarding to a tls:// URL. If nil, the
+	// system roots are used to verify the destination.
+	ForwardTLSConfig *tls.Config
+	// QueueSize is the number of messages buffered while the destination is
+	// slow or unavailable. When the queue is full, TCP senders are blocked and
+	// UDP messages are dropped.
+	QueueSize int
+}
+
+// Server receives syslog messages via UDP, TCP or TLS, anonymizes them and
+// forwards them to another syslog server. Stream connections may use octet
+// counting or newline terminated framing as described in RFC 6587; forwarded
+// messages are always octet-counted on streams.
+type Server struct {
+	anonymizer  *Anonymizer
+	opts        ServerOptions
+	forward     *url.URL
+	listeners   []net.Listener
+	packetConns []net.PacketConn
+	queue       chan string
+	quit        chan struct{}
+	closeOnce   sync.Once
+	receivers   sync.WaitGroup
+	connsMutex  sync.Mutex
+	conns       map[net.Conn]struct{}
+	dropped     uint64
+}
+
+func parseServerURL(raw string, schemes ...string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme && u.Host != "" {
+			return u, nil
+		}
+	}
+	return nil, errors.New("invalid URL \"" + raw + "\": must be " + strings.Join(schemes, "://HOST:PORT, ") + "://HOST:PORT")
+}
+
+// NewServer creates a Server and binds all listeners
+func NewServer(a *Anonymizer, opts ServerOptions) (*Server, error) {
+	if len(opts.Listen) == 0 {
+		return nil, errors.New("at least one listen URL is required")
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	forward, err := parseServerURL(opts.Forward, "udp", "tcp", "tls")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		anonymizer: a,
+		opts:       opts,
+		forward:    forward,
+		queue:      make(chan string, opts.QueueSize),
+		quit:       make(chan struct{}),
+		conns:      map[net.Conn]struct{}{},
+	}
+	for _, raw := range opts.Listen {
+		if err := s.listen(raw); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Server) listen(raw string) error {
+	u, err := parseServerURL(raw, "udp", "tcp", "tls")
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "udp":
+		conn, err := net.ListenPacket("udp", u.Host)
+		if err != nil {
+			return err
+		}
+		s.packetConns = append(s.packetConns, conn)
+		return nil
+	case "tls":
+		if s.opts.TLSConfig == nil || len(s.opts.TLSConfig.Certificates) == 0 {
+			return errors.New("listening on " + raw + " requires a certificate")
+		}
+		l, err := tls.Listen("tcp", u.Host, s.opts.TLSConfig)
+		if err != nil {
+			return err
+		}
+		s.listeners = append(s.listeners, l)
+		return nil
+	}
+	l, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return err
+	}
+	s.listeners = append(s.listeners, l)
+	return nil
+}
+
+// Addrs returns the addresses of the stream listeners, followed by the ones of
+// the UDP listeners
+func (s *Server) Addrs() []net.Addr {
+	var addrs []net.Addr
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	for _, conn := range s.packetConns {
+		addrs = append(addrs, conn.LocalAddr())
+	}
+	return addrs
+}
+
+// Dropped returns the number of UDP messages dropped because the queue was
+// full
+func (s *Server) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Serve receives, anonymizes and forwards messages until Close is called. The
+// messages still queued are forwarded before it returns.
+func (s *Server) Serve() error {
+	for _, l := range s.listeners {
+		s.receivers.Add(1)
+		go s.accept(l)
+	}
+	for _, conn := range s.packetConns {
+		s.receivers.Add(1)
+		go s.readPackets(conn)
+	}
+	go func() {
+		s.receivers.Wait()
+		close(s.queue)
+	}()
+	return s.forwardMessages()
+}
+
+// Close stops receiving messages. Serve returns as soon as the queue has been
+// forwarded.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.quit)
+		for _, l := range s.listeners {
+			_ = l.Close()
+		}
+		for _, conn := range s.packetConns {
+			_ = conn.Close()
+		}
+		s.connsMutex.Lock()
+		for conn := range s.conns {
+			_ = conn.Close()
+		}
+		s.connsMutex.Unlock()
+	})
+}
+
+func (s *Server) closing() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) accept(l net.Listener) {
+	defer s.receivers.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.closing() {
+				return
+			}
+			// like running out of file descriptors
+			time.Sleep(minBackoff)
+			continue
+		}
+		s.connsMutex.Lock()
+		if s.closing() {
+			s.connsMutex.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.receivers.Add(1)
+		s.connsMutex.Unlock()
+		go s.readStream(conn)
+	}
+}
+
+// readStream receives messages from a stream connection. If the queue is
+// full, it stops reading, which in turn slows down the sender.
+func (s *Server) readStream(conn net.Conn) {
+	defer s.receivers.Done()
+	defer func() {
+		s.connsMutex.Lock()
+		delete(s.conns, conn)
+		s.connsMutex.Unlock()
+		_ = conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		message, err := ReadFrame(reader)
+		if err != nil {
+			return
+		}
+		if message == "" {
+			continue
+		}
+		select {
+		case s.queue <- s.anonymizer.HandleLine(message):
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// readPackets receives one message per datagram. Messages are dropped if the
+// queue is full, as UDP senders can't be slowed down.
+func (s *Server) readPackets(conn net.PacketConn) {
+	defer s.receivers.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.closing() {
+				return
+			}
+			continue
+		}
+		message := strings.TrimRight(string(buf[:n]), "\r\n")
+		if message == "" {
+			continue
+		}
+		select {
+		case s.queue <- s.anonymizer.HandleLine(message):
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// ReadFrame reads a single syslog message from a stream. Octet counting is
+// used if the frame starts with a length followed by a space, otherwise the
+// message is terminated by a newline (RFC 6587).
+func ReadFrame(r *bufio.Reader) (string, error) {
+	// peek byte by byte, a short newline terminated message must not block
+	digits := 0
+	for ; digits < maxLengthDigits; digits++ {
+		peek, err := r.Peek(digits + 1)
+		if err != nil || peek[digits] < '0' || peek[digits] > '9' {
+			break
+		}
+	}
+	peek, _ := r.Peek(digits + 1)
+	if digits == 0 || len(peek) <= digits || peek[digits] != ' ' {
+		return readNonTransparentFrame(r)
+	}
+
+	length, err := strconv.Atoi(string(peek[:digits]))
+	if err != nil || length > MaxMessageSize {
+		return "", errors.New("invalid message length: " + string(peek[:digits]))
+	}
+	_, _ = r.Discard(digits + 1) // already peeked
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(message), "\r\n"), nil
+}
+
+// readNonTransparentFrame reads a newline terminated message of at most
+// MaxMessageSize bytes
+func readNonTransparentFrame(r *bufio.Reader) (string, error) {
+	errTooLong := errors.New("message exceeds " + strconv.Itoa(MaxMessageSize) + " bytes")
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > MaxMessageSize+len("\r\n") {
+			return "", errTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			err = nil
+		}
+		message := strings.TrimRight(string(line), "\r\n")
+		if len(message) > MaxMessageSize {
+			return "", errTooLong
+		}
+		return message, err
+	}
+}
+
+func (s *Server) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: maxBackoff}
+	if s.forward.Scheme == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", s.forward.Host, s.opts.ForwardTLSConfig)
+	}
+	return dialer.Dial(s.forward.Scheme, s.forward.Host)
+}
+
+func (s *Server) frame(message string) string {
+	if s.forward.Scheme == "udp" {
+		return message
+	}
+	return strconv.Itoa(len(message)) + " " + message
+}
+
+// forwardMessages sends all queued messages to the destination. If sending
+// fails, the connection is reestablished with exponential backoff and the
+// message is sent again, while the queue fills up. Once the server is closed,
+// the first failure aborts.
+func (s *Server) forwardMessages() error {
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+	backoff := minBackoff
+	for message := range s.queue {
+		framed := s.frame(message)
+		for {
+			var err error
+			if conn == nil {
+				conn, err = s.dial()
+			}
+			if err == nil {
+				_, err = io.WriteString(conn, framed)
+			}
+			if err == nil {
+				backoff = minBackoff
+				break
+			}
+			if conn != nil {
+				_ = conn.Close()
+				conn = nil
+			}
+			if s.closing() {
+				return err
+			}
+			select {
+			case <-time.After(backoff):
+			case <-s.quit:
+			}
+			backoff = min(2*backoff, maxBackoff)
+		}
+	}
+	return nil
+}
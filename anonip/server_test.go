@@ -0,0 +1,360 @@
+package anonip
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newServer(t *testing.T, opts ServerOptions) *Server {
+	anonymizerOpts := DefaultOptions()
+	anonymizerOpts.Format = FormatSyslog
+	s, err := NewServer(newAnonymizer(t, anonymizerOpts), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestServer(t *testing.T) {
+	collector, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	s := newServer(t, ServerOptions{
+		Listen:  []string{"tcp://127.0.0.1:0", "udp://127.0.0.1:0"},
+		Forward: "tcp://" + collector.Addr().String(),
+	})
+	served := make(chan error)
+	go func() { served <- s.Serve() }()
+
+	tcp, err := net.Dial("tcp", s.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tcp.Write([]byte("<13>Feb  6 12:14:14 host app: from 1.2.3.4\n\n37 <13>Feb  6 12:14:14 host app: 5.6.7.8"))
+	assert.NoError(t, err)
+
+	conn, err := collector.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{
+		"<13>Feb  6 12:14:14 host app: from 1.2.0.0",
+		"<13>Feb  6 12:14:14 host app: 5.6.0.0",
+	} {
+		message, err := ReadFrame(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, message)
+	}
+
+	udp, err := net.Dial("udp", s.Addrs()[1].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = udp.Write([]byte("\n"))
+	assert.NoError(t, err)
+	_, err = udp.Write([]byte("<13>1 2003-10-11T22:14:15.003Z host app - - [a ip=\"9.9.9.9\"]\n"))
+	assert.NoError(t, err)
+	message, err := ReadFrame(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "<13>1 2003-10-11T22:14:15.003Z host app - - [a ip=\"9.9.0.0\"]", message)
+
+	// the collector goes away, the server reconnects. The first write to the
+	// closed connection may still succeed, so keep sending until reconnected.
+	conn.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := collector.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	for conn = nil; conn == nil; {
+		_, err = udp.Write([]byte("<13>Feb  6 12:14:14 host app: 1.1.1.1"))
+		assert.NoError(t, err)
+		select {
+		case conn = <-accepted:
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	message, err = ReadFrame(bufio.NewReader(conn))
+	assert.NoError(t, err)
+	assert.Equal(t, "<13>Feb  6 12:14:14 host app: 1.1.0.0", message)
+
+	s.Close()
+	assert.NoError(t, <-served)
+	assert.Equal(t, uint64(0), s.Dropped())
+	tcp.Close()
+	udp.Close()
+	conn.Close()
+}
+
+func TestServerForwardUDP(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	s := newServer(t, ServerOptions{
+		Listen:  []string{"tcp://127.0.0.1:0"},
+		Forward: "udp://" + collector.LocalAddr().String(),
+	})
+	served := make(chan error)
+	go func() { served <- s.Serve() }()
+
+	tcp, err := net.Dial("tcp", s.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tcp.Write([]byte("<13>Feb  6 12:14:14 host app: 1.2.3.4\n"))
+	assert.NoError(t, err)
+
+	buf := make([]byte, maxPacketSize)
+	_ = collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := collector.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "<13>Feb  6 12:14:14 host app: 1.2.0.0", string(buf[:n]))
+
+	tcp.Close()
+	s.Close()
+	assert.NoError(t, <-served)
+}
+
+func TestServerUnavailable(t *testing.T) {
+	collector, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := collector.Addr().String()
+	collector.Close()
+
+	s := newServer(t, ServerOptions{
+		Listen:    []string{"udp://127.0.0.1:0"},
+		Forward:   "tcp://" + address,
+		QueueSize: 1,
+	})
+	served := make(chan error)
+	go func() { served <- s.Serve() }()
+
+	udp, err := net.Dial("udp", s.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	for s.Dropped() == 0 {
+		_, _ = udp.Write([]byte("<13>Feb  6 12:14:14 host app: 1.2.3.4"))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.Close()
+	assert.Error(t, <-served)
+}
+
+func TestNewServerFail(t *testing.T) {
+	for _, opts := range []ServerOptions{
+		{Forward: "tcp://127.0.0.1:601"},
+		{Listen: []string{"tcp://127.0.0.1:0"}, Forward: "http://127.0.0.1:601"},
+		{Listen: []string{"tcp://127.0.0.1:0"}, Forward: "tcp://"},
+		{Listen: []string{"tcp://127.0.0.1:0"}, Forward: "%"},
+		{Listen: []string{"tcp://127.0.0.1:0", "tls://127.0.0.1:0"}, Forward: "tcp://127.0.0.1:601"},
+		{Listen: []string{"tls://127.0.0.1:0"}, Forward: "tcp://127.0.0.1:601", TLSConfig: &tls.Config{}},
+		{Listen: []string{"ftp://127.0.0.1:0"}, Forward: "tcp://127.0.0.1:601"},
+		{Listen: []string{"udp://127.0.0.1:99999"}, Forward: "tcp://127.0.0.1:601"},
+		{Listen: []string{"tcp://127.0.0.1:99999"}, Forward: "tcp://127.0.0.1:601"},
+		{Listen: []string{"tls://127.0.0.1:99999"}, Forward: "tcp://127.0.0.1:601", TLSConfig: &tls.Config{Certificates: []tls.Certificate{newCertificate(t)}}},
+	} {
+		t.Run(strings.Join(opts.Listen, " ")+" "+opts.Forward, func(t *testing.T) {
+			_, err := NewServer(newAnonymizer(t, DefaultOptions()), opts)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("11 hello\nworldx2 y\r\n12345678 y\n0 3 abc"))
+	for _, expected := range []string{"hello\nworld", "x2 y", "12345678 y", "", "abc"} {
+		message, err := ReadFrame(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, message)
+	}
+	_, err := ReadFrame(reader)
+	assert.Error(t, err)
+
+	long := strings.Repeat("x", MaxMessageSize)
+	reader = bufio.NewReader(strings.NewReader(long + "\r\n" + long + "x\n" + long + "xxx\nabc"))
+	message, err := ReadFrame(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, long, message)
+	_, err = ReadFrame(reader)
+	assert.Error(t, err)
+	_, err = ReadFrame(reader)
+	assert.Error(t, err)
+
+	reader = bufio.NewReader(strings.NewReader("abc"))
+	message, err = ReadFrame(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", message)
+
+	for _, input := range []string{"9999999 x", "5 abc"} {
+		_, err := ReadFrame(bufio.NewReader(strings.NewReader(input)))
+		assert.Error(t, err)
+	}
+}
+
+type fakeListener struct {
+	net.Listener
+	accept func() (net.Conn, error)
+}
+
+func (l fakeListener) Accept() (net.Conn, error) {
+	return l.accept()
+}
+
+type fakePacketConn struct {
+	net.PacketConn
+	readFrom func() error
+}
+
+func (c fakePacketConn) ReadFrom([]byte) (int, net.Addr, error) {
+	return 0, nil, c.readFrom()
+}
+
+func TestServerReceiveErrors(t *testing.T) {
+	opts := ServerOptions{Listen: []string{"udp://127.0.0.1:0"}, Forward: "tcp://127.0.0.1:601", QueueSize: 1}
+
+	t.Run("accept", func(t *testing.T) {
+		s := newServer(t, opts)
+		client, server := net.Pipe()
+		calls := 0
+		s.receivers.Add(1)
+		s.accept(fakeListener{accept: func() (net.Conn, error) {
+			calls++
+			if calls == 1 {
+				return nil, errors.New("too many open files")
+			}
+			// closed while accepting
+			s.Close()
+			return server, nil
+		}})
+		assert.Equal(t, 2, calls)
+		_, err := client.Write([]byte("x"))
+		assert.Error(t, err)
+	})
+
+	t.Run("read packets", func(t *testing.T) {
+		s := newServer(t, opts)
+		calls := 0
+		s.receivers.Add(1)
+		s.readPackets(fakePacketConn{readFrom: func() error {
+			calls++
+			if calls == 2 {
+				s.Close()
+			}
+			return errors.New("read error")
+		}})
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		s := newServer(t, opts)
+		s.queue <- "queued"
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		s.receivers.Add(1)
+		go func() {
+			s.readStream(server)
+			close(done)
+		}()
+		_, err := client.Write([]byte("hello\n"))
+		assert.NoError(t, err)
+		s.Close()
+		<-done
+		assert.Equal(t, "queued", <-s.queue)
+	})
+}
+
+func newCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestServerTLS(t *testing.T) {
+	cert := newCertificate(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	collector, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	s := newServer(t, ServerOptions{
+		Listen:           []string{"tls://127.0.0.1:0"},
+		Forward:          "tls://" + collector.Addr().String(),
+		TLSConfig:        tlsConfig,
+		ForwardTLSConfig: &tls.Config{RootCAs: pool},
+	})
+	served := make(chan error)
+	go func() { served <- s.Serve() }()
+
+	client, err := tls.Dial("tcp", s.Addrs()[0].String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte("37 <13>Feb  6 12:14:14 host app: 1.2.3.4"))
+	assert.NoError(t, err)
+
+	conn, err := collector.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := ReadFrame(bufio.NewReader(conn))
+	assert.NoError(t, err)
+	assert.Equal(t, "<13>Feb  6 12:14:14 host app: 1.2.0.0", message)
+
+	client.Close()
+	s.Close()
+	assert.NoError(t, <-served)
+	conn.Close()
+}
@@ -0,0 +1,182 @@
+package anonip
+
+import (
+	"errors"
+	"net"
+	"sort"
+)
+
+// SpecialPurposeSets are named sets of networks, based on the IANA IPv4 and
+// IPv6 Special-Purpose Address Registries and the multicast ranges.
+var SpecialPurposeSets = map[string][]string{
+	"this-network": {
+		"0.0.0.0/8", // RFC791
+		"::/128",    // RFC4291 unspecified address
+	},
+	"private-use": {
+		"10.0.0.0/8",     // RFC1918
+		"172.16.0.0/12",  // RFC1918
+		"192.168.0.0/16", // RFC1918
+	},
+	"shared": {
+		"100.64.0.0/10", // RFC6598 carrier-grade NAT
+	},
+	"loopback": {
+		"127.0.0.0/8", // RFC1122
+		"::1/128",     // RFC4291
+	},
+	"link-local": {
+		"169.254.0.0/16", // RFC3927
+		"fe80::/10",      // RFC4291
+	},
+	"ietf-protocol": {
+		"192.0.0.0/24",   // RFC6890
+		"2001::/23",      // RFC2928
+		"2001:10::/28",   // RFC4843 deprecated ORCHID
+		"64:ff9b:1::/48", // RFC8215 local-use IPv4/IPv6 translation
+	},
+	"ipv4-mapped": {
+		"::ffff:0:0/96", // RFC4291
+	},
+	"ipv4-translation": {
+		"64:ff9b::/96", // RFC6052
+	},
+	"6to4": {
+		"192.88.99.0/24", // RFC7526 deprecated 6to4 relay anycast
+		"2002::/16",      // RFC3056
+	},
+	"teredo": {
+		"2001::/32", // RFC4380
+	},
+	"amt": {
+		"192.52.193.0/24", // RFC7450
+		"2001:3::/32",     // RFC7450
+	},
+	"as112": {
+		"192.31.196.0/24",   // RFC7535
+		"192.175.48.0/24",   // RFC7534 direct delegation
+		"2001:4:112::/48",   // RFC7535
+		"2620:4f:8000::/48", // RFC7534 direct delegation
+	},
+	"documentation": {
+		"192.0.2.0/24",    // RFC5737 TEST-NET-1
+		"198.51.100.0/24", // RFC5737 TEST-NET-2
+		"203.0.113.0/24",  // RFC5737 TEST-NET-3
+		"2001:db8::/32",   // RFC3849
+		"3fff::/20",       // RFC9637
+	},
+	"benchmarking": {
+		"198.18.0.0/15", // RFC2544
+		"2001:2::/48",   // RFC5180
+	},
+	"reserved": {
+		"240.0.0.0/4",        // RFC1112
+		"255.255.255.255/32", // RFC919 limited broadcast
+	},
+	"discard": {
+		"100::/64", // RFC6666
+	},
+	"segment-routing": {
+		"5f00::/16", // RFC9602
+	},
+	"unique-local": {
+		"fc00::/7", // RFC4193
+	},
+	"multicast": {
+		"224.0.0.0/4", // RFC5771
+		"ff00::/8",    // RFC4291
+	},
+}
+
+// PrivateSets are the sets skipped by Options.SkipPrivate. They contain all
+// networks of the special-purpose registries that are not globally reachable,
+// as well as the multicast ranges. IPv4-mapped addresses are checked as the
+// IPv4 address they contain, so ipv4-mapped is not part of them.
+var PrivateSets = []string{
+	"this-network",
+	"private-use",
+	"shared",
+	"loopback",
+	"link-local",
+	"ietf-protocol",
+	"documentation",
+	"benchmarking",
+	"reserved",
+	"discard",
+	"segment-routing",
+	"unique-local",
+	"multicast",
+}
+
+// globallyReachable are the globally reachable networks of the registries
+// within the PrivateSets. They are not skipped by Options.SkipPrivate.
+var globallyReachable = []string{
+	"192.0.0.9/32",    // RFC7723 PCP anycast
+	"192.0.0.10/32",   // RFC8155 TURN anycast
+	"2001::/32",       // RFC4380 Teredo, contains the client address
+	"2001:1::1/128",   // RFC7723 PCP anycast
+	"2001:1::2/128",   // RFC8155 TURN anycast
+	"2001:1::3/128",   // RFC9665 DNS-SD SRP anycast
+	"2001:3::/32",     // RFC7450 AMT
+	"2001:4:112::/48", // RFC7535 AS112-v6
+	"2001:20::/28",    // RFC7343 ORCHIDv2
+	"2001:30::/28",    // RFC9374 drone remote ID
+}
+
+// SpecialPurposeSetNames returns the sorted names of all SpecialPurposeSets
+func SpecialPurposeSetNames() []string {
+	var names []string
+	for name := range SpecialPurposeSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func setsCIDRs(sets []string) []string {
+	var cidrs []string
+	for _, name := range sets {
+		cidrs = append(cidrs, SpecialPurposeSets[name]...)
+	}
+	return cidrs
+}
+
+// ParseSkipList parses networks to skip. Each entry is either a CIDR, a
+// single address or the name of one of the SpecialPurposeSets.
+func ParseSkipList(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if cidrs, ok := SpecialPurposeSets[entry]; ok {
+			blocks, err := parseCIDRs(cidrs)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, blocks...)
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			bits := len(ip) * 8
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.New("invalid network \"" + entry + "\": must be a CIDR, an address or a set name")
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ReadSkipFile reads networks to skip from a file, one per line. Empty lines
+// and lines starting with # are ignored. See ParseSkipList.
+func ReadSkipFile(name string) ([]*net.IPNet, error) {
+	entries, err := readListFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSkipList(entries)
+}
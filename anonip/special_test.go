@@ -0,0 +1,131 @@
+package anonip
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpecialPurposeSets(t *testing.T) {
+	for _, name := range SpecialPurposeSetNames() {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseCIDRs(SpecialPurposeSets[name])
+			assert.NoError(t, err)
+		})
+	}
+	for _, name := range PrivateSets {
+		_, ok := SpecialPurposeSets[name]
+		assert.True(t, ok, "unknown private set %s", name)
+	}
+}
+
+func TestSkipPrivateSpecialPurpose(t *testing.T) {
+	var testMap = []struct {
+		Input    string
+		Expected string
+	}{
+		{Input: "0.1.2.3", Expected: "0.1.2.3"},
+		{Input: "100.64.1.2", Expected: "100.64.1.2"},
+		{Input: "192.0.0.8", Expected: "192.0.0.8"},
+		{Input: "192.0.2.55", Expected: "192.0.2.55"},
+		{Input: "198.19.1.2", Expected: "198.19.1.2"},
+		{Input: "203.0.113.7", Expected: "203.0.113.7"},
+		{Input: "224.0.0.251", Expected: "224.0.0.251"},
+		{Input: "250.1.2.3", Expected: "250.1.2.3"},
+		{Input: "255.255.255.255", Expected: "255.255.255.255"},
+		{Input: "2001:db8::1", Expected: "2001:db8::1"},
+		{Input: "fd00::1", Expected: "fd00::1"},
+		{Input: "ff02::1", Expected: "ff02::1"},
+		{Input: "100.128.1.2", Expected: "100.128.0.0"},
+		{Input: "2001:0:4136:e378:8000:63bf:3fff:fdd2", Expected: "2001:0:4130::"},
+		{Input: "2002:c000:204::1", Expected: "2002:c000:200::"},
+		{Input: "2001:5::1", Expected: "2001:5::1"},
+		{Input: "2001:2::1", Expected: "2001:2::1"},
+		{Input: "192.0.0.9", Expected: "192.0.0.0"},
+		{Input: "2001:1::1", Expected: "2001:1::"},
+		{Input: "2001:3::1", Expected: "2001:3::"},
+		{Input: "2001:4:112::1", Expected: "2001:4:110::"},
+		{Input: "2001:20::1", Expected: "2001:20::"},
+		{Input: "64:ff9b::c000:201", Expected: "64:ff9b::"},
+		{Input: "192.88.99.1", Expected: "192.88.96.0"},
+		{Input: "192.175.48.6", Expected: "192.175.48.0"},
+		{Input: "2620:4f:8000::6", Expected: "2620:4f:8000::"},
+	}
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.SkipPrivate = true
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, tCase.Expected, maskedLine, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestSkip(t *testing.T) {
+	skip, err := ParseSkipList([]string{"5.5.5.5", "2001:db8:1::/48", "documentation", "::ffff:6.6.6.6", "as112", "teredo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testMap = []struct {
+		Input    string
+		Expected string
+	}{
+		{Input: "5.5.5.5", Expected: "5.5.5.5"},
+		{Input: "5.5.5.6", Expected: "5.5.0.0"},
+		{Input: "6.6.6.6", Expected: "6.6.6.6"},
+		{Input: "2001:db8:1::1", Expected: "2001:db8:1::1"},
+		{Input: "198.51.100.1", Expected: "198.51.100.1"},
+		{Input: "10.1.1.1", Expected: "10.1.0.0"},
+		{Input: "192.175.48.6", Expected: "192.175.48.6"},
+		{Input: "2620:4f:8000::6", Expected: "2620:4f:8000::6"},
+		{Input: "2001:0:4136:e378:8000:63bf:3fff:fdd2", Expected: "2001:0:4136:e378:8000:63bf:3fff:fdd2"},
+	}
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Skip = skip
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, tCase.Expected, maskedLine, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestParseSkipListFail(t *testing.T) {
+	_, err := ParseSkipList([]string{"10.0.0.0/8", "not-a-set"})
+	assert.Error(t, err)
+
+	opts := DefaultOptions()
+	opts.Mode = ModeEncrypt
+	opts.Key = testKey
+	opts.Skip = []*net.IPNet{{IP: net.IPv4zero, Mask: net.CIDRMask(8, 32)}}
+	_, err = New(opts)
+	assert.Error(t, err)
+	opts.Reverse = true
+	_, err = New(opts)
+	assert.Error(t, err)
+}
+
+func TestReadSkipFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "anonipSkip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	name := filepath.Join(tempDir, "skip")
+	content := "# load balancers\n5.5.5.5\n5.5.6.0/24\n\nshared\n"
+	if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	skip, err := ReadSkipFile(name)
+	assert.NoError(t, err)
+	assert.Len(t, skip, 3)
+
+	_, err = ReadSkipFile(filepath.Join(tempDir, "missing"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,182 @@
+package anonip
+
+import (
+	"errors"
+	"strings"
+)
+
+var errInvalidSyslog = errors.New("invalid syslog")
+
+var months = []string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
+
+// nextToken returns the end of the space delimited token starting at pos
+func nextToken(line string, pos int) int {
+	end := strings.IndexByte(line[pos:], ' ')
+	if end < 0 {
+		return len(line)
+	}
+	return pos + end
+}
+
+// skipPriority returns the position after the <PRI> part of a syslog line, if
+// there is one
+func skipPriority(line string) (int, error) {
+	if !strings.HasPrefix(line, "<") {
+		return 0, nil
+	}
+	end := strings.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		return 0, errInvalidSyslog
+	}
+	for _, c := range line[1:end] {
+		if c < '0' || c > '9' {
+			return 0, errInvalidSyslog
+		}
+	}
+	return end + 1, nil
+}
+
+// FindSyslogFields returns the byte offsets of all structured data parameter
+// values and of the message of a syslog line according to RFC 5424 or
+// RFC 3164. The priority is optional, so lines as written to files by syslog
+// daemons are supported as well. The header is not part of the result.
+func FindSyslogFields(line string) ([][]int, error) {
+	pos, err := skipPriority(line)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(line[pos:], "1 ") {
+		return findRFC5424Fields(line, pos+2)
+	}
+	return findRFC3164Fields(line, pos)
+}
+
+// findRFC5424Fields parses
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func findRFC5424Fields(line string, pos int) ([][]int, error) {
+	for i := 0; i < 5; i++ {
+		pos = nextToken(line, pos)
+		if pos == len(line) {
+			return nil, errInvalidSyslog
+		}
+		pos++
+	}
+
+	var indexes [][]int
+	if strings.HasPrefix(line[pos:], "-") {
+		pos++
+	} else {
+		sdIndexes, end, err := findStructuredData(line, pos)
+		if err != nil {
+			return nil, err
+		}
+		indexes = sdIndexes
+		pos = end
+	}
+
+	switch {
+	case pos == len(line):
+		return indexes, nil
+	case line[pos] != ' ':
+		return nil, errInvalidSyslog
+	}
+	return append(indexes, []int{pos + 1, len(line)}), nil
+}
+
+// findStructuredData returns the offsets of all parameter values of the
+// structured data elements starting at pos and the end of the last element
+func findStructuredData(line string, pos int) ([][]int, int, error) {
+	var indexes [][]int
+	if pos == len(line) || line[pos] != '[' {
+		return nil, 0, errInvalidSyslog
+	}
+	for pos < len(line) && line[pos] == '[' {
+		pos++
+		// SD-ID
+		for pos < len(line) && line[pos] != ' ' && line[pos] != ']' {
+			pos++
+		}
+		for {
+			if pos == len(line) {
+				return nil, 0, errInvalidSyslog
+			}
+			if line[pos] == ']' {
+				pos++
+				break
+			}
+			// SP PARAM-NAME="PARAM-VALUE"
+			nameEnd := strings.Index(line[pos:], "=\"")
+			if line[pos] != ' ' || nameEnd < 2 || strings.ContainsAny(line[pos+1:pos+nameEnd], " ]\"") {
+				return nil, 0, errInvalidSyslog
+			}
+			pos += nameEnd + 2
+			start := pos
+			for pos < len(line) && line[pos] != '"' {
+				if line[pos] == '\\' {
+					pos++
+				}
+				pos++
+			}
+			if pos >= len(line) {
+				return nil, 0, errInvalidSyslog
+			}
+			indexes = append(indexes, []int{start, pos})
+			pos++ // "
+		}
+	}
+	return indexes, pos, nil
+}
+
+// findRFC3164Fields parses TIMESTAMP HOSTNAME TAG: MSG. The timestamp is
+// either "Mmm dd hh:mm:ss" or, as written by modern syslog daemons, RFC 3339.
+// Hostname and tag may be missing.
+func findRFC3164Fields(line string, pos int) ([][]int, error) {
+	isBSDTimestamp := false
+	for _, month := range months {
+		if strings.HasPrefix(line[pos:], month+" ") {
+			isBSDTimestamp = true
+			break
+		}
+	}
+	switch {
+	case isBSDTimestamp && len(line) >= pos+16 && line[pos+15] == ' ':
+		pos += 16
+	case pos < len(line) && line[pos] >= '0' && line[pos] <= '9' && strings.Contains(line[pos:nextToken(line, pos)], "T"):
+		pos = nextToken(line, pos) + 1
+	default:
+		return nil, errInvalidSyslog
+	}
+
+	if pos < len(line) && !strings.HasSuffix(line[pos:nextToken(line, pos)], ":") {
+		// hostname
+		pos = nextToken(line, pos) + 1
+	}
+	if pos < len(line) && isTag(line[pos:nextToken(line, pos)]) {
+		pos = nextToken(line, pos) + 1
+	}
+	if pos >= len(line) {
+		return nil, nil
+	}
+	return [][]int{{pos, len(line)}}, nil
+}
+
+// isTag returns true for a TAG: token. Addresses followed by a colon, as in
+// "203.0.113.7: connection refused", belong to the message.
+func isTag(token string) bool {
+	if !strings.HasSuffix(token, ":") {
+		return false
+	}
+	_, ip := GetIP(strings.TrimSuffix(token, ":"))
+	return ip == nil
+}
+
+// syslogLine anonymizes the addresses found in the structured data and the
+// message of a syslog line, leaving the header intact. Lines that are not
+// valid syslog are scanned as a whole.
+func (a *Anonymizer) syslogLine(line string) string {
+	indexes, err := FindSyslogFields(line)
+	if err != nil {
+		return a.scanLine(line)
+	}
+	return a.scanIndexes(line, indexes)
+}
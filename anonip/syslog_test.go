@@ -0,0 +1,99 @@
+package anonip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslog(t *testing.T) {
+	var testMap = []struct {
+		Input    string
+		Expected string
+	}{
+		{
+			Input:    `<38>Feb  6 12:14:14 gateway sshd[1234]: Failed password for root from 1.2.3.4 port 22 ssh2`,
+			Expected: `<38>Feb  6 12:14:14 gateway sshd[1234]: Failed password for root from 1.2.0.0 port 22 ssh2`,
+		},
+		{
+			Input:    `Feb 16 12:14:14 10.1.2.3 postfix/smtpd[99]: connect from unknown[2001:db8::1]`,
+			Expected: `Feb 16 12:14:14 10.1.2.3 postfix/smtpd[99]: connect from unknown[2001:db8::]`,
+		},
+		{
+			Input:    `2020-01-01T00:00:00.123+01:00 fw kernel: IN=eth0 SRC=1.2.3.4 DST=5.6.7.8`,
+			Expected: `2020-01-01T00:00:00.123+01:00 fw kernel: IN=eth0 SRC=1.2.0.0 DST=5.6.0.0`,
+		},
+		{
+			Input:    `<13>Feb  6 12:14:14 sshd: from 1.2.3.4`,
+			Expected: `<13>Feb  6 12:14:14 sshd: from 1.2.0.0`,
+		},
+		{
+			Input:    `Oct 11 22:14:15 myhost 203.0.113.7: connection refused`,
+			Expected: `Oct 11 22:14:15 myhost 203.0.112.0: connection refused`,
+		},
+		{
+			Input:    `<13>Oct 11 22:14:15 [2001:db8::1]:22: connection refused`,
+			Expected: `<13>Oct 11 22:14:15 [2001:db8::]:22: connection refused`,
+		},
+		{
+			Input:    `<13>Feb  6 12:14:14 host connect from 1.2.3.4`,
+			Expected: `<13>Feb  6 12:14:14 host connect from 1.2.0.0`,
+		},
+		{
+			Input:    `<13>Feb  6 12:14:14 host`,
+			Expected: `<13>Feb  6 12:14:14 host`,
+		},
+		{
+			Input:    `<165>1 2003-10-11T22:14:15.003Z 10.1.2.3 evntslog - ID47 [exampleSDID@32473 iut="3" src="1.2.3.4, 5.6.7.8"][origin ip="9.9.9.9" x="a\"]1.1.1.1"] from 1.2.3.4`,
+			Expected: `<165>1 2003-10-11T22:14:15.003Z 10.1.2.3 evntslog - ID47 [exampleSDID@32473 iut="3" src="1.2.0.0, 5.6.0.0"][origin ip="9.9.0.0" x="a\"]1.1.0.0"] from 1.2.0.0`,
+		},
+		{
+			Input:    `<165>1 2003-10-11T22:14:15.003Z host app 1 - - 1.2.3.4`,
+			Expected: `<165>1 2003-10-11T22:14:15.003Z host app 1 - - 1.2.0.0`,
+		},
+		{
+			Input:    `<165>1 2003-10-11T22:14:15.003Z host app 1 - [a]`,
+			Expected: `<165>1 2003-10-11T22:14:15.003Z host app 1 - [a]`,
+		},
+		{
+			Input:    `<165>1 2003-10-11T22:14:15.003Z 10.1.2.3 app 1 - [a ip="1.2.3.4]`,
+			Expected: `<165>1 2003-10-11T22:14:15.003Z 10.1.0.0 app 1 - [a ip="1.2.0.0]`,
+		},
+		{
+			Input:    `<1234>Feb  6 12:14:14 10.1.2.3 sshd: from 1.2.3.4`,
+			Expected: `<1234>Feb  6 12:14:14 10.1.0.0 sshd: from 1.2.0.0`,
+		},
+		{
+			Input:    `10.1.2.3 - - [06/Feb/2009:12:14:14 +0000] "GET / HTTP/1.1"`,
+			Expected: `10.1.0.0 - - [06/Feb/2009:12:14:14 +0000] "GET / HTTP/1.1"`,
+		},
+	}
+
+	for _, tCase := range testMap {
+		t.Run(tCase.Input, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Format = FormatSyslog
+			maskedLine := newAnonymizer(t, opts).HandleLine(tCase.Input)
+			assert.Equal(t, tCase.Expected, maskedLine, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		})
+	}
+}
+
+func TestFindSyslogFields(t *testing.T) {
+	for _, input := range []string{
+		`<1a>Feb  6 12:14:14 host app: msg`,
+		`<>Feb  6 12:14:14 host app: msg`,
+		`<13>1 2003-10-11T22:14:15.003Z host app`,
+		`<13>1 2003-10-11T22:14:15.003Z host app 1 - x`,
+		`<13>1 2003-10-11T22:14:15.003Z host app 1 - -x`,
+		`<13>1 2003-10-11T22:14:15.003Z host app 1 - [a b]`,
+		`<13>1 2003-10-11T22:14:15.003Z host app 1 - [a b="c"]x`,
+		`<13>1 2003-10-11T22:14:15.003Z host app 1 - [a`,
+		`Feb`,
+	} {
+		t.Run(input, func(t *testing.T) {
+			_, err := FindSyslogFields(input)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package anonip
+
+import (
+	"strings"
+)
+
+const w3cFieldsDirective = "#Fields:"
+
+// W3CDefaultFields are the fields IIS logs by default. They are used until
+// the first #Fields directive is found.
+var W3CDefaultFields = []string{
+	"date", "time", "s-ip", "cs-method", "cs-uri-stem", "cs-uri-query",
+	"s-port", "cs-username", "c-ip", "cs(User-Agent)", "cs(Referer)",
+	"sc-status", "sc-substatus", "sc-win32-status", "time-taken",
+}
+
+// W3CAddressFields are the fields holding addresses in the W3C extended log
+// format. They are anonymized unless Options.ColumnNames is set.
+var W3CAddressFields = []string{
+	"c-ip", "s-ip", "cs(X-Forwarded-For)", "X-Forwarded-For",
+}
+
+// setW3CFields selects the columns holding addresses, according to the field
+// names of a #Fields directive. Names are case-insensitive and must not all be
+// present.
+func (a *Anonymizer) setW3CFields(fields []string) {
+	names := a.opts.ColumnNames
+	if len(names) == 0 {
+		names = W3CAddressFields
+	}
+	a.columns = nil
+	for i, field := range fields {
+		for _, name := range names {
+			if strings.EqualFold(field, name) {
+				a.columns = append(a.columns, uint(i))
+				break
+			}
+		}
+	}
+}
+
+// w3cLine anonymizes a line of a W3C extended log file. Directives are passed
+// through, a #Fields directive changes the columns for all subsequent lines.
+// IIS replaces spaces in values with "+", which is taken into account for
+// lists of addresses.
+func (a *Anonymizer) w3cLine(line string) string {
+	if strings.HasPrefix(line, "#") {
+		if strings.HasPrefix(line, w3cFieldsDirective) {
+			a.setW3CFields(strings.Fields(line[len(w3cFieldsDirective):]))
+		}
+		return line
+	}
+	var indexes [][]int
+	for _, index := range GetIPIndexColumn(line, a.columns, " ") {
+		indexes = append(indexes, listIndexes(line, index, " +")...)
+	}
+	return a.anonymizeIndexes(line, indexes)
+}
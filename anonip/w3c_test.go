@@ -0,0 +1,47 @@
+package anonip
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestW3C(t *testing.T) {
+	input := strings.Join([]string{
+		"#Software: Microsoft Internet Information Services 10.0",
+		"#Fields: date time s-ip cs-method cs-uri-stem c-ip X-Forwarded-For",
+		"2020-01-01 00:00:00 10.1.2.3 GET /?1.2.3.4 1.2.3.4 5.6.7.8,+9.9.9.9",
+		"2020-01-01 00:00:00 10.1.2.3 GET / 1.2.3.4 -",
+		"#Fields: date time C-IP",
+		"2020-01-01 00:00:00 1.2.3.4 5.6.7.8",
+		"",
+	}, "\n")
+	expected := strings.Join([]string{
+		"#Software: Microsoft Internet Information Services 10.0",
+		"#Fields: date time s-ip cs-method cs-uri-stem c-ip X-Forwarded-For",
+		"2020-01-01 00:00:00 10.1.0.0 GET /?1.2.3.4 1.2.0.0 5.6.0.0,+9.9.0.0",
+		"2020-01-01 00:00:00 10.1.0.0 GET / 1.2.0.0 -",
+		"#Fields: date time C-IP",
+		"2020-01-01 00:00:00 1.2.0.0 5.6.7.8",
+		"",
+	}, "\n")
+
+	opts := DefaultOptions()
+	opts.Format = FormatW3C
+	opts.Workers = 4
+	var output bytes.Buffer
+	assert.NoError(t, newAnonymizer(t, opts).Run(strings.NewReader(input), &output))
+	assert.Equal(t, expected, output.String())
+}
+
+func TestW3CColumnNames(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Format = FormatW3C
+	opts.ColumnNames = []string{"cs-uri-query"}
+	a := newAnonymizer(t, opts)
+	assert.False(t, a.NeedsHeader())
+	assert.Equal(t, "#Fields: c-ip cs-uri-query", a.HandleLine("#Fields: c-ip cs-uri-query"))
+	assert.Equal(t, "1.2.3.4 1.2.0.0", a.HandleLine("1.2.3.4 1.2.3.4"))
+}
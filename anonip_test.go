@@ -2,16 +2,19 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"regexp"
+	"path/filepath"
 	"strings"
 	"testing"
 	"testing/iotest"
+	"time"
 
+	"github.com/open-dynaMIX/anonip-go/anonip"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -44,256 +47,6 @@ func GetDefaultArgs() Args {
 	return args
 }
 
-func TestHandleLine(t *testing.T) {
-	var testMap = []struct {
-		Input    string
-		Expected string
-		V4Mask   int
-		V6Mask   int
-	}{
-		{
-			Input:    "3.3.3.3",
-			Expected: "3.3.0.0",
-			V4Mask:   12,
-			V6Mask:   84,
-		},
-		{
-			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
-			Expected: "2001:db8:85a0::",
-			V4Mask:   12,
-			V6Mask:   84,
-		},
-		{
-			Input:    "192.168.100.200",
-			Expected: "192.168.96.0",
-			V4Mask:   12,
-			V6Mask:   84,
-		},
-		{
-			Input:    "192.168.100.200:80",
-			Expected: "192.168.96.0:80",
-			V4Mask:   12,
-			V6Mask:   84,
-		},
-		{
-			Input:    "192.168.100.200]",
-			Expected: "192.168.96.0]",
-			V4Mask:   12,
-			V6Mask:   84,
-		},
-		{
-			Input:    "192.168.100.200:80]",
-			Expected: "192.168.96.0:80]",
-			V4Mask:   12,
-			V6Mask:   84,
-		},
-		{
-			Input:    "192.168.100.200",
-			Expected: "192.168.100.200",
-			V4Mask:   0,
-			V6Mask:   84,
-		},
-		{
-			Input:    "192.168.100.200",
-			Expected: "192.168.100.192",
-			V4Mask:   4,
-			V6Mask:   84,
-		},
-		{
-			Input:    "192.168.100.200",
-			Expected: "192.168.100.0",
-			V4Mask:   8,
-			V6Mask:   84,
-		},
-		{
-			Input:    "192.168.100.200",
-			Expected: "192.0.0.0",
-			V4Mask:   24,
-			V6Mask:   84,
-		},
-		{
-			Input:    "192.168.100.200",
-			Expected: "0.0.0.0",
-			V4Mask:   32,
-			V6Mask:   84,
-		},
-		{
-			Input:    "no_ip_address",
-			Expected: "no_ip_address",
-			V4Mask:   12,
-			V6Mask:   84,
-		},
-		{
-			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
-			Expected: "2001:db8:85a0::",
-			V4Mask:   12,
-			V6Mask:   84,
-		},
-		{
-			Input:    "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:443",
-			Expected: "[2001:db8:85a0::]:443",
-			V4Mask:   12,
-			V6Mask:   84,
-		},
-		{
-			Input:    "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]",
-			Expected: "[2001:db8:85a0::]",
-			V4Mask:   12,
-			V6Mask:   84,
-		},
-		{
-			Input:    "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]]",
-			Expected: "[2001:db8:85a0::]]",
-			V4Mask:   12,
-			V6Mask:   84,
-		},
-		{
-			Input:    "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:443]",
-			Expected: "[2001:db8:85a0::]:443]",
-			V4Mask:   12,
-			V6Mask:   84,
-		},
-		{
-			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
-			Expected: "2001:db8:85a3::8a2e:370:7334",
-			V4Mask:   12,
-			V6Mask:   0,
-		},
-		{
-			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
-			Expected: "2001:db8:85a3::8a2e:370:7330",
-			V4Mask:   12,
-			V6Mask:   4,
-		},
-		{
-			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
-			Expected: "2001:db8:85a3::8a2e:370:7300",
-			V4Mask:   12,
-			V6Mask:   8,
-		},
-		{
-			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
-			Expected: "2001:db8:85a3::8a2e:300:0",
-			V4Mask:   12,
-			V6Mask:   24,
-		},
-		{
-			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
-			Expected: "2001:db8:85a3::8a2e:0:0",
-			V4Mask:   12,
-			V6Mask:   32,
-		},
-		{
-			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
-			Expected: "2001:db8:85a3::",
-			V4Mask:   12,
-			V6Mask:   62,
-		},
-		{
-			Input:    "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
-			Expected: "::",
-			V4Mask:   12,
-			V6Mask:   128,
-		},
-		{
-			Input:    "   foo",
-			Expected: "   foo",
-			V4Mask:   12,
-			V6Mask:   84,
-		},
-		{
-			Input:    "",
-			Expected: "",
-			V4Mask:   12,
-			V6Mask:   84,
-		},
-	}
-
-	for _, tCase := range testMap {
-		t.Run(tCase.Input, func(t *testing.T) {
-			channel := make(chan string)
-			args := GetDefaultArgs()
-			args.IPV4Mask, args.IPV6Mask = tCase.V4Mask, tCase.V6Mask
-			go HandleLine(tCase.Input, args, channel)
-			maskedLine := <-channel
-			assert.Equal(t, maskedLine, tCase.Expected, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
-		})
-	}
-}
-
-func TestIncrement(t *testing.T) {
-	var testMap = []struct {
-		Input     string
-		Increment uint
-		Expected  string
-	}{
-		{
-			Input:     "192.168.100.200",
-			Increment: 3,
-			Expected:  "192.168.96.3",
-		},
-		{
-			Input:     "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
-			Increment: 7,
-			Expected:  "2001:db8:85a0::7",
-		},
-	}
-	for _, tCase := range testMap {
-		t.Run(tCase.Input, func(t *testing.T) {
-			channel := make(chan string)
-			args := GetDefaultArgs()
-			args.Increment = tCase.Increment
-			go HandleLine(tCase.Input, args, channel)
-			maskedLine := <-channel
-			assert.Equal(t, maskedLine, tCase.Expected, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
-		})
-	}
-}
-
-func TestColumns(t *testing.T) {
-	var testMap = []struct {
-		Input    string
-		Columns  []uint
-		Expected string
-	}{
-		{
-			Input:    "192.168.100.200 some string with öéäü",
-			Columns:  []uint{0},
-			Expected: "192.168.96.0 some string with öéäü",
-		},
-		{
-			Input:    "some 192.168.100.200 string with öéäü",
-			Columns:  []uint{1},
-			Expected: "some 192.168.96.0 string with öéäü",
-		},
-		{
-			Input:    "some string 192.168.100.200 with öéäü",
-			Columns:  []uint{2},
-			Expected: "some string 192.168.96.0 with öéäü",
-		},
-		{
-			Input:    "192.168.100.200 192.168.11.222 192.168.123.234",
-			Columns:  []uint{0, 1, 2},
-			Expected: "192.168.96.0 192.168.0.0 192.168.112.0",
-		},
-		{
-			Input:    "192.168.100.200 192.168.11.222 192.168.123.234",
-			Columns:  []uint{9999},
-			Expected: "192.168.100.200 192.168.11.222 192.168.123.234",
-		},
-	}
-	for _, tCase := range testMap {
-		t.Run(tCase.Input, func(t *testing.T) {
-			channel := make(chan string)
-			args := GetDefaultArgs()
-			args.Columns = tCase.Columns
-			go HandleLine(tCase.Input, args, channel)
-			maskedLine := <-channel
-			assert.Equal(t, maskedLine, tCase.Expected, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
-		})
-	}
-}
-
 func TestArgsColumns(t *testing.T) {
 	var testMap = []struct {
 		Input    []string
@@ -485,6 +238,7 @@ func TestMainFail(t *testing.T) {
 		{"-o"},
 		{"--input"},
 		{"--regex", "\\8"},
+		{"-w", "0"},
 	}
 
 	// ignore stderr in order to keep the log clean
@@ -574,164 +328,691 @@ func TestRunFail(t *testing.T) {
 	assert.True(t, got == -1, "Expected exit code: -1, got: %d", got)
 }
 
-func TestDelimiter(t *testing.T) {
+func TestRunFailAnonymizer(t *testing.T) {
+	// patched exit function
+	var got int
+	testOsExit := func(code int) {
+		got = code
+	}
+
+	// create a copy of the old value
+	oldOsExit := osExit
+
+	// ignore stderr in order to keep the log clean
+	oldStderr := os.Stderr
+	os.Stderr, _ = os.Open("/dev/null")
+
+	// restore previous state after the test
+	defer func() {
+		osExit = oldOsExit
+		os.Stderr = oldStderr
+	}()
+
+	// reassign osExit
+	osExit = testOsExit
+
+	args := GetDefaultArgs()
+	args.IPV4Mask = 33
+
+	Run(args)
+
+	assert.True(t, got == 2, "Expected exit code: 2, got: %d", got)
+}
+
+func TestArgsMode(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "anonipKey")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	keyFile := filepath.Join(tempDir, "key")
+	shortKeyFile := filepath.Join(tempDir, "short")
+	longKeyFile := filepath.Join(tempDir, "long")
+	if err := ioutil.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(longKeyFile, []byte("0123456789abcdef0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(shortKeyFile, []byte("short\n"), 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	var testMap = []struct {
+		Input   []string
+		Success bool
+	}{
+		{
+			Input:   []string{"-m", "truncate"},
+			Success: true,
+		},
+		{
+			Input:   []string{"-m", "hmac", "-k", keyFile},
+			Success: true,
+		},
+		{
+			Input:   []string{"-m", "cryptopan", "-k", keyFile},
+			Success: true,
+		},
+		{
+			Input:   []string{"-m", "cryptopan", "-k", shortKeyFile},
+			Success: false,
+		},
+		{
+			Input:   []string{"-m", "cryptopan", "-k", longKeyFile},
+			Success: false,
+		},
+		{
+			Input:   []string{"-m", "encrypt", "-k", keyFile},
+			Success: true,
+		},
+		{
+			Input:   []string{"-m", "encrypt", "-k", keyFile, "-p"},
+			Success: false,
+		},
+		{
+			Input:   []string{"-m", "encrypt", "-k", keyFile, "--skip-cidr", "10.0.0.0/8"},
+			Success: false,
+		},
+		{
+			Input:   []string{"-m", "encrypt", "-k", keyFile, "--rules", "10.0.0.0/8 keep"},
+			Success: false,
+		},
+		{
+			Input:   []string{"reverse", "-k", keyFile},
+			Success: true,
+		},
+		{
+			Input:   []string{"reverse", "-m", "hmac", "-k", keyFile},
+			Success: false,
+		},
+		{
+			Input:   []string{"reverse", "-p", "-k", keyFile},
+			Success: false,
+		},
+		{
+			Input:   []string{"reverse"},
+			Success: false,
+		},
+		{
+			Input:   []string{"-m", "unknown"},
+			Success: false,
+		},
+		{
+			Input:   []string{"-m", "hmac"},
+			Success: false,
+		},
+		{
+			Input:   []string{"-m", "hmac", "-k", shortKeyFile},
+			Success: false,
+		},
+		{
+			Input:   []string{"-m", "hmac", "-k", filepath.Join(tempDir, "missing")},
+			Success: false,
+		},
+	}
+
+	defer func() { os.Args = []string{"anonip"} }()
+
+	for _, tCase := range testMap {
+		t.Run(strings.Join(tCase.Input, " "), func(t *testing.T) {
+			os.Args = append([]string{"anonip"}, tCase.Input...)
+			args, _, err := parseArgs()
+			assert.True(t, err == nil == tCase.Success, "Failed with input: %v", tCase.Input)
+			if err == nil && args.KeyFile != "" {
+				assert.Equal(t, []byte("0123456789abcdef0123456789abcdef"), args.Options().Key)
+			}
+		})
+	}
+}
+
+func TestArgsRules(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "anonipRules")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	rulesFile := filepath.Join(tempDir, "rules")
+	if err := ioutil.WriteFile(rulesFile, []byte("10.0.0.0/8 keep\n"), 0600); err != nil {
+		log.Fatal(err)
+	}
+
 	var testMap = []struct {
-		Input     string
-		Delimiter string
-		Expected  string
+		Input   []string
+		Rules   int
+		Success bool
 	}{
 		{
-			Input:     "192.168.100.200;some;string;with;öéäü",
-			Delimiter: ";",
-			Expected:  "192.168.96.0;some;string;with;öéäü",
+			Input:   []string{"--rules", "10.0.0.0/8 keep", "default mask 12"},
+			Rules:   2,
+			Success: true,
+		},
+		{
+			Input:   []string{"--rules", "default mask 12", "--rules-file", rulesFile},
+			Rules:   2,
+			Success: true,
+		},
+		{
+			Input:   []string{"--rules", "10.0.0.0/8 drop"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--rules-file", filepath.Join(tempDir, "missing")},
+			Success: false,
 		},
 		{
-			Input:     "192.168.100.200 some string with öéäü",
-			Delimiter: ";",
-			Expected:  "192.168.100.200 some string with öéäü",
+			Input:   []string{"reverse", "--rules-file", rulesFile},
+			Success: false,
 		},
 	}
+
+	defer func() { os.Args = []string{"anonip"} }()
+
 	for _, tCase := range testMap {
-		t.Run(tCase.Input, func(t *testing.T) {
-			channel := make(chan string)
-			args := GetDefaultArgs()
-			args.Delimiter = tCase.Delimiter
-			go HandleLine(tCase.Input, args, channel)
-			maskedLine := <-channel
-			assert.Equal(t, maskedLine, tCase.Expected, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		t.Run(strings.Join(tCase.Input, " "), func(t *testing.T) {
+			os.Args = append([]string{"anonip"}, tCase.Input...)
+			args, _, err := parseArgs()
+			assert.True(t, err == nil == tCase.Success, "Failed with input: %v", tCase.Input)
+			if err == nil {
+				assert.Len(t, args.Options().Rules, tCase.Rules)
+			}
 		})
 	}
 }
 
-func TestReplace(t *testing.T) {
-	replaceString := "replaceIt"
+func TestArgsSkip(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "anonipSkip")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	skipFile := filepath.Join(tempDir, "skip")
+	if err := ioutil.WriteFile(skipFile, []byte("5.5.5.5\n"), 0600); err != nil {
+		log.Fatal(err)
+	}
 
 	var testMap = []struct {
-		Input    string
-		Replace  *string
-		Expected string
+		Input   []string
+		Skip    int
+		Success bool
+	}{
+		{
+			Input:   []string{"--skip-cidr", "10.0.0.0/8", "5.5.5.5"},
+			Skip:    2,
+			Success: true,
+		},
+		{
+			Input:   []string{"--skip-cidr", "shared", "--skip-file", skipFile},
+			Skip:    2,
+			Success: true,
+		},
+		{
+			Input:   []string{"--skip-cidr", "nope"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--skip-file", filepath.Join(tempDir, "missing")},
+			Success: false,
+		},
+		{
+			Input:   []string{"reverse", "--skip-file", skipFile},
+			Success: false,
+		},
+	}
+
+	defer func() { os.Args = []string{"anonip"} }()
+
+	for _, tCase := range testMap {
+		t.Run(strings.Join(tCase.Input, " "), func(t *testing.T) {
+			os.Args = append([]string{"anonip"}, tCase.Input...)
+			args, _, err := parseArgs()
+			assert.True(t, err == nil == tCase.Success, "Failed with input: %v", tCase.Input)
+			if err == nil {
+				assert.Len(t, args.Options().Skip, tCase.Skip)
+			}
+		})
+	}
+}
+
+func TestArgsFormat(t *testing.T) {
+	var testMap = []struct {
+		Input   []string
+		Success bool
 	}{
 		{
-			Input:    "some string without IP",
-			Replace:  nil,
-			Expected: "some string without IP",
+			Input:   []string{"-f", "text"},
+			Success: true,
+		},
+		{
+			Input:   []string{"-f", "json", "--field", "client.ip", "--field", "headers.x-forwarded-for"},
+			Success: true,
+		},
+		{
+			Input:   []string{"-f", "json"},
+			Success: false,
+		},
+		{
+			Input:   []string{"-f", "logfmt", "--key", "remote_addr"},
+			Success: true,
+		},
+		{
+			Input:   []string{"-f", "logfmt", "--field", "remote_addr"},
+			Success: false,
+		},
+		{
+			Input:   []string{"-f", "csv", "--column-name", "client", "-c", "2"},
+			Success: true,
+		},
+		{
+			Input:   []string{"-f", "tsv", "--column-name", "client"},
+			Success: true,
+		},
+		{
+			Input:   []string{"-f", "syslog"},
+			Success: true,
+		},
+		{
+			Input:   []string{"-f", "text", "--column-name", "client"},
+			Success: false,
 		},
 		{
-			Input:    "some string without IP",
-			Replace:  &replaceString,
-			Expected: "replaceIt string without IP",
+			Input:   []string{"-f", "yaml"},
+			Success: false,
 		},
 	}
 
+	defer func() { os.Args = []string{"anonip"} }()
+
 	for _, tCase := range testMap {
-		t.Run(tCase.Input, func(t *testing.T) {
-			channel := make(chan string)
-			args := GetDefaultArgs()
-			args.Replace = tCase.Replace
-			go HandleLine(tCase.Input, args, channel)
-			maskedLine := <-channel
-			assert.Equal(t, maskedLine, tCase.Expected, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		t.Run(strings.Join(tCase.Input, " "), func(t *testing.T) {
+			os.Args = append([]string{"anonip"}, tCase.Input...)
+			args, _, err := parseArgs()
+			assert.True(t, err == nil == tCase.Success, "Failed with input: %v", tCase.Input)
+			if err == nil && args.Format == "json" {
+				assert.Equal(t, []string{"client.ip", "headers.x-forwarded-for"}, args.Options().Fields)
+			}
+			if err == nil && args.Format == "tsv" {
+				assert.Empty(t, args.Options().Columns)
+				assert.Equal(t, []string{"client"}, args.Options().ColumnNames)
+			}
 		})
 	}
 }
 
-func TestSkipPrivate(t *testing.T) {
+func TestArgsPreset(t *testing.T) {
 	var testMap = []struct {
-		Input    string
+		Input   []string
+		Success bool
+		Format  string
+	}{
+		{
+			Input:   []string{"--preset", "nginx-combined"},
+			Success: true,
+			Format:  "text",
+		},
+		{
+			Input:   []string{"--preset", "iis-w3c", "--column-name", "c-ip"},
+			Success: true,
+			Format:  "w3c",
+		},
+		{
+			Input:   []string{"--preset", "envoy", "--column-name", "client"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--preset", "lighttpd"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--preset", "envoy", "-f", "json", "--field", "ip"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--preset", "envoy", "-c", "2"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--preset", "envoy", "--regex", "(.*)"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--preset", "envoy", "--scan"},
+			Success: false,
+		},
+	}
+
+	defer func() { os.Args = []string{"anonip"} }()
+
+	for _, tCase := range testMap {
+		t.Run(strings.Join(tCase.Input, " "), func(t *testing.T) {
+			os.Args = append([]string{"anonip"}, tCase.Input...)
+			args, _, err := parseArgs()
+			assert.True(t, err == nil == tCase.Success, "Failed with input: %v", tCase.Input)
+			if err == nil {
+				assert.Equal(t, tCase.Format, args.Format)
+				assert.Equal(t, tCase.Input[1], args.Options().Preset)
+			}
+		})
+	}
+}
+
+func TestMainPcap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "in.pcap")
+	output := filepath.Join(dir, "out.pcap")
+
+	capture := []byte{
+		// pcap header, raw IP
+		0xd4, 0xc3, 0xb2, 0xa1, 2, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0, 0, 101, 0, 0, 0,
+		// record header
+		0, 0, 0, 0, 0, 0, 0, 0, 20, 0, 0, 0, 20, 0, 0, 0,
+		// IPv4 header 1.2.3.4 > 5.6.7.8
+		0x45, 0, 0, 20, 0, 0, 0x40, 0, 0x40, 0, 0x2a, 0xd7, 1, 2, 3, 4, 5, 6, 7, 8,
+	}
+	if err := ioutil.WriteFile(input, capture, 0600); err != nil {
+		log.Fatal(err)
+	}
+	// existing content is replaced
+	if err := ioutil.WriteFile(output, []byte("previous content"), 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	defer func() { os.Args = []string{"anonip"} }()
+	os.Args = []string{"anonip", "pcap", "--input", input, "--output", output}
+	main()
+
+	result, err := ioutil.ReadFile(output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	expected := append([]byte{}, capture...)
+	copy(expected[50:], []byte{0x34, 0xe3, 1, 2, 0, 0, 5, 6, 0, 0})
+	assert.Equal(t, expected, result)
+}
+
+func TestMainCompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, _ = w.Write([]byte("1.2.3.4\n"))
+	_ = w.Close()
+	input := filepath.Join(dir, "access.log.1.gz")
+	if err := ioutil.WriteFile(input, compressed.Bytes(), 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	var testMap = []struct {
+		Input    []string
+		Output   string
 		Expected string
 	}{
 		{
-			Input:    "10.0.0.1",
-			Expected: "10.0.0.1",
+			Input:    []string{"--input", input, "--output", filepath.Join(dir, "access.log")},
+			Output:   "access.log",
+			Expected: anonip.CompressionNone,
+		},
+		{
+			Input:    []string{"--input", input, "--output", filepath.Join(dir, "access.log.zst")},
+			Output:   "access.log.zst",
+			Expected: anonip.CompressionZstd,
 		},
 		{
-			Input:    "3.3.3.3",
-			Expected: "3.3.0.0",
+			Input:    []string{"--input", input, "--output", filepath.Join(dir, "access.log.1"), "--output-compress", "gzip"},
+			Output:   "access.log.1",
+			Expected: anonip.CompressionGzip,
 		},
 		{
-			Input:    "169.254.0.1",
-			Expected: "169.254.0.1",
+			Input:    []string{"--input", input, "--output", filepath.Join(dir, "plain.gz"), "--output-compress", "none"},
+			Output:   "plain.gz",
+			Expected: anonip.CompressionNone,
 		},
 	}
+
+	defer func() { os.Args = []string{"anonip"} }()
+
 	for _, tCase := range testMap {
-		t.Run(tCase.Input, func(t *testing.T) {
-			channel := make(chan string)
-			args := GetDefaultArgs()
-			args.SkipPrivate = true
-			initPrivateIPBlocks()
-			go HandleLine(tCase.Input, args, channel)
-			maskedLine := <-channel
-			assert.Equal(t, maskedLine, tCase.Expected, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		t.Run(strings.Join(tCase.Input, " "), func(t *testing.T) {
+			os.Args = append([]string{"anonip"}, tCase.Input...)
+			main()
+
+			result, err := ioutil.ReadFile(filepath.Join(dir, tCase.Output))
+			if err != nil {
+				log.Fatal(err)
+			}
+			assert.Equal(t, tCase.Expected, anonip.DetectCompression(result))
+			r, err := anonip.NewDecompressingReader(bytes.NewReader(result))
+			assert.NoError(t, err)
+			output, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, "1.2.0.0\n", string(output))
 		})
 	}
 }
 
-func TestFailInitPrivateIPBlocks(t *testing.T) {
-	// patched exit function
-	var got int
-	testOsExit := func(code int) {
-		got = code
+func TestMainCompressFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "truncated.gz")
+	if err := ioutil.WriteFile(input, []byte{0x1f, 0x8b}, 0600); err != nil {
+		log.Fatal(err)
 	}
 
-	// create a copy of the old value
-	oldOsExit := osExit
+	testMap := [][]string{
+		{"--input", input},
+		{"--output-compress", "bzip2"},
+		{"--output-compress", "gzip", "serve", "--listen", "udp://:514", "--forward", "udp://collector:514"},
+	}
 
-	// ignore stderr in order to keep the log clean
 	oldStderr := os.Stderr
 	os.Stderr, _ = os.Open("/dev/null")
-
-	// restore previous state after the test
+	var got int
+	oldOsExit := osExit
+	osExit = func(code int) {
+		got = code
+	}
 	defer func() {
-		osExit = oldOsExit
+		os.Args = []string{"anonip"}
 		os.Stderr = oldStderr
+		osExit = oldOsExit
 	}()
 
-	// reassign osExit
-	osExit = testOsExit
+	for _, tCase := range testMap {
+		t.Run(strings.Join(tCase, " "), func(t *testing.T) {
+			os.Args = append([]string{"anonip"}, tCase...)
+			main()
+			assert.True(t, got == -1, "Expected exit code: -1, got: %d", got)
+			got = 0
+		})
+	}
+}
 
-	privateIPBlocksStrings = []string{
-		"no valid CIDR",
+func TestArgsRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "access.log")
 
-	args := GetDefaultArgs()
-	args.SkipPrivate = true
+	var testMap = []struct {
+		Input   []string
+		Success bool
+		Size    int64
+	}{
+		{
+			Input:   []string{"--output", output, "--rotate-size", "100M", "--rotate-keep", "14", "--rotate-compress", "gzip"},
+			Success: true,
+			Size:    100 << 20,
+		},
+		{
+			Input:   []string{"--output", output, "--rotate-size", " 1g"},
+			Success: true,
+			Size:    1 << 30,
+		},
+		{
+			Input:   []string{"--output", output, "--rotate-size", "512", "--rotate-interval", "24h"},
+			Success: true,
+			Size:    512,
+		},
+		{
+			Input:   []string{"--output", output, "--rotate-interval", "1h", "--output-compress", "none"},
+			Success: true,
+		},
+		{
+			Input:   []string{"--output", output, "--rotate-size", "0"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--output", output, "--rotate-size", "10T"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--output", output, "--rotate-size", "M"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--output", output, "--rotate-interval", "-1h"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--output", output, "--rotate-interval", "1h", "--rotate-keep", "-1"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--output", output, "--rotate-interval", "1h", "--rotate-compress", "bzip2"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--output", output + ".gz", "--rotate-interval", "1h"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--output", filepath.Join(dir, "missing", "access.log"), "--rotate-interval", "1h"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--rotate-interval", "1h"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--output", output, "--rotate-keep", "14"},
+			Success: false,
+		},
+		{
+			Input:   []string{"pcap", "--output", output, "--rotate-size", "100M"},
+			Success: false,
+		},
+	}
 
-	Run(args)
+	defer func() { os.Args = []string{"anonip"} }()
 
-	assert.True(t, got == 2, "Expected exit code: 2, got: %d", got)
+	for _, tCase := range testMap {
+		t.Run(strings.Join(tCase.Input, " "), func(t *testing.T) {
+			os.Args = append([]string{"anonip"}, tCase.Input...)
+			args, _, err := parseArgs()
+			assert.True(t, err == nil == tCase.Success, "Failed with input: %v", tCase.Input)
+			if err == nil {
+				size, _ := parseSize(args.RawRotateSize)
+				assert.Equal(t, tCase.Size, size)
+				assert.NoError(t, args.OutputFile.Close())
+			}
+		})
+	}
 }
 
-func TestRegexMatching(t *testing.T) {
+func TestMainRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "input.log")
+	if err := ioutil.WriteFile(input, []byte("1.2.3.4\n3.4.5.6\n5.6.7.8\n"), 0600); err != nil {
+		log.Fatal(err)
+	}
+	output := filepath.Join(dir, "access.log")
+
+	defer func() { os.Args = []string{"anonip"} }()
+	os.Args = []string{"anonip", "--input", input, "--output", output, "--rotate-size", "10", "--rotate-keep", "1", "--rotate-compress", "zstd"}
+	main()
+
+	result, err := ioutil.ReadFile(output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(t, "5.6.0.0\n", string(result))
+	rotated, err := filepath.Glob(output + ".*")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if assert.Len(t, rotated, 1) {
+		assert.Equal(t, ".zst", filepath.Ext(rotated[0]))
+		result, err = ioutil.ReadFile(rotated[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		r, err := anonip.NewDecompressingReader(bytes.NewReader(result))
+		assert.NoError(t, err)
+		content, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "3.4.0.0\n", string(content))
+	}
+}
+
+func TestArgsFlush(t *testing.T) {
 	var testMap = []struct {
-		Input    string
-		Expected string
-		Regex    []string
+		Input    []string
+		Success  bool
+		Interval time.Duration
+		Lines    int
 	}{
 		{
-			Input:    "3.3.3.3 - - [20/May/2015:21:05:01 +0000] \"GET / HTTP/1.1\" 200 13358 \"-\" \"useragent\"\n",
-			Expected: "3.3.0.0 - - [20/May/2015:21:05:01 +0000] \"GET / HTTP/1.1\" 200 13358 \"-\" \"useragent\"\n",
-			Regex:    []string{"(?:^(.*) - - )", "^(.*) - somefixedstring: (.*) - .* - (.*)"},
+			Input:    []string{},
+			Success:  true,
+			Interval: time.Second,
 		},
 		{
-			Input:    "1.1.1.1 - somefixedstring: 2.2.2.2 - some random stuff - 3.3.3.3",
-			Expected: "1.1.0.0 - somefixedstring: 2.2.0.0 - some random stuff - 3.3.0.0",
-			Regex:    []string{"(?:^(.*) - - )", "^(.*) - somefixedstring: (.*) - .* - (.*)"},
+			Input:    []string{"--flush-interval", "100ms", "--flush-lines", "1000"},
+			Success:  true,
+			Interval: 100 * time.Millisecond,
+			Lines:    1000,
 		},
 		{
-			Input:    "blabla/ 3.3.3.3 /blublu",
-			Expected: "blabla/ 3.3.0.0 /blublu",
-			Regex:    []string{"^blabla/ (.*) /blublu$"},
+			Input:   []string{"--flush-interval", "-1s"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--flush-lines", "-1"},
+			Success: false,
 		},
 	}
 
+	defer func() { os.Args = []string{"anonip"} }()
+
 	for _, tCase := range testMap {
-		t.Run(tCase.Input, func(t *testing.T) {
-			channel := make(chan string)
-			args := GetDefaultArgs()
-			args.Regex = regexp.MustCompile(strings.Join(tCase.Regex, "|"))
-			go HandleLine(tCase.Input, args, channel)
-			maskedLine := <-channel
-			assert.Equal(t, maskedLine, tCase.Expected, "Failing input: %+v\nReceived output: \"%v\"", tCase, maskedLine)
+		t.Run(strings.Join(tCase.Input, " "), func(t *testing.T) {
+			os.Args = append([]string{"anonip"}, tCase.Input...)
+			args, _, err := parseArgs()
+			assert.True(t, err == nil == tCase.Success, "Failed with input: %v", tCase.Input)
+			if err == nil {
+				assert.Equal(t, tCase.Interval, args.FlushInterval)
+				assert.Equal(t, tCase.Lines, args.FlushLines)
+			}
 		})
 	}
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/open-dynaMIX/anonip-go/anonip"
+)
+
+// InputFile is a file to anonymize. Name is its path relative to the
+// directory or glob it was found by, and is used below --output-dir.
+type InputFile struct {
+	Path string
+	Name string
+}
+
+// runFunc anonymizes r to w, this is Run or RunPcap
+type runFunc func(*anonip.Anonymizer, io.Reader, io.Writer) error
+
+// globBase returns the directory of pattern up to the first meta character
+func globBase(pattern string) string {
+	return filepath.Dir(pattern[:strings.IndexAny(pattern, "*?[")])
+}
+
+// expandInput returns the files of an --input, which may be a file, a glob or
+// a directory, which is descended into recursively. Only regular files are
+// taken from globs and directories, while a file named explicitly may also
+// be a FIFO.
+func expandInput(pattern string) ([]InputFile, error) {
+	roots := []string{pattern}
+	glob := strings.ContainsAny(pattern, "*?[")
+	if glob {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.New("invalid pattern: " + pattern)
+		}
+		roots = matches
+	}
+
+	var files []InputFile
+	for _, root := range roots {
+		base := root
+		if glob {
+			base = globBase(pattern)
+		}
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// follows symbolic links to files
+			info, err := os.Stat(path)
+			if err != nil || info.IsDir() || !info.Mode().IsRegular() && (glob || path != root) {
+				return nil
+			}
+			name := filepath.Base(path)
+			if path != base {
+				// both are relative or both are absolute
+				name, _ = filepath.Rel(base, path)
+			}
+			files = append(files, InputFile{Path: path, Name: name})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no files found: " + pattern)
+	}
+	return files, nil
+}
+
+// outputFlag returns the flags output files are opened with
+func (args *Args) outputFlag() int {
+	if args.Pcap != nil {
+		// capture files can't be appended to
+		return os.O_WRONLY | os.O_TRUNC | os.O_CREATE
+	}
+	return os.O_RDWR | os.O_APPEND | os.O_CREATE
+}
+
+// outputCompression returns the compression by --output-compress or, if not
+// given, by the extension of the output file name
+func (args *Args) outputCompression(name string) string {
+	if args.Compress != "" {
+		return args.Compress
+	}
+	return anonip.CompressionByExtension(name)
+}
+
+// buffered buffers writes to w as --flush-interval and --flush-lines say
+func (args *Args) buffered(w io.Writer) *anonip.BufferedWriter {
+	return anonip.NewBufferedWriter(w, anonip.FlushOptions{
+		Interval: args.FlushInterval,
+		Lines:    args.FlushLines,
+	})
+}
+
+// runBuffered runs r through a buffer to w, which is flushed at the end
+func runBuffered(args Args, anonymizer *anonip.Anonymizer, r io.Reader, w io.Writer, run runFunc) error {
+	output := args.buffered(w)
+	if err := run(anonymizer, r, output); err != nil {
+		return err
+	}
+	return output.Flush()
+}
+
+// compressor wraps w to compress like outputCompression says
+func (args *Args) compressor(w io.Writer, name string) io.WriteCloser {
+	// the compression has been validated already
+	compressor, _ := anonip.NewCompressingWriter(w, args.outputCompression(name))
+	return compressor
+}
+
+// runFiles anonymizes all input files. With --output-dir or --in-place, up to
+// --jobs files are processed concurrently, each into its own output file.
+// Otherwise, they are written to the output one after another. A failing file
+// does not stop the others from being processed. Once stopped by a signal,
+// reading the files being processed ends and the remaining ones are skipped.
+func runFiles(args Args, run runFunc) error {
+	jobs := 1
+	if args.OutputDir != "" || args.InPlace {
+		jobs = args.Jobs
+	}
+	inputs := make(chan InputFile)
+	stop := make(chan struct{})
+	var mutex sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for input := range inputs {
+				if err := anonymizeFile(args, input, run, stop); err != nil {
+					mutex.Lock()
+					errs = append(errs, errors.New(input.Path+": "+err.Error()))
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	defer handleSignals(args, nil, func() { close(stop) })()
+feed:
+	for _, input := range args.Inputs {
+		select {
+		case <-stop:
+			break feed
+		case inputs <- input:
+		}
+	}
+	close(inputs)
+	wg.Wait()
+
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	for _, err := range errs {
+		logError(err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d input files failed", len(errs), len(args.Inputs))
+	}
+	return nil
+}
+
+// anonymizeFile anonymizes a single input file, decompressing it if needed.
+// Every file gets its own anonymizer, as CSV headers and W3C directives only
+// apply to the file they are found in. Once stop is closed, reading ends,
+// unless the file is replaced in place, which would lose its remaining lines.
+func anonymizeFile(args Args, input InputFile, run runFunc, stop <-chan struct{}) error {
+	anonymizer, err := anonip.New(args.Options())
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(input.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := anonip.NewDecompressingReader(file)
+	if err != nil {
+		return err
+	}
+	if args.InPlace {
+		defer reader.Close()
+		return anonymizeInPlace(args, input, file, func(w io.Writer) error {
+			return runBuffered(args, anonymizer, reader, w, run)
+		})
+	}
+
+	stoppable := newStoppableReader(reader, func() {})
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			stoppable.Stop()
+		case <-finished:
+		}
+	}()
+	defer func() {
+		close(finished)
+		// a read abandoned by stopping ends once the file is closed
+		_ = file.Close()
+		stoppable.Wait()
+		_ = reader.Close()
+	}()
+	if args.OutputDir == "" {
+		return runBuffered(args, anonymizer, stoppable, args.Output, run)
+	}
+
+	path := filepath.Join(args.OutputDir, input.Name)
+	if info, err := os.Stat(path); err == nil {
+		if inputInfo, _ := file.Stat(); os.SameFile(info, inputInfo) {
+			return errors.New("output file is the input file")
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return err
+	}
+	output, err := os.OpenFile(path, args.outputFlag(), 0660)
+	if err != nil {
+		return err
+	}
+	compressor := args.compressor(output, path)
+	err = runBuffered(args, anonymizer, stoppable, compressor, run)
+	if err == nil {
+		err = compressor.Close()
+	}
+	if err == nil {
+		err = output.Sync()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// anonymizeInPlace replaces an input file by the output of run, compressed
+// like the input unless --output-compress is given
+func anonymizeInPlace(args Args, input InputFile, file *os.File, run func(io.Writer) error) error {
+	compression := args.Compress
+	if compression == "" {
+		header := make([]byte, 6)
+		n, _ := file.ReadAt(header, 0)
+		compression = anonip.DetectCompression(header[:n])
+	}
+	return anonip.ReplaceFile(input.Path, args.BackupSuffix, func(w io.Writer) error {
+		compressor, err := anonip.NewCompressingWriter(w, compression)
+		if err != nil {
+			return err
+		}
+		if err := run(compressor); err != nil {
+			return err
+		}
+		return compressor.Close()
+	})
+}
+
+// follow anonymizes the input file and everything appended to it, until the
+// process is stopped. It is not decompressed, as it is still being written.
+// With --state-file, it continues after the last line written before. The
+// output is flushed whenever the input is idle.
+func follow(anonymizer *anonip.Anonymizer, args Args) error {
+	path := args.Inputs[0].Path
+	var follower *anonip.Follower
+	var err error
+	if args.StateFile == "" {
+		follower, err = anonip.Follow(path, anonip.DefaultPollInterval)
+	} else {
+		follower, err = anonip.Resume(path, anonip.DefaultPollInterval, args.StateFile)
+	}
+	if err != nil {
+		return err
+	}
+	// lines only count as written once flushed
+	output := args.buffered(follower.Output(args.Output))
+	input := newStoppableReader(follower, func() { _ = output.Flush() })
+	handled := handleSignals(args, follower.Reopen, follower.Stop)
+	err = anonymizer.Run(input, output)
+	if err == nil {
+		err = output.Flush()
+	}
+	handled()
+	if closeErr := follower.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/open-dynaMIX/anonip-go/anonip"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeLogs creates a directory of logs: a.log, b.log.gz and sub/c.log
+func writeLogs() string {
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		log.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, _ = w.Write([]byte("3.4.5.6\n"))
+	_ = w.Close()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		log.Fatal(err)
+	}
+	for name, content := range map[string][]byte{
+		"a.log":     []byte("1.2.3.4\n"),
+		"b.log.gz":  compressed.Bytes(),
+		"sub/c.log": []byte("5.6.7.8\n"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestArgsInput(t *testing.T) {
+	dir := writeLogs()
+	defer os.RemoveAll(dir)
+	empty := filepath.Join(dir, "empty")
+	if err := os.Mkdir(empty, 0700); err != nil {
+		log.Fatal(err)
+	}
+
+	var testMap = []struct {
+		Input    []string
+		Success  bool
+		Expected []string
+	}{
+		{
+			Input:    []string{"--input", dir},
+			Success:  true,
+			Expected: []string{"a.log", "b.log.gz", "sub/c.log"},
+		},
+		{
+			Input:    []string{"--input", filepath.Join(dir, "*.log*")},
+			Success:  true,
+			Expected: []string{"a.log", "b.log.gz"},
+		},
+		{
+			Input:    []string{"--input", filepath.Join(dir, "*"), "--output-dir", dir},
+			Success:  true,
+			Expected: []string{"a.log", "b.log.gz", "sub/c.log"},
+		},
+		{
+			Input:    []string{"--input", filepath.Join(dir, "sub", "c.log"), "--input", filepath.Join(dir, "s*", "*")},
+			Success:  true,
+			Expected: []string{"c.log"},
+		},
+		{
+			Input:    []string{"pcap", "--input", filepath.Join(dir, "*.log*"), "--output-dir", dir},
+			Success:  true,
+			Expected: []string{"a.log", "b.log.gz"},
+		},
+		{
+			Input:    []string{"pcap", "--input", filepath.Join(dir, "*.log*"), "--in-place", "--backup-suffix", ".orig"},
+			Success:  true,
+			Expected: []string{"a.log", "b.log.gz"},
+		},
+		{
+			Input:    []string{"--input", filepath.Join(dir, "a.log"), "--follow"},
+			Success:  true,
+			Expected: []string{"a.log"},
+		},
+		{
+			Input:    []string{"--input", filepath.Join(dir, "a.log"), "--follow", "--state-file", filepath.Join(dir, "state.json"), "--output-compress", "none"},
+			Success:  true,
+			Expected: []string{"a.log"},
+		},
+		{
+			Input:   []string{"--follow"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--input", filepath.Join(dir, "a.log"), "--state-file", filepath.Join(dir, "state.json")},
+			Success: false,
+		},
+		{
+			Input:   []string{"--input", filepath.Join(dir, "a.log"), "--follow", "--state-file", filepath.Join(dir, "state.json"), "--output", filepath.Join(dir, "out.log.gz")},
+			Success: false,
+		},
+		{
+			Input:   []string{"--input", dir, "--follow"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--input", filepath.Join(dir, "a.log"), "--follow", "--output-dir", dir},
+			Success: false,
+		},
+		{
+			Input:   []string{"pcap", "--input", filepath.Join(dir, "a.log"), "--follow"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--in-place"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--input", dir, "--in-place", "--output-dir", dir},
+			Success: false,
+		},
+		{
+			Input:   []string{"--input", dir, "--backup-suffix", ".orig"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--input", filepath.Join(dir, "[")},
+			Success: false,
+		},
+		{
+			Input:   []string{"--input", filepath.Join(dir, "missing")},
+			Success: false,
+		},
+		{
+			Input:   []string{"--input", filepath.Join(dir, "*.txt")},
+			Success: false,
+		},
+		{
+			Input:   []string{"--input", empty},
+			Success: false,
+		},
+		{
+			Input:   []string{"--input", dir, "--output-dir", dir, "--output", filepath.Join(dir, "out.log")},
+			Success: false,
+		},
+		{
+			Input:   []string{"--output-dir", dir},
+			Success: false,
+		},
+		{
+			Input:    []string{"--input", filepath.Join(dir, "a.log"), "--input", dir + "/sub/../a.log"},
+			Success:  true,
+			Expected: []string{"a.log", "a.log"},
+		},
+		{
+			Input:   []string{"--input", filepath.Join(dir, "a.log"), "--input", dir + "/sub/../a.log", "--output-dir", dir},
+			Success: false,
+		},
+		{
+			Input:   []string{"pcap", "--input", filepath.Join(dir, "*.log*")},
+			Success: false,
+		},
+		{
+			Input:   []string{"--input", dir, "-j", "-1"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--output-dir", dir, "serve", "--listen", "udp://:514", "--forward", "udp://collector:514"},
+			Success: false,
+		},
+	}
+
+	defer func() { os.Args = []string{"anonip"} }()
+
+	for _, tCase := range testMap {
+		t.Run(strings.Join(tCase.Input, " "), func(t *testing.T) {
+			os.Args = append([]string{"anonip"}, tCase.Input...)
+			args, _, err := parseArgs()
+			assert.True(t, err == nil == tCase.Success, "Failed with input: %v", tCase.Input)
+			if err == nil {
+				var names []string
+				for _, input := range args.Inputs {
+					names = append(names, filepath.ToSlash(input.Name))
+				}
+				assert.Equal(t, tCase.Expected, names)
+				assert.Equal(t, runtime.NumCPU(), args.Jobs)
+			}
+		})
+	}
+}
+
+func TestMainInputs(t *testing.T) {
+	dir := writeLogs()
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "out")
+
+	defer func() { os.Args = []string{"anonip"} }()
+
+	// one output per input
+	os.Args = []string{"anonip", "--input", dir, "--output-dir", output, "-j", "2"}
+	main()
+	for name, expected := range map[string]string{
+		"a.log":     "1.2.0.0\n",
+		"b.log.gz":  "3.4.0.0\n",
+		"sub/c.log": "5.6.0.0\n",
+	} {
+		result, err := ioutil.ReadFile(filepath.Join(output, name))
+		if err != nil {
+			log.Fatal(err)
+		}
+		assert.Equal(t, anonip.CompressionByExtension(name), anonip.DetectCompression(result))
+		r, err := anonip.NewDecompressingReader(bytes.NewReader(result))
+		assert.NoError(t, err)
+		content, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+
+	// a combined output, in order
+	combined := filepath.Join(output, "combined.log")
+	os.Args = []string{"anonip", "--input", filepath.Join(dir, "sub"), "--input", filepath.Join(dir, "*.log*"), "--output", combined}
+	main()
+	result, err := ioutil.ReadFile(combined)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(t, "5.6.0.0\n1.2.0.0\n3.4.0.0\n", string(result))
+}
+
+func TestRunFilesFail(t *testing.T) {
+	dir := writeLogs()
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "truncated.gz"), []byte{0x1f, 0x8b}, 0600); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "existing", "a.log"), 0700); err != nil {
+		log.Fatal(err)
+	}
+
+	oldStderr := os.Stderr
+	os.Stderr, _ = os.Open("/dev/null")
+	defer func() {
+		os.Args = []string{"anonip"}
+		os.Stderr = oldStderr
+	}()
+
+	parse := func(input ...string) Args {
+		os.Args = append([]string{"anonip"}, input...)
+		args, _, err := parseArgs()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return args
+	}
+	run := (*anonip.Anonymizer).Run
+
+	args := parse("--input", filepath.Join(dir, "a.log"))
+	args.IPV4Mask = 33
+	assert.Error(t, runFiles(args, run))
+
+	for _, input := range [][]string{
+		{"--input", filepath.Join(dir, "truncated.gz")},
+		{"--input", filepath.Join(dir, "a.log"), "--output-dir", dir},
+		{"--input", filepath.Join(dir, "sub"), "--output-dir", filepath.Join(dir, "a.log")},
+		{"--input", filepath.Join(dir, "a.log"), "--output-dir", filepath.Join(dir, "existing")},
+	} {
+		t.Run(strings.Join(input, " "), func(t *testing.T) {
+			assert.Error(t, runFiles(parse(input...), run))
+		})
+	}
+
+	args = parse("--input", filepath.Join(dir, "*.gz"), "--input", filepath.Join(dir, "sub"), "--output", os.DevNull)
+	if err := os.Remove(filepath.Join(dir, "sub", "c.log")); err != nil {
+		log.Fatal(err)
+	}
+	err := runFiles(args, run)
+	assert.EqualError(t, err, "2 of 3 input files failed")
+}
+
+func TestMainInPlace(t *testing.T) {
+	dir := writeLogs()
+	defer os.RemoveAll(dir)
+	// "7.8.9.10\n" compressed with bzip2
+	compressed := []byte{0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x09, 0x82, 0x61, 0xbf, 0x00, 0x00, 0x03, 0x58, 0x00, 0x00, 0x10, 0x00, 0x01, 0x60, 0xe0, 0x20, 0x00, 0x31, 0x0c, 0x01, 0x00, 0x7e, 0xa9, 0x6e, 0x0a, 0x8f, 0x17, 0x72, 0x45, 0x38, 0x50, 0x90, 0x09, 0x82, 0x61, 0xbf}
+	bzip2 := filepath.Join(dir, "d.log.bz2")
+	if err := ioutil.WriteFile(bzip2, compressed, 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	oldStderr := os.Stderr
+	os.Stderr, _ = os.Open("/dev/null")
+	var got int
+	oldOsExit := osExit
+	osExit = func(code int) {
+		got = code
+	}
+	defer func() {
+		os.Args = []string{"anonip"}
+		os.Stderr = oldStderr
+		osExit = oldOsExit
+	}()
+
+	os.Args = []string{"anonip", "--input", dir, "--in-place", "--backup-suffix", ".orig"}
+	main()
+	// bzip2 can't be written
+	assert.Equal(t, -1, got)
+
+	for name, expected := range map[string]string{
+		"a.log":          "1.2.0.0\n",
+		"a.log.orig":     "1.2.3.4\n",
+		"b.log.gz":       "3.4.0.0\n",
+		"b.log.gz.orig":  "3.4.5.6\n",
+		"sub/c.log":      "5.6.0.0\n",
+		"sub/c.log.orig": "5.6.7.8\n",
+	} {
+		result, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the compression is kept
+		assert.Equal(t, anonip.CompressionByExtension(strings.TrimSuffix(name, ".orig")), anonip.DetectCompression(result))
+		r, err := anonip.NewDecompressingReader(bytes.NewReader(result))
+		assert.NoError(t, err)
+		content, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+
+	// a failure leaves the file untouched
+	os.Args = []string{"anonip", "pcap", "--input", filepath.Join(dir, "a.log"), "--in-place"}
+	got = 0
+	main()
+	assert.Equal(t, -1, got)
+	result, err := ioutil.ReadFile(filepath.Join(dir, "a.log"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(t, "1.2.0.0\n", string(result))
+
+	os.Args = []string{"anonip", "--input", bzip2, "--in-place", "--output-compress", "gzip"}
+	got = 0
+	main()
+	assert.Equal(t, 0, got)
+	result, err = ioutil.ReadFile(bzip2)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(t, anonip.CompressionGzip, anonip.DetectCompression(result))
+	r, err := anonip.NewDecompressingReader(bytes.NewReader(result))
+	assert.NoError(t, err)
+	content, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "7.8.0.0\n", string(content))
+}
+
+// waitForFile waits for the file at path to have the expected content
+func waitForFile(t *testing.T, path string, expected string) {
+	var result []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		result, _ = ioutil.ReadFile(path)
+		if string(result) == expected {
+			break
+		}
+	}
+	assert.Equal(t, expected, string(result))
+}
+
+func TestRunFollow(t *testing.T) {
+	dir := writeLogs()
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "a.log")
+	output := filepath.Join(dir, "out.log")
+	state := filepath.Join(dir, "state.json")
+
+	var got int
+	oldOsExit := osExit
+	oldStderr := os.Stderr
+	os.Stderr, _ = os.Open("/dev/null")
+	defer func() {
+		os.Args = []string{"anonip"}
+		osExit = oldOsExit
+		os.Stderr = oldStderr
+	}()
+	osExit = func(code int) {
+		got = code
+	}
+	appendInput := func(line string) {
+		file, err := os.OpenFile(input, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, _ = file.WriteString(line)
+		_ = file.Close()
+	}
+
+	os.Args = []string{"anonip", "--input", input, "--follow", "--output", output, "--state-file", state}
+	args, _, err := parseArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// runs until stopped
+	done := make(chan struct{})
+	go func() {
+		Run(args)
+		close(done)
+	}()
+	appendInput("3.4.5.6\n")
+	waitForFile(t, output, "1.2.0.0\n3.4.0.0\n")
+	signals <- syscall.SIGHUP
+	signals <- syscall.SIGTERM
+	<-done
+	assert.Equal(t, 0, got)
+
+	// resumes after the last line written
+	appendInput("5.6.7.8\n")
+	os.Args = []string{"anonip", "--input", input, "--follow", "--output", output, "--state-file", state}
+	args, _, err = parseArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	done = make(chan struct{})
+	go func() {
+		Run(args)
+		close(done)
+	}()
+	waitForFile(t, output, "1.2.0.0\n3.4.0.0\n5.6.0.0\n")
+	signals <- syscall.SIGINT
+	<-done
+	assert.Equal(t, 0, got)
+
+	// the input is gone before it is opened
+	if err := os.Remove(input); err != nil {
+		log.Fatal(err)
+	}
+	args.StateFile = ""
+	Run(args)
+	assert.Equal(t, -1, got)
+}
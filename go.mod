@@ -1,8 +1,17 @@
 module github.com/open-dynaMIX/anonip-go
 
-go 1.15
+go 1.22
 
 require (
 	github.com/alexflint/go-arg v1.3.0
+	github.com/klauspost/compress v1.18.0
 	github.com/stretchr/testify v1.6.1
+	github.com/ulikunitz/xz v0.5.15
+)
+
+require (
+	github.com/alexflint/go-scalar v1.0.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+
+	"github.com/open-dynaMIX/anonip-go/anonip"
+)
+
+// ServeCmd receives syslog messages over the network and forwards them
+// anonymized. It shares all anonymization options with the top-level command.
+type ServeCmd struct {
+	Listen           []string    `arg:"--listen,separate,required,env:ANONIP_LISTEN" placeholder:"URL" help:"receive syslog messages on udp://HOST:PORT, tcp://HOST:PORT or tls://HOST:PORT. Can be given multiple times"`
+	Forward          string      `arg:"--forward,required,env:ANONIP_FORWARD" placeholder:"URL" help:"forward anonymized messages to udp://HOST:PORT, tcp://HOST:PORT or tls://HOST:PORT"`
+	TLSCert          string      `arg:"--tls-cert,env:ANONIP_TLS_CERT" placeholder:"FILE" help:"certificate for tls:// listeners"`
+	TLSKey           string      `arg:"--tls-key,env:ANONIP_TLS_KEY" placeholder:"FILE" help:"private key for tls:// listeners"`
+	TLSCA            string      `arg:"--tls-ca,env:ANONIP_TLS_CA" placeholder:"FILE" help:"CA certificates to verify a tls:// destination [default: system roots]"`
+	QueueSize        int         `arg:"--queue-size,env:ANONIP_QUEUE_SIZE" default:"10000" placeholder:"INTEGER" help:"number of messages to buffer while the destination is slow or unavailable"`
+	TLSConfig        *tls.Config `arg:"-"`
+	ForwardTLSConfig *tls.Config `arg:"-"`
+}
+
+func (args *Args) validateServe() error {
+	if args.Serve == nil {
+		return nil
+	}
+	if len(args.RawInput) > 0 || args.RawOutput != "" || args.OutputDir != "" || args.Compress != "" {
+		return errors.New("serve: --input, --output, --output-dir and --output-compress are not supported")
+	}
+	if args.Serve.QueueSize < 1 {
+		return errors.New("argument --queue-size: must be an integer greater than 0")
+	}
+	if (args.Serve.TLSCert == "") != (args.Serve.TLSKey == "") {
+		return errors.New("argument --tls-cert: must be given together with --tls-key")
+	}
+	if args.Serve.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(args.Serve.TLSCert, args.Serve.TLSKey)
+		if err != nil {
+			return errors.New("argument --tls-cert: " + err.Error())
+		}
+		args.Serve.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if args.Serve.TLSCA != "" {
+		pem, err := ioutil.ReadFile(args.Serve.TLSCA)
+		if err != nil {
+			return errors.New("argument --tls-ca: " + err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("argument --tls-ca: no certificates found")
+		}
+		args.Serve.ForwardTLSConfig = &tls.Config{RootCAs: pool}
+	}
+	// network messages are syslog, unless told otherwise
+	if args.Format == anonip.FormatText && args.Preset == "" {
+		args.Format = anonip.FormatSyslog
+	}
+	return nil
+}
+
+// validateServeFormat rejects formats that take the columns from a header line
+// or a directive, as all connections share a single Anonymizer
+func (args *Args) validateServeFormat() error {
+	switch {
+	case args.Serve == nil:
+		return nil
+	case args.Format == anonip.FormatW3C && args.Preset != "":
+		return errors.New("argument --preset: " + args.Preset + " is not supported by serve")
+	case args.Format == anonip.FormatW3C:
+		return errors.New("argument -f/--format: " + args.Format + " is not supported by serve")
+	case len(args.ColumnNames) > 0:
+		return errors.New("argument --column-name: not supported by serve")
+	}
+	return nil
+}
+
+// ServerOptions converts the parsed arguments of the serve command into
+// server options
+func (args *Args) ServerOptions() anonip.ServerOptions {
+	return anonip.ServerOptions{
+		Listen:           args.Serve.Listen,
+		Forward:          args.Serve.Forward,
+		TLSConfig:        args.Serve.TLSConfig,
+		ForwardTLSConfig: args.Serve.ForwardTLSConfig,
+		QueueSize:        args.Serve.QueueSize,
+	}
+}
+
+func serve(anonymizer *anonip.Anonymizer, args Args) error {
+	server, err := anonip.NewServer(anonymizer, args.ServerOptions())
+	if err != nil {
+		return err
+	}
+	defer handleSignals(args, nil, server.Close)()
+	return server.Serve()
+}
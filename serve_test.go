@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCertificate writes a self-signed certificate and its key to dir
+func writeCertificate(dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		log.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestArgsServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(dir)
+
+	var testMap = []struct {
+		Input   []string
+		Success bool
+		Format  string
+	}{
+		{
+			Input:   []string{"serve", "--listen", "udp://:514", "--listen", "tcp://:601", "--forward", "tcp://collector:601"},
+			Success: true,
+			Format:  "syslog",
+		},
+		{
+			Input:   []string{"-f", "json", "--field", "ip", "serve", "--listen", "udp://:514", "--forward", "tcp://collector:601"},
+			Success: true,
+			Format:  "json",
+		},
+		{
+			Input:   []string{"serve", "--listen", "tls://:6514", "--forward", "tls://collector:6514", "--tls-cert", certFile, "--tls-key", keyFile, "--tls-ca", certFile},
+			Success: true,
+			Format:  "syslog",
+		},
+		{
+			Input:   []string{"serve", "--listen", "tls://:6514", "--forward", "tcp://collector:601", "--tls-cert", certFile},
+			Success: false,
+		},
+		{
+			Input:   []string{"serve", "--listen", "tls://:6514", "--forward", "tcp://collector:601", "--tls-cert", keyFile, "--tls-key", keyFile},
+			Success: false,
+		},
+		{
+			Input:   []string{"serve", "--listen", "udp://:514", "--forward", "tls://collector:6514", "--tls-ca", keyFile},
+			Success: false,
+		},
+		{
+			Input:   []string{"serve", "--listen", "udp://:514", "--forward", "tls://collector:6514", "--tls-ca", filepath.Join(dir, "missing")},
+			Success: false,
+		},
+		{
+			Input:   []string{"serve", "--listen", "udp://:514", "--forward", "tcp://collector:601", "--queue-size", "0"},
+			Success: false,
+		},
+		{
+			Input:   []string{"-f", "csv", "serve", "--listen", "udp://:514", "--forward", "tcp://collector:601"},
+			Success: true,
+			Format:  "csv",
+		},
+		{
+			Input:   []string{"-f", "csv", "--column-name", "ip", "serve", "--listen", "udp://:514", "--forward", "tcp://collector:601"},
+			Success: false,
+		},
+		{
+			Input:   []string{"-f", "w3c", "serve", "--listen", "udp://:514", "--forward", "tcp://collector:601"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--preset", "iis-w3c", "serve", "--listen", "udp://:514", "--forward", "tcp://collector:601"},
+			Success: false,
+		},
+		{
+			Input:   []string{"--output", filepath.Join(dir, "out"), "serve", "--listen", "udp://:514", "--forward", "tcp://collector:601"},
+			Success: false,
+		},
+	}
+
+	defer func() { os.Args = []string{"anonip"} }()
+
+	for _, tCase := range testMap {
+		t.Run(strings.Join(tCase.Input, " "), func(t *testing.T) {
+			os.Args = append([]string{"anonip"}, tCase.Input...)
+			args, _, err := parseArgs()
+			assert.True(t, err == nil == tCase.Success, "Failed with input: %v", tCase.Input)
+			if err == nil {
+				assert.Equal(t, tCase.Format, args.Format)
+				assert.Equal(t, tCase.Input[len(tCase.Input)-1] == certFile, args.ServerOptions().ForwardTLSConfig != nil)
+			}
+		})
+	}
+}
+
+func TestRunServe(t *testing.T) {
+	var got int
+	oldOsExit := osExit
+	oldStderr := os.Stderr
+	os.Stderr, _ = os.Open("/dev/null")
+	defer func() {
+		osExit = oldOsExit
+		os.Stderr = oldStderr
+	}()
+	osExit = func(code int) {
+		got = code
+	}
+
+	args := GetDefaultArgs()
+	args.Format = "syslog"
+	args.Serve = &ServeCmd{Listen: []string{"tcp://127.0.0.1:-1"}, Forward: "tcp://127.0.0.1:601"}
+	Run(args)
+	assert.Equal(t, -1, got)
+
+	// runs until stopped
+	got = 0
+	args.Serve = &ServeCmd{Listen: []string{"udp://127.0.0.1:0"}, Forward: "tcp://127.0.0.1:601"}
+	done := make(chan struct{})
+	go func() {
+		Run(args)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	signals <- syscall.SIGTERM
+	<-done
+	assert.Equal(t, 0, got)
+}
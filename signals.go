@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/open-dynaMIX/anonip-go/anonip"
+)
+
+// signals receives the signals handled while running, tests send to it
+// directly
+var signals = make(chan os.Signal, 1)
+
+// handleSignals reopens the output and calls reopen on SIGHUP. On SIGTERM or
+// SIGINT, it calls stop once, which ends the reading of input, so the lines
+// read so far are still written before anonip exits. The returned function
+// ends the handling.
+func handleSignals(args Args, reopen func() error, stop func()) func() {
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		stopped := false
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-signals:
+				switch {
+				case sig == syscall.SIGHUP:
+					if err := args.reopen(reopen); err != nil {
+						logError(err)
+					}
+				case !stopped:
+					stopped = true
+					stop()
+				}
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+		<-finished
+	}
+}
+
+// reopen reopens --output, unless it is compressed or a capture file, which
+// can't be continued in a new file. Then it calls input, if given.
+func (args *Args) reopen(input func() error) error {
+	if args.OutputFile != nil && args.Pcap == nil && args.outputCompression(args.RawOutput) == anonip.CompressionNone {
+		if err := args.OutputFile.Reopen(); err != nil {
+			return err
+		}
+	}
+	if input != nil {
+		return input()
+	}
+	return nil
+}
+
+// outputFile is the file --output is written to
+type outputFile interface {
+	io.WriteCloser
+	// Reopen reopens the file by its name, e.g. after logrotate moved it
+	Reopen() error
+}
+
+// reopenFile is an --output file without rotation
+type reopenFile struct {
+	name  string
+	flag  int
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func (f *reopenFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Write(p)
+}
+
+func (f *reopenFile) Reopen() error {
+	file, err := os.OpenFile(f.name, f.flag&^os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_ = f.file.Close()
+	f.file = file
+	return nil
+}
+
+// Close syncs the file to disk, if it is a regular file, and closes it
+func (f *reopenFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var err error
+	if info, statErr := f.file.Stat(); statErr == nil && info.Mode().IsRegular() {
+		err = f.file.Sync()
+	}
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// stoppableReader reads from r until it is stopped, which also ends a read
+// that is blocking, e.g. on stdin. It reads ahead in the background, and calls
+// idle whenever it has to wait for r.
+type stoppableReader struct {
+	r       io.Reader
+	idle    func()
+	stopped chan struct{}
+	once    sync.Once
+	results chan readResult
+	bufs    [2][]byte
+	next    int
+	rest    []byte
+	err     error
+	// a read of r has not been returned yet
+	pending bool
+}
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+func newStoppableReader(r io.Reader, idle func()) *stoppableReader {
+	s := &stoppableReader{
+		r:       r,
+		idle:    idle,
+		stopped: make(chan struct{}),
+		results: make(chan readResult, 1),
+		bufs:    [2][]byte{make([]byte, 64*1024), make([]byte, 64*1024)},
+	}
+	s.readAhead()
+	return s
+}
+
+// readAhead reads into the next buffer in the background
+func (s *stoppableReader) readAhead() {
+	buf := s.bufs[s.next]
+	s.next = 1 - s.next
+	s.pending = true
+	go func() {
+		n, err := s.r.Read(buf)
+		s.results <- readResult{buf[:n], err}
+	}()
+}
+
+func (s *stoppableReader) Read(p []byte) (int, error) {
+	if len(s.rest) == 0 && s.err == nil {
+		var result readResult
+		select {
+		case result = <-s.results:
+		default:
+			// nothing to read right now
+			s.idle()
+			select {
+			case result = <-s.results:
+			case <-s.stopped:
+				// data read meanwhile is still returned, a read that is still
+				// blocking is abandoned
+				select {
+				case result = <-s.results:
+				default:
+					s.err = io.EOF
+					return 0, s.err
+				}
+			}
+		}
+		s.pending = false
+		s.rest, s.err = result.data, result.err
+		if s.err == nil {
+			select {
+			case <-s.stopped:
+				s.err = io.EOF
+			default:
+				s.readAhead()
+			}
+		}
+	}
+	n := copy(p, s.rest)
+	s.rest = s.rest[n:]
+	if len(s.rest) == 0 && s.err != nil {
+		return n, s.err
+	}
+	return n, nil
+}
+
+// Wait waits for a read abandoned by Stop to return, e.g. because r has been
+// closed
+func (s *stoppableReader) Wait() {
+	if s.pending {
+		<-s.results
+		s.pending = false
+	}
+}
+
+// Stop makes reads return io.EOF once the data already read from r has been
+// returned
+func (s *stoppableReader) Stop() {
+	s.once.Do(func() {
+		close(s.stopped)
+	})
+}
+
+// runInput anonymizes --input or stdin until its end or until stopped. The
+// output is flushed whenever the input is idle.
+func runInput(anonymizer *anonip.Anonymizer, args Args, run runFunc) error {
+	output := args.buffered(args.Output)
+	input := newStoppableReader(args.Input, func() { _ = output.Flush() })
+	defer handleSignals(args, nil, input.Stop)()
+	if err := run(anonymizer, input, output); err != nil {
+		return err
+	}
+	return output.Flush()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/open-dynaMIX/anonip-go/anonip"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunSignals(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("there is no SIGHUP on windows")
+	}
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		log.Fatal(err)
+	}
+	output := filepath.Join(dir, "sub", "out.log")
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer w.Close()
+
+	var got int
+	oldOsExit := osExit
+	oldStderr := os.Stderr
+	os.Stderr, _ = os.Open("/dev/null")
+	oldLogReader := defaultLogReader
+	defaultLogReader = r
+	defer func() {
+		os.Args = []string{"anonip"}
+		osExit = oldOsExit
+		os.Stderr = oldStderr
+		defaultLogReader = oldLogReader
+	}()
+	osExit = func(code int) {
+		got = code
+	}
+
+	// lines are only flushed when the input is idle
+	os.Args = []string{"anonip", "--output", output, "--flush-interval", "0"}
+	args, _, err := parseArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		Run(args)
+		close(done)
+	}()
+	_, _ = w.WriteString("1.2.3.4\n")
+	waitForFile(t, output, "1.2.0.0\n")
+
+	// the output is reopened after it has been moved away
+	if err := os.Rename(output, output+".1"); err != nil {
+		log.Fatal(err)
+	}
+	signals <- syscall.SIGHUP
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && !exists(output); time.Sleep(10 * time.Millisecond) {
+	}
+	_, _ = w.WriteString("3.4.5.6\n")
+	waitForFile(t, output, "3.4.0.0\n")
+
+	// a failing reopen keeps the current output
+	if err := os.Rename(filepath.Join(dir, "sub"), filepath.Join(dir, "moved")); err != nil {
+		log.Fatal(err)
+	}
+	signals <- syscall.SIGHUP
+	_, _ = w.WriteString("5.6.7.8\n")
+	waitForFile(t, filepath.Join(dir, "moved", "out.log"), "3.4.0.0\n5.6.0.0\n")
+
+	// stopped while a read blocks
+	signals <- syscall.SIGTERM
+	<-done
+	assert.Equal(t, 0, got)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestRunFilesStop(t *testing.T) {
+	dir := writeLogs()
+	defer os.RemoveAll(dir)
+
+	defer func() { os.Args = []string{"anonip"} }()
+	os.Args = []string{"anonip", "--input", dir, "--output", os.DevNull}
+	args, _, err := parseArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// what has been read of the file being processed is written, the others
+	// are skipped
+	var processed []string
+	err = runFiles(args, func(a *anonip.Anonymizer, r io.Reader, w io.Writer) error {
+		signals <- syscall.SIGTERM
+		time.Sleep(50 * time.Millisecond)
+		content, err := ioutil.ReadAll(r)
+		processed = append(processed, string(content))
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1.2.3.4\n"}, processed)
+}
+
+func TestStoppableReader(t *testing.T) {
+	// data read before stopping is still returned
+	input := newStoppableReader(strings.NewReader("1.2.3.4\n"), func() {})
+	for len(input.results) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	input.Stop()
+	content, err := ioutil.ReadAll(input)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.4\n", string(content))
+
+	// a blocking read is abandoned
+	r, w := io.Pipe()
+	defer w.Close()
+	var blocking *stoppableReader
+	blocking = newStoppableReader(r, func() { blocking.Stop() })
+	n, err := blocking.Read(make([]byte, 10))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+	n, err = blocking.Read(make([]byte, 10))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRunFilesStopBlocking(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("pipes can only be opened by their path on linux")
+	}
+	dir, err := ioutil.TempDir("", "anonip")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "out.log")
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	defer func() { os.Args = []string{"anonip"} }()
+	os.Args = []string{"anonip", "--input", fmt.Sprintf("/proc/self/fd/%d", r.Fd()), "--output", output}
+	args, _, err := parseArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer args.OutputFile.Close()
+
+	// the writer keeps the pipe open
+	_, _ = w.WriteString("1.2.3.4\n")
+	done := make(chan error)
+	go func() {
+		done <- runFiles(args, (*anonip.Anonymizer).Run)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	signals <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the reading to stop")
+	}
+	result, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.0.0\n", string(result))
+}